@@ -3,7 +3,7 @@ module mhist
 go 1.22.2
 
 require (
-	github.com/creack/pty v1.1.24 // indirect
-	golang.org/x/sys v0.28.0 // indirect
-	golang.org/x/term v0.27.0 // indirect
+	github.com/creack/pty v1.1.24
+	golang.org/x/sys v0.28.0
+	golang.org/x/term v0.27.0
 )
@@ -1,35 +1,118 @@
+//go:build unix
+
 package main
 
 import (
-	"crypto/rand"
-	"encoding/json"
+	"encoding/hex"
 	"fmt"
 	"log"
-	"net"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
+
+	"mhist/mux"
 )
 
 const usage = `Usage: mhist [command] [options]
 
 Commands:
   new [-n name]       Create a new session
+      --attach-if-exists
+                      Attach to the session called name instead, if there
+                      is one
+      --shell path    Run this shell instead of $SHELL
+      --login         Start the shell as a login shell
+      --scrollback n  Keep n lines of scrollback (default 10000)
+      --replay-buffer size
+                      Keep this much output (e.g. 256k) to redraw the screen
+                      on attach (default 64k, grown to fit the terminal)
+      --raw-scrollback
+                      Keep scrollback as raw output rather than lines, for
+                      output that isn't line oriented
+      --record file   Record output as an asciinema cast file
+      --log file      Append output to a plain log file as it is written
+      --log-timestamps
+                      Start each line of the --log file with the time
+      --no-clipboard  Don't let programs in the session set the clipboard
+                      (OSC 52)
+      --init command  Type command into the shell once it has started
+      --max-sessions n
+                      Refuse to start if n sessions are already running
+                      (default $MHIST_MAX_SESSIONS; 0 means no limit)
+      --listen addr   Also accept clients over TLS on a TCP address
+                      (host:port); needs all three of:
+      --tls-cert file --tls-key file
+                      The listener's certificate
+      --tls-ca file   Require clients to present a certificate signed by this CA
+  ensure -n name [-- command]
+                      Attach to the session called name, or start it if
+                      there is none, typing command into its shell; takes
+                      new's options too
   attach [name|id]    Attach to an existing session
+      --no-redraw     Don't replay the current screen; show new output only
+      --banner        Show the session's name, ID and start time briefly
+      --no-takeover   Give up if the session is attached elsewhere rather
+                      than detaching the other client
+      --sanitize      Strip sequences that could query or retitle the
+                      terminal from the redraw and history
+      --term name     Report this TERM to the session instead of $TERM
+      --connect addr  Attach over TLS to a session listening on addr,
+                      verifying the server against system roots
+      --tls-ca file   Verify the server against this CA instead
+      --tls-cert file --tls-key file
+                      Present a client certificate, which the session requires
+      --tls-insecure  Skip server certificate verification
+  play file.cast [-n name]
+                      Play back a recording in a new session, with scrollback
   ls                  List sessions
   kill [name|id]      Kill a session
+  detach [name|id]    Detach the client attached to a session, leaving it
+                      running
+  clear [name|id]     Wipe a session's scrollback
+  stat [name|id]      Show a session's scrollback usage and state
+  export [name|id] file
+                      Save a session's scrollback to file, with "\n" line
+                      endings
+      --plain         Strip escape sequences, leaving plain text
+      --raw           Save it as it would be replayed, escape sequences,
+                      carriage returns and all
+  send [name|id] [text | --key key]...
+                      Type text and keys (e.g. Enter, C-c, C-d) into a
+                      session without attaching
+  signal [name|id] sig
+                      Send a signal (e.g. TERM, HUP, USR1 or a number) to
+                      a session's shell, leaving the session running
 
 Options:
   --help              Show this help message
 
 With no arguments, attaches to the most recent session or creates a new one.
+A session is named by its name, its number in ls, or a prefix of its ID,
+tried in that order.
+
+Defaults for the prefix key, shell, scrollback, scroll step and socket
+directory can be set in ~/.config/mhist/config; flags and environment
+variables take precedence.
 
 Prefix key: Ctrl+a
   Ctrl+a d            Detach from session
-  Ctrl+a Ctrl+a       Send literal Ctrl+a`
+  Ctrl+a Ctrl+a       Send literal Ctrl+a
+  Ctrl+a q            Send the next key as it is
+  Ctrl+a ]            Paste the last scroll mode copy
+  Ctrl+a Ctrl+z       Suspend the client
+  Ctrl+a Space        Pause or resume live output
+  Ctrl+a K            Wipe the session's scrollback`
+
+// config is the user's config file, loaded at startup.
+var config = mux.DefaultConfig()
+
+// store is where commands look up sessions.
+var store mux.SessionStore = mux.FileStore{}
 
 func main() {
 	args := os.Args[1:]
@@ -38,38 +121,165 @@ func main() {
 	for _, arg := range args {
 		if len(arg) > 13 && arg[:13] == "--session-id=" {
 			sessionID := arg[13:]
-			name := ""
-			for _, a := range args {
-				if len(a) > 7 && a[:7] == "--name=" {
-					name = a[7:]
-				}
+			opts := sessionOptions{
+				shell:      flagValue(args, "--shell="),
+				login:      hasFlag(args, "--login"),
+				keepLogs:   hasFlag(args, "--keep-logs"),
+				scrollback: atoiOrZero(flagValue(args, "--scrollback=")),
+				raw:        hasFlag(args, "--raw-scrollback"),
+				replayBuf:  atoiOrZero(flagValue(args, "--replay-buffer=")),
+				rows:       atoiOrZero(flagValue(args, "--rows=")),
+				cols:       atoiOrZero(flagValue(args, "--cols=")),
+				record:     flagValue(args, "--record="),
+				logFile:    flagValue(args, "--log="),
+				logTimes:   hasFlag(args, "--log-timestamps"),
+				noClip:     hasFlag(args, "--no-clipboard"),
+				init:       flagValue(args, "--init="),
+				play:       flagValue(args, "--play="),
+				listen:     flagValue(args, "--listen="),
+				tls: tlsOptions{
+					cert: flagValue(args, "--tls-cert="),
+					key:  flagValue(args, "--tls-key="),
+					ca:   flagValue(args, "--tls-ca="),
+				},
 			}
-			runSession(sessionID, name)
+			runSession(sessionID, flagValue(args, "--name="), opts)
 			return
 		}
 	}
 
+	cfg, err := mux.LoadConfig(mux.ConfigPath())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	config = cfg
+	if config.SocketDir != "" && os.Getenv("MHIST_SOCKET_DIR") == "" {
+		// Set rather than pass along, so session processes started from
+		// here use the same directory.
+		os.Setenv("MHIST_SOCKET_DIR", config.SocketDir)
+	}
+	if config.Timeout > 0 && os.Getenv("MHIST_TIMEOUT") == "" {
+		mux.DialTimeout = config.Timeout
+	}
+	if mux.Debugging() {
+		startClientLog()
+	}
+
 	if len(args) == 0 {
 		cmdDefault()
 		return
 	}
 
 	switch args[0] {
-	case "new":
+	case "new", "ensure":
 		name := ""
+		var opts sessionOptions
+		if args[0] == "ensure" {
+			opts.attachIfExists = true
+		}
 		for i := 1; i < len(args); i++ {
-			if args[i] == "-n" && i+1 < len(args) {
+			if args[i] == "--" && args[0] == "ensure" {
+				opts.init = strings.Join(args[i+1:], " ")
+				break
+			} else if args[i] == "-n" && i+1 < len(args) {
 				name = args[i+1]
 				i++
+			} else if args[i] == "--login" {
+				opts.login = true
+			} else if args[i] == "--attach-if-exists" {
+				opts.attachIfExists = true
+			} else if args[i] == "--replay-buffer" && i+1 < len(args) {
+				n, err := mux.ParseSize(args[i+1])
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: invalid --replay-buffer: %v\n", err)
+					os.Exit(1)
+				}
+				opts.replayBuf = n
+				i++
+			} else if args[i] == "--raw-scrollback" {
+				opts.raw = true
+			} else if args[i] == "--scrollback" && i+1 < len(args) {
+				n, err := strconv.Atoi(args[i+1])
+				if err != nil || n <= 0 {
+					fmt.Fprintf(os.Stderr, "Error: invalid --scrollback %q\n", args[i+1])
+					os.Exit(1)
+				}
+				opts.scrollback = n
+				i++
+			} else if args[i] == "--max-sessions" && i+1 < len(args) {
+				opts.maxSessions = args[i+1]
+				i++
+			} else if args[i] == "--record" && i+1 < len(args) {
+				opts.record = args[i+1]
+				i++
+			} else if args[i] == "--log" && i+1 < len(args) {
+				opts.logFile = args[i+1]
+				i++
+			} else if args[i] == "--log-timestamps" {
+				opts.logTimes = true
+			} else if args[i] == "--no-clipboard" {
+				opts.noClip = true
+			} else if args[i] == "--init" && i+1 < len(args) {
+				opts.init = args[i+1]
+				i++
+			} else if args[i] == "--shell" && i+1 < len(args) {
+				opts.shell = args[i+1]
+				i++
+			} else if args[i] == "--listen" && i+1 < len(args) {
+				opts.listen = args[i+1]
+				i++
+			} else if n := parseTLSFlag(args, i, &opts.tls); n > 0 {
+				i += n - 1
 			}
 		}
-		cmdNew(name)
+		cmdNew(name, opts)
 	case "attach":
 		target := ""
-		if len(args) > 1 {
-			target = args[1]
+		connect := ""
+		var tlsOpts tlsOptions
+		var clientOpts mux.ClientOptions
+		for i := 1; i < len(args); i++ {
+			if args[i] == "--banner" {
+				config.Banner = true
+			} else if args[i] == "--no-redraw" {
+				clientOpts.NoRedraw = true
+			} else if args[i] == "--no-takeover" {
+				clientOpts.NoTakeover = true
+			} else if args[i] == "--sanitize" {
+				clientOpts.Sanitize = true
+			} else if args[i] == "--term" && i+1 < len(args) {
+				clientOpts.Term = args[i+1]
+				i++
+			} else if args[i] == "--connect" && i+1 < len(args) {
+				connect = args[i+1]
+				i++
+			} else if n := parseTLSFlag(args, i, &tlsOpts); n > 0 {
+				i += n - 1
+			} else if target == "" {
+				target = args[i]
+			}
 		}
-		cmdAttach(target)
+		if connect != "" {
+			cmdConnect(connect, tlsOpts, clientOpts)
+			return
+		}
+		cmdAttach(target, clientOpts)
+	case "play":
+		name, file := "", ""
+		for i := 1; i < len(args); i++ {
+			if args[i] == "-n" && i+1 < len(args) {
+				name = args[i+1]
+				i++
+			} else if file == "" {
+				file = args[i]
+			}
+		}
+		if file == "" {
+			fmt.Fprintf(os.Stderr, "Usage: mhist play file.cast [-n name]\n")
+			os.Exit(1)
+		}
+		cmdPlay(file, name)
 	case "ls":
 		cmdList()
 	case "kill":
@@ -78,6 +288,54 @@ func main() {
 			os.Exit(1)
 		}
 		cmdKill(args[1])
+	case "detach":
+		if len(args) < 2 {
+			fmt.Fprintf(os.Stderr, "Usage: mhist detach [name|id]\n")
+			os.Exit(1)
+		}
+		cmdDetach(args[1])
+	case "clear":
+		if len(args) < 2 {
+			fmt.Fprintf(os.Stderr, "Usage: mhist clear [name|id]\n")
+			os.Exit(1)
+		}
+		cmdClear(args[1])
+	case "send":
+		if len(args) < 3 {
+			fmt.Fprintf(os.Stderr, "Usage: mhist send [name|id] [text | --key key]...\n")
+			os.Exit(1)
+		}
+		cmdSend(args[1], args[2:])
+	case "signal":
+		if len(args) < 3 {
+			fmt.Fprintf(os.Stderr, "Usage: mhist signal [name|id] sig\n")
+			os.Exit(1)
+		}
+		cmdSignal(args[1], args[2])
+	case "export":
+		var targets []string
+		mode := exportText
+		for i := 1; i < len(args); i++ {
+			switch args[i] {
+			case "--plain":
+				mode = exportPlain
+			case "--raw":
+				mode = exportRaw
+			default:
+				targets = append(targets, args[i])
+			}
+		}
+		if len(targets) != 2 {
+			fmt.Fprintf(os.Stderr, "Usage: mhist export [name|id] file [--plain | --raw]\n")
+			os.Exit(1)
+		}
+		cmdExport(targets[0], targets[1], mode)
+	case "stat":
+		target := ""
+		if len(args) > 1 {
+			target = args[1]
+		}
+		cmdStat(target)
 	case "--help", "-h", "help":
 		fmt.Println(usage)
 	default:
@@ -87,49 +345,426 @@ func main() {
 	}
 }
 
-func runSession(id, name string) {
+// startClientLog sends this process's log, where protocol traces go, to
+// a file next to the session logs, since the terminal is taken.
+func startClientLog() {
+	dir, err := mux.EnsureSocketDir()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: no client log: %v\n", err)
+		return
+	}
+	path := filepath.Join(dir, fmt.Sprintf("client-%d.log", os.Getpid()))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: no client log: %v\n", err)
+		return
+	}
+	log.SetOutput(f)
+	fmt.Fprintf(os.Stderr, "Logging protocol trace to %s\n", path)
+}
+
+// sessionOptions holds the settings passed from `mhist new` to the
+// background session process.
+type sessionOptions struct {
+	shell      string     // shell to run; empty means $SHELL
+	login      bool       // start the shell as a login shell
+	scrollback int        // scrollback lines; 0 means the session default
+	raw        bool       // keep raw scrollback rather than lines
+	replayBuf  int        // replay buffer bytes; 0 means the session default
+	rows, cols int        // initial terminal size; 0 means unknown
+	keepLogs   bool       // keep the session log after a clean exit
+	record     string     // asciinema cast file to record output to
+	logFile    string     // plain file to log output to
+	logTimes   bool       // timestamp each line of logFile
+	noClip     bool       // drop OSC 52 clipboard writes
+	init       string     // command typed into the shell once it starts
+	play       string     // cast file to play back instead of running a shell
+	listen     string     // optional TCP listen address
+	tls        tlsOptions // TLS settings for the TCP listener
+
+	// maxSessions is the --max-sessions value, checked before launching
+	// rather than passed to the session. Empty means $MHIST_MAX_SESSIONS.
+	maxSessions string
+
+	// attachIfExists makes `mhist new -n name` attach to the session
+	// called name rather than start another, if there is one.
+	attachIfExists bool
+}
+
+// args returns the internal command-line flags encoding the options.
+func (o sessionOptions) args() []string {
+	var args []string
+	if o.shell != "" {
+		args = append(args, "--shell="+o.shell)
+	}
+	if o.login {
+		args = append(args, "--login")
+	}
+	if o.scrollback > 0 {
+		args = append(args, "--scrollback="+strconv.Itoa(o.scrollback))
+	}
+	if o.raw {
+		args = append(args, "--raw-scrollback")
+	}
+	if o.replayBuf > 0 {
+		args = append(args, "--replay-buffer="+strconv.Itoa(o.replayBuf))
+	}
+	if o.keepLogs {
+		args = append(args, "--keep-logs")
+	}
+	if o.logTimes {
+		args = append(args, "--log-timestamps")
+	}
+	if o.noClip {
+		args = append(args, "--no-clipboard")
+	}
+	if o.init != "" {
+		args = append(args, "--init="+o.init)
+	}
+	if o.rows > 0 && o.cols > 0 {
+		args = append(args, "--rows="+strconv.Itoa(o.rows), "--cols="+strconv.Itoa(o.cols))
+	}
+	if o.listen != "" {
+		args = append(args, "--listen="+o.listen)
+	}
+	// The session process runs in the same directory, but resolve paths
+	// anyway so the log shows exactly which files were used.
+	for _, f := range []struct{ flag, path string }{
+		{"--tls-cert=", o.tls.cert},
+		{"--tls-key=", o.tls.key},
+		{"--tls-ca=", o.tls.ca},
+		{"--record=", o.record},
+		{"--log=", o.logFile},
+		{"--play=", o.play},
+	} {
+		if f.path == "" {
+			continue
+		}
+		if abs, err := filepath.Abs(f.path); err == nil {
+			f.path = abs
+		}
+		args = append(args, f.flag+f.path)
+	}
+	return args
+}
+
+// withConfig fills in settings left unset on the command line from the
+// config file.
+func (o sessionOptions) withConfig(cfg *mux.Config) sessionOptions {
+	if o.shell == "" {
+		o.shell = cfg.Shell
+	}
+	if o.scrollback == 0 {
+		o.scrollback = cfg.Scrollback
+	}
+	if o.replayBuf == 0 {
+		o.replayBuf = cfg.ReplayBuf
+	}
+	o.keepLogs = o.keepLogs || cfg.KeepLogs
+	o.noClip = o.noClip || cfg.NoClipboard
+	return o
+}
+
+// atoiOrZero parses s as an integer, returning 0 if it isn't one.
+func atoiOrZero(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+// hasFlag reports whether args contains flag exactly.
+func hasFlag(args []string, flag string) bool {
+	for _, a := range args {
+		if a == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTLSFlag parses a TLS flag at args[i] into o. Returns the number of
+// arguments consumed, or 0 if args[i] is not a TLS flag.
+func parseTLSFlag(args []string, i int, o *tlsOptions) int {
+	switch args[i] {
+	case "--tls":
+		o.enabled = true
+		return 1
+	case "--tls-insecure":
+		o.insecure = true
+		return 1
+	}
+	if i+1 >= len(args) {
+		return 0
+	}
+	switch args[i] {
+	case "--tls-cert":
+		o.cert = args[i+1]
+	case "--tls-key":
+		o.key = args[i+1]
+	case "--tls-ca":
+		o.ca = args[i+1]
+	default:
+		return 0
+	}
+	return 2
+}
+
+// flagValue returns the value of the first "--flag=value" argument with the
+// given prefix, or "" if there is none.
+func flagValue(args []string, prefix string) string {
+	for _, a := range args {
+		if strings.HasPrefix(a, prefix) {
+			return a[len(prefix):]
+		}
+	}
+	return ""
+}
+
+func runSession(id, name string, opts sessionOptions) {
+	// Having no controlling terminal, the session only gets a hangup if
+	// something sends it one on purpose, e.g. killing the launching
+	// terminal's whole process tree; it should outlive that too. It is
+	// caught rather than ignored, since an ignored signal stays ignored in
+	// the shell and everything it runs.
+	signal.Notify(make(chan os.Signal, 1), syscall.SIGHUP)
 	log.Printf("session starting: id=%s name=%s", id, name)
-	sess, err := NewSession(id, name, "")
+	var sess *mux.Session
+	var err error
+	if opts.play != "" {
+		sess, err = mux.NewPlayback(id, name, opts.play)
+	} else {
+		sess, err = mux.NewSession(id, name, mux.SessionOptions{
+			Shell:         opts.shell,
+			Login:         opts.login,
+			Record:        opts.record,
+			Log:           opts.logFile,
+			LogTimestamps: opts.logTimes,
+			NoClipboard:   opts.noClip,
+			Init:          opts.init,
+			Scrollback:    opts.scrollback,
+			RawScrollback: opts.raw,
+			ReplayBuffer:  opts.replayBuf,
+			Rows:          opts.rows,
+			Cols:          opts.cols,
+		})
+	}
 	if err != nil {
 		log.Fatalf("failed to create session: %v", err)
 	}
+	if opts.listen != "" {
+		cfg, err := opts.tls.serverConfig()
+		if err != nil {
+			sess.Close()
+			log.Fatalf("failed to create session: %v", err)
+		}
+		if err := sess.Listen(mux.TLSTransport{Config: cfg}, opts.listen); err != nil {
+			sess.Close()
+			log.Fatalf("failed to create session: %v", err)
+		}
+		log.Printf("session %s: listening on %s", id, opts.listen)
+	}
 	sess.Run()
+
+	// The session ended cleanly, so the log has nothing worth keeping
+	// unless it has a protocol trace. A crash never gets here and leaves
+	// it for a post-mortem.
+	if !opts.keepLogs && !mux.Debugging() {
+		os.Remove(sessionLogPath(id))
+	}
+}
+
+// sessionLogPath returns where a session process's output is logged.
+func sessionLogPath(id string) string {
+	return filepath.Join(mux.SocketDir(), id+".log")
+}
+
+func cmdNew(name string, opts sessionOptions) {
+	unlock := func() {}
+	if opts.attachIfExists {
+		if name == "" {
+			fmt.Fprintf(os.Stderr, "Error: a session name (-n) is needed to look for the session\n")
+			os.Exit(1)
+		}
+		// Held until the session is started and listed, so that of two
+		// commands doing this at once, the second attaches to the
+		// session the first started
+		var err error
+		unlock, err = lockName(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if info, ok := mux.SessionNamed(store.List(), name); ok {
+			unlock()
+			runClientLoop(mux.UnixTransport{}, info.Socket, info.ID, info.Name, mux.ClientOptions{
+				Rows: info.Rows,
+				Cols: info.Cols,
+			})
+			return
+		}
+	}
+
+	id := mux.GenerateID()
+	if name == "" {
+		name = id[:8]
+	}
+
+	opts = opts.withConfig(config)
+	if opts.shell != "" {
+		// Resolve now so a bad --shell is reported here, not in the session log
+		shell, err := mux.ResolveShell(opts.shell)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		opts.shell = shell
+	}
+	if opts.tls.active() && opts.listen == "" {
+		fmt.Fprintf(os.Stderr, "Error: TLS options require --listen\n")
+		os.Exit(1)
+	}
+	if opts.listen != "" {
+		// Fail early rather than leaving the error in the session log
+		if _, err := opts.tls.serverConfig(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	socketPath, err := launchSessionProcess(id, name, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if opts.attachIfExists {
+		waitListed(id)
+	}
+	unlock()
+
+	runClientLoop(mux.UnixTransport{}, socketPath, id, name, mux.ClientOptions{})
 }
 
-func cmdNew(name string) {
-	id := generateID()
+// lockName takes a lock on a session name, for starting a session with
+// that name only if there isn't one already. The returned function
+// releases it; so does exiting.
+func lockName(name string) (func(), error) {
+	dir, err := mux.EnsureSocketDir()
+	if err != nil {
+		return nil, err
+	}
+	// Any name makes a safe file name in hex. The files are left behind,
+	// since removing one could let a third command lock a new file while
+	// a second holds the old one.
+	path := filepath.Join(dir, "name-"+hex.EncodeToString([]byte(name))+".lock")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("lock session name: %w", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("lock session name: %w", err)
+	}
+	return func() { f.Close() }, nil
+}
+
+// waitListed waits briefly for a session just launched to be listed. Its
+// socket appears just before its info file is written.
+func waitListed(id string) {
+	for i := 0; i < 50; i++ {
+		if _, ok := store.Get(id); ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// cmdPlay plays a recording in a new session. The session only exists
+// for viewing, so it is killed once the client leaves it.
+func cmdPlay(file, name string) {
+	if err := mux.CheckCast(file); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	id := mux.GenerateID()
 	if name == "" {
 		name = id[:8]
 	}
+	socketPath, err := launchSessionProcess(id, name, sessionOptions{play: file})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
 
-	socketPath, err := launchSessionProcess(id, name)
+	runClientLoop(mux.UnixTransport{}, socketPath, id, name, mux.ClientOptions{})
+
+	if info, ok := store.Get(id); ok {
+		mux.KillSession(info)
+	}
+}
+
+// findSession returns the session target names, exiting if there is none.
+// If target could mean another session too, it says which it picked.
+func findSession(target string) mux.SessionInfo {
+	info, hint, err := mux.ResolveSession(store.List(), target)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
+	if hint != "" {
+		fmt.Fprintf(os.Stderr, "Note: %s\n", hint)
+	}
+	return info
+}
 
-	runClientLoop(socketPath, id, name)
+func cmdAttach(target string, clientOpts mux.ClientOptions) {
+	info := findSession(target)
+	// Used if the terminal's own size can't be read
+	clientOpts.Rows, clientOpts.Cols = info.Rows, info.Cols
+
+	runClientLoop(mux.UnixTransport{}, info.Socket, info.ID, info.Name, clientOpts)
 }
 
-func cmdAttach(target string) {
-	sessions := listSessions()
-	info, err := findSession(sessions, target)
+// cmdConnect attaches to a session listening on a TCP address. Listeners
+// always serve TLS, so so does the connection.
+func cmdConnect(addr string, tlsOpts tlsOptions, clientOpts mux.ClientOptions) {
+	cfg, err := tlsOpts.clientConfig(addr)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
+	runClientLoop(mux.TLSTransport{Config: cfg}, addr, "", addr, clientOpts)
+}
 
-	runClientLoop(info.Socket, info.ID, info.Name)
+// attachBanner is the banner shown on attaching to a session, if enabled.
+func attachBanner(id, name string) string {
+	banner := "attached to " + name
+	if info, ok := store.Get(id); ok {
+		banner += fmt.Sprintf(" (%.8s)", info.ID)
+		if created, err := time.Parse(time.RFC3339, info.Created); err == nil {
+			banner += ", started " + created.Local().Format("Jan 2 15:04")
+		}
+	}
+	return "[" + banner + "]"
 }
 
 func cmdDefault() {
-	cmdNew("")
+	cmdNew("", sessionOptions{})
 }
 
 // runClientLoop runs the client, handling session switches in a loop.
-func runClientLoop(socketPath, id, name string) {
+// Sessions switched to from the picker are always local Unix sockets.
+func runClientLoop(t mux.Transport, addr, id, name string, opts mux.ClientOptions) {
+	opts.Keymap = &config.Keymap
+	opts.ScrollLines = config.ScrollLines
+	opts.SplitRows = config.SplitRows
+	opts.TabWidth = config.TabWidth
+	opts.Sanitize = opts.Sanitize || config.Sanitize
+
 	for {
-		client, err := NewClient(socketPath, id, name)
+		if config.Banner {
+			opts.Banner = attachBanner(id, name)
+		}
+		client, err := mux.DialClient(t, addr, id, name, opts)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error connecting to session: %v\n", err)
 			os.Exit(1)
@@ -145,104 +780,250 @@ func runClientLoop(socketPath, id, name string) {
 			return
 		}
 
-		// Switch to another session
+		// Switch to another session, which always gets a full redraw
 		target := client.SwitchTarget
+		opts.NoRedraw = false
 		if target.ID == "" {
 			// Create new session
-			newID := generateID()
+			newID := mux.GenerateID()
 			newName := newID[:8]
-			sp, err := launchSessionProcess(newID, newName)
+			sp, err := launchSessionProcess(newID, newName, sessionOptions{})
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "Error creating session: %v\n", err)
 				os.Exit(1)
 			}
-			socketPath, id, name = sp, newID, newName
+			addr, id, name = sp, newID, newName
+			opts.Rows, opts.Cols = 0, 0
 		} else {
-			socketPath, id, name = target.Socket, target.ID, target.Name
+			addr, id, name = target.Socket, target.ID, target.Name
+			opts.Rows, opts.Cols = target.Rows, target.Cols
 		}
+		t = mux.UnixTransport{}
 	}
 }
 
 func cmdList() {
-	fmt.Printf("%-8s  %-15s  %-20s  %s\n", "ID", "NAME", "CREATED", "STATUS")
-	sessions := listSessions()
-	for _, info := range sessions {
+	fmt.Printf("%3s  %-8s  %-15s  %-20s  %s\n", "#", "ID", "NAME", "CREATED", "STATUS")
+	sessions := store.List()
+	for i, info := range sessions {
 		shortID := info.ID
 		if len(shortID) > 8 {
 			shortID = shortID[:8]
 		}
 		status := "alive"
-		if !isProcessAlive(info.PID) {
+		if !mux.IsSessionAlive(info) {
 			status = "dead"
 		}
-		fmt.Printf("%-8s  %-15s  %-20s  %s\n", shortID, info.Name, info.Created, status)
+		fmt.Printf("%3d  %-8s  %-15s  %-20s  %s\n", i+1, shortID, info.Name, info.Created, status)
 	}
 }
 
 func cmdKill(target string) {
-	sessions := listSessions()
-	info, err := findSession(sessions, target)
+	info := findSession(target)
+
+	mux.KillSession(info)
+	fmt.Printf("killed session %s\n", info.Name)
+}
+
+func cmdDetach(target string) {
+	info := findSession(target)
+
+	if err := mux.DetachSession(info); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("detached session %s\n", info.Name)
+}
+
+func cmdClear(target string) {
+	info := findSession(target)
+
+	if err := mux.ClearSessionHistory(info); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("cleared history of session %s\n", info.Name)
+}
+
+// cmdSend types args into a session; see sendData.
+func cmdSend(target string, args []string) {
+	data, err := sendData(args)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
+	info := findSession(target)
 
-	killSession(info)
-	fmt.Printf("killed session %s\n", info.Name)
+	if err := mux.SendInput(info, data); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
 }
 
-// killSession kills a session by sending MsgKill via its socket, falling back
-// to a direct process kill, and cleaning up socket/info files.
-func killSession(info SessionInfo) {
-	// Try sending MsgKill via socket
-	conn, dialErr := net.Dial("unix", info.Socket)
-	if dialErr == nil {
-		encoded := Encode(Message{Type: MsgKill, Payload: nil})
-		conn.Write(encoded)
-		conn.Close()
-		return
+// sendData returns the input `mhist send` types for args: each is sent as
+// is, except that "--key k" sends key k, named as in the config file.
+func sendData(args []string) ([]byte, error) {
+	var data []byte
+	for i := 0; i < len(args); i++ {
+		if args[i] != "--key" {
+			data = append(data, args[i]...)
+			continue
+		}
+		if i+1 >= len(args) {
+			return nil, fmt.Errorf("--key needs a key name")
+		}
+		key, err := mux.ParseKey(args[i+1])
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, key)
+		i++
 	}
+	return data, nil
+}
 
-	// Fallback: kill the process directly
-	proc, err := os.FindProcess(info.PID)
-	if err == nil {
-		proc.Kill()
+func cmdSignal(target, name string) {
+	sig, err := mux.ParseSignal(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
 	}
+	info := findSession(target)
 
-	// Clean up stale files
-	os.Remove(info.Socket)
-	infoPath := filepath.Join(socketDir(), info.ID+".json")
-	os.Remove(infoPath)
+	if err := mux.SignalSession(info, sig); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("sent %v to session %s\n", sig, info.Name)
+}
+
+func cmdStat(target string) {
+	info := findSession(target)
+
+	stats, err := mux.QueryStats(info)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	attached := "no"
+	if stats.Attached {
+		attached = "yes"
+	}
+	shortID := info.ID
+	if len(shortID) > 8 {
+		shortID = shortID[:8]
+	}
+	fmt.Printf("session   %s (%s)\n", info.Name, shortID)
+	fmt.Printf("lines     %d / %d\n", stats.Lines, stats.Capacity)
+	fmt.Printf("bytes     %d (+%d replay)\n", stats.Bytes, stats.ReplayBytes)
+	fmt.Printf("uptime    %s\n", time.Duration(stats.Uptime)*time.Second)
+	fmt.Printf("attached  %s\n", attached)
+}
+
+// exportMode is how `mhist export` writes scrollback.
+type exportMode int
+
+const (
+	exportText  exportMode = iota // lines as output, ending in "\n"
+	exportPlain                   // lines without escape sequences
+	exportRaw                     // as replayed to a client
+)
+
+// exportLines asks for more lines than any scrollback holds, for all of it.
+const exportLines = 1 << 30
+
+// exportTimeout bounds how long a session has to send its scrollback,
+// which can be a lot more than the other queries answer with.
+const exportTimeout = 30 * time.Second
+
+func cmdExport(target, file string, mode exportMode) {
+	info := findSession(target)
+
+	data, err := exportData(info, mode)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("exported %d bytes of session %s to %s\n", len(data), info.Name, file)
+}
+
+// exportData returns a session's scrollback as `mhist export` writes it.
+func exportData(info mux.SessionInfo, mode exportMode) ([]byte, error) {
+	if mode == exportRaw {
+		return mux.QueryRawHistory(info, exportLines, exportTimeout)
+	}
+	lines, err := mux.QueryHistory(info, exportLines, exportTimeout)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	for _, line := range lines {
+		if mode == exportPlain {
+			line = mux.StripEscapes(line)
+		}
+		data = append(data, line...)
+		data = append(data, '\n')
+	}
+	return data, nil
 }
 
 // printExitMessage prints the appropriate message after a client exits.
-func printExitMessage(client *Client, name string) {
-	if client.detached {
-		fmt.Fprintf(os.Stderr, "detached from session %s\n", name)
-	} else {
+func printExitMessage(client *mux.Client, name string) {
+	switch client.DetachReason() {
+	case mux.DetachNone:
 		fmt.Fprintf(os.Stderr, "session ended\n")
+	case mux.DetachTakeover:
+		fmt.Fprintf(os.Stderr, "detached from session %s by another client\n", name)
+	case mux.DetachRemote:
+		fmt.Fprintf(os.Stderr, "detached from session %s by mhist detach\n", name)
+	default:
+		fmt.Fprintf(os.Stderr, "detached from session %s\n", name)
 	}
 }
 
 // launchSessionProcess starts a background session process and waits for the socket.
-func launchSessionProcess(id, name string) (string, error) {
+func launchSessionProcess(id, name string, opts sessionOptions) (string, error) {
+	limit, err := sessionLimit(opts.maxSessions)
+	if err != nil {
+		return "", err
+	}
+	if running := len(store.List()); limit > 0 && running >= limit {
+		return "", fmt.Errorf("session limit reached (%d running, max %d); kill a session or raise the limit", running, limit)
+	}
+	opts = opts.withConfig(config)
+	if opts.rows == 0 {
+		// Start the shell at this terminal's size so its first prompt
+		// isn't laid out for the wrong width.
+		opts.rows, opts.cols = mux.TerminalSize()
+	}
+
 	self, err := os.Executable()
 	if err != nil {
 		return "", fmt.Errorf("find executable: %w", err)
 	}
 
-	dir := socketDir()
-	if err := os.MkdirAll(dir, 0700); err != nil {
-		return "", fmt.Errorf("create socket dir: %w", err)
+	dir, err := mux.EnsureSocketDir()
+	if err != nil {
+		return "", err
 	}
 
-	logPath := filepath.Join(dir, id+".log")
+	logPath := sessionLogPath(id)
 	logFile, err := os.Create(logPath)
 	if err != nil {
 		return "", fmt.Errorf("create log file: %w", err)
 	}
 
-	cmd := exec.Command(self, fmt.Sprintf("--session-id=%s", id), fmt.Sprintf("--name=%s", name))
+	args := []string{fmt.Sprintf("--session-id=%s", id), fmt.Sprintf("--name=%s", name)}
+	cmd := exec.Command(self, append(args, opts.args()...)...)
+	// Detach the session from this terminal entirely, so closing it can't
+	// take the session down: Setsid gives it a session of its own with no
+	// controlling terminal, stdin is /dev/null (Stdin is nil) and output
+	// goes only to the log. Go opens files close-on-exec, so no other
+	// descriptors of ours, such as the terminal, are inherited.
 	cmd.Stdout = logFile
 	cmd.Stderr = logFile
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
@@ -253,90 +1034,64 @@ func launchSessionProcess(id, name string) (string, error) {
 	}
 	logFile.Close()
 
+	// Reap the process if it dies, and notice when it does
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+
 	// Wait for socket to appear
 	sockPath := filepath.Join(dir, id+".sock")
 	for i := 0; i < 50; i++ {
 		if _, err := os.Stat(sockPath); err == nil {
 			return sockPath, nil
 		}
-		time.Sleep(100 * time.Millisecond)
+		select {
+		case <-exited:
+			return "", fmt.Errorf("session process exited before creating socket (%s)%s",
+				cmd.ProcessState, logExcerpt(logPath))
+		case <-time.After(100 * time.Millisecond):
+		}
 	}
 
-	return "", fmt.Errorf("session socket did not appear within 5 seconds")
+	return "", fmt.Errorf("session socket did not appear within 5 seconds%s", logExcerpt(logPath))
 }
 
-// listSessions scans the socket directory for session info files.
-func listSessions() []SessionInfo {
-	dir := socketDir()
-	entries, err := os.ReadDir(dir)
+// logExcerptLines is how much of a session's log a launch error quotes.
+const logExcerptLines = 10
+
+// logExcerpt returns the last lines of a session log, formatted to follow
+// an error message, or "" if the log is empty or unreadable.
+func logExcerpt(path string) string {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return nil
+		return ""
 	}
-
-	var sessions []SessionInfo
-	for _, entry := range entries {
-		if !strings.HasSuffix(entry.Name(), ".json") {
-			continue
-		}
-		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
-		if err != nil {
-			continue
-		}
-		var info SessionInfo
-		if err := json.Unmarshal(data, &info); err != nil {
-			continue
-		}
-
-		if !isProcessAlive(info.PID) {
-			// Clean up stale files
-			os.Remove(info.Socket)
-			os.Remove(filepath.Join(dir, entry.Name()))
-			continue
-		}
-
-		sessions = append(sessions, info)
+	text := strings.TrimRight(string(data), "\n")
+	if text == "" {
+		return ""
 	}
-	return sessions
-}
-
-// findSession finds a session by name or ID prefix.
-func findSession(sessions []SessionInfo, target string) (SessionInfo, error) {
-	if target == "" {
-		if len(sessions) == 0 {
-			return SessionInfo{}, fmt.Errorf("no sessions found")
-		}
-		return sessions[len(sessions)-1], nil
+	lines := strings.Split(text, "\n")
+	if len(lines) > logExcerptLines {
+		lines = lines[len(lines)-logExcerptLines:]
 	}
+	return fmt.Sprintf("; last lines of %s:\n  %s", path, strings.Join(lines, "\n  "))
+}
 
-	for _, info := range sessions {
-		if info.Name == target {
-			return info, nil
-		}
+// sessionLimit returns the maximum number of running sessions: flag if
+// given, else $MHIST_MAX_SESSIONS. 0 means unlimited.
+func sessionLimit(flag string) (int, error) {
+	source, value := "--max-sessions", flag
+	if value == "" {
+		source, value = "MHIST_MAX_SESSIONS", os.Getenv("MHIST_MAX_SESSIONS")
 	}
-
-	for _, info := range sessions {
-		if strings.HasPrefix(info.ID, target) {
-			return info, nil
-		}
+	if value == "" {
+		return 0, nil
 	}
-
-	return SessionInfo{}, fmt.Errorf("session not found: %s", target)
-}
-
-// isProcessAlive checks if a PID is alive.
-func isProcessAlive(pid int) bool {
-	proc, err := os.FindProcess(pid)
-	if err != nil {
-		return false
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %q: want a number, 0 for no limit", source, value)
 	}
-	err = proc.Signal(syscall.Signal(0))
-	return err == nil
-}
-
-// generateID generates a random UUID-like identifier.
-func generateID() string {
-	b := make([]byte, 16)
-	rand.Read(b)
-	return fmt.Sprintf("%08x-%04x-%04x-%04x-%012x",
-		b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+	return n, nil
 }
@@ -0,0 +1,113 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerConfigNeedsClientAuth(t *testing.T) {
+	for _, o := range []tlsOptions{
+		{},
+		{cert: "server.pem", key: "server-key.pem"},
+		{ca: "ca.pem"},
+	} {
+		if _, err := o.serverConfig(); err == nil || !strings.Contains(err.Error(), "--tls-ca") {
+			t.Errorf("serverConfig(%+v): got %v, want an error asking for client authentication", o, err)
+		}
+	}
+}
+
+func TestSessionLimit(t *testing.T) {
+	t.Setenv("MHIST_MAX_SESSIONS", "")
+	if n, err := sessionLimit(""); err != nil || n != 0 {
+		t.Errorf("default: got %d, %v; want unlimited", n, err)
+	}
+
+	t.Setenv("MHIST_MAX_SESSIONS", "5")
+	if n, err := sessionLimit(""); err != nil || n != 5 {
+		t.Errorf("from env: got %d, %v; want 5", n, err)
+	}
+	if n, err := sessionLimit("2"); err != nil || n != 2 {
+		t.Errorf("flag over env: got %d, %v; want 2", n, err)
+	}
+	if n, err := sessionLimit("0"); err != nil || n != 0 {
+		t.Errorf("flag 0: got %d, %v; want unlimited", n, err)
+	}
+
+	for _, bad := range []string{"-1", "lots"} {
+		if _, err := sessionLimit(bad); err == nil {
+			t.Errorf("sessionLimit(%q): expected error", bad)
+		}
+	}
+}
+
+func TestLogExcerpt(t *testing.T) {
+	dir := t.TempDir()
+	if got := logExcerpt(filepath.Join(dir, "missing.log")); got != "" {
+		t.Errorf("missing log: got %q, want empty", got)
+	}
+
+	path := filepath.Join(dir, "s.log")
+	var lines []string
+	for i := 1; i <= 12; i++ {
+		lines = append(lines, fmt.Sprintf("line %d", i))
+	}
+	os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+	got := logExcerpt(path)
+	if strings.Contains(got, "line 2\n") || !strings.Contains(got, "line 3\n") || !strings.HasSuffix(got, "line 12") {
+		t.Errorf("logExcerpt = %q, want the last 10 lines", got)
+	}
+}
+
+func TestSendData(t *testing.T) {
+	data, err := sendData([]string{"ls -l", "--key", "Enter", "--key", "C-c", "--key", "^D"})
+	if err != nil || string(data) != "ls -l\r\x03\x04" {
+		t.Errorf("sendData = %q, %v", data, err)
+	}
+	for _, bad := range [][]string{{"--key"}, {"--key", "C-!"}} {
+		if _, err := sendData(bad); err == nil {
+			t.Errorf("sendData(%q): expected an error", bad)
+		}
+	}
+}
+
+func TestLockName(t *testing.T) {
+	t.Setenv("MHIST_SOCKET_DIR", t.TempDir())
+	unlock, err := lockName("build/1")
+	if err != nil {
+		t.Fatalf("lockName: %v", err)
+	}
+
+	// A second lock on the name waits for the first; another name doesn't
+	other, err := lockName("build/2")
+	if err != nil {
+		t.Fatalf("lockName other: %v", err)
+	}
+	other()
+	locked := make(chan func())
+	go func() {
+		second, err := lockName("build/1")
+		if err != nil {
+			t.Errorf("second lockName: %v", err)
+		}
+		locked <- second
+	}()
+	select {
+	case <-locked:
+		t.Fatal("second lock taken while the first was held")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case second := <-locked:
+		second()
+	case <-time.After(5 * time.Second):
+		t.Fatal("second lock not taken after the first was released")
+	}
+}
@@ -0,0 +1,223 @@
+package mux
+
+import "bytes"
+
+// ScrollbackBuffer is a ring buffer holding terminal output lines.
+type ScrollbackBuffer struct {
+	lines   [][]byte
+	head    int    // index where the next line will be written
+	count   int    // number of lines currently stored
+	size    int    // bytes in the stored lines, not counting partial
+	cap     int    // maximum number of lines
+	partial []byte // incomplete line (no trailing \n yet)
+	slab    []byte // shared backing store that new lines are carved from
+	written int    // lines ever added, for numbering prompts
+	prompts []int  // numbers (counting from the first line written) of prompt lines
+	raw     bool   // lines are fixed-size chunks of output; see NewRawScrollbackBuffer
+}
+
+// promptMark is the OSC 133 sequence a shell with semantic prompt
+// integration (FinalTerm/iTerm2 style) emits where a prompt starts.
+var promptMark = []byte("\x1b]133;A")
+
+// slabSize is the size of the chunks line bytes are allocated from. Lines
+// are stored back to back in a slab, so adding a line costs no allocation
+// until the slab fills; a slab is freed once all its lines are evicted.
+const slabSize = 64 << 10
+
+// NewScrollbackBuffer creates a new scrollback buffer with the given capacity.
+// A capacity below 1 is taken as 1, so the buffer always holds at least
+// the newest line.
+func NewScrollbackBuffer(capacity int) *ScrollbackBuffer {
+	capacity = max(capacity, 1)
+	return &ScrollbackBuffer{
+		lines: make([][]byte, capacity),
+		cap:   capacity,
+	}
+}
+
+// NewRawScrollbackBuffer creates a scrollback buffer that doesn't split
+// output into lines, for programs whose output isn't line oriented, such
+// as binary dumps or full-screen programs. Its "lines" are consecutive
+// chunks of rawChunkSize bytes, which replayed back to back reproduce the
+// output as the terminal drew it; the last, unfilled chunk is the partial
+// line.
+func NewRawScrollbackBuffer(capacity int) *ScrollbackBuffer {
+	b := NewScrollbackBuffer(capacity)
+	b.raw = true
+	return b
+}
+
+// rawChunkSize is the size of a raw buffer's lines, about a line of text,
+// so that scrolling moves through raw output at a similar pace.
+const rawChunkSize = 80
+
+// Raw reports whether the buffer is a raw one, whose lines are joined
+// without line breaks.
+func (b *ScrollbackBuffer) Raw() bool {
+	return b.raw
+}
+
+// Write processes raw PTY output, splitting into lines on \n boundaries.
+// Partial lines (no trailing \n) are buffered until the next Write.
+func (b *ScrollbackBuffer) Write(data []byte) {
+	if b.raw {
+		b.writeRaw(data)
+		return
+	}
+	for len(data) > 0 {
+		idx := bytes.IndexByte(data, '\n')
+		if idx == -1 {
+			// No newline found — buffer as partial line
+			b.partial = append(b.partial, data...)
+			return
+		}
+
+		// Store the line (including content up to but not including \n),
+		// completing any partial line from a previous write
+		line := data[:idx]
+		if len(b.partial) > 0 {
+			b.partial = append(b.partial, line...)
+			line = b.partial
+		}
+		b.addLine(b.store(line))
+		b.partial = b.partial[:0]
+		data = data[idx+1:]
+	}
+}
+
+// writeRaw adds data to a raw buffer, a chunk at a time.
+func (b *ScrollbackBuffer) writeRaw(data []byte) {
+	for len(data) > 0 {
+		n := min(len(data), rawChunkSize-len(b.partial))
+		b.partial = append(b.partial, data[:n]...)
+		data = data[n:]
+		if len(b.partial) == rawChunkSize {
+			b.addLine(b.store(b.partial))
+			b.partial = b.partial[:0]
+		}
+	}
+}
+
+// store copies line into the current slab and returns the copy, starting
+// a new slab when it is full. Long lines get an allocation of their own so
+// they don't waste the rest of a slab.
+func (b *ScrollbackBuffer) store(line []byte) []byte {
+	if len(line) > slabSize/4 {
+		return append([]byte(nil), line...)
+	}
+	if cap(b.slab)-len(b.slab) < len(line) {
+		b.slab = make([]byte, 0, slabSize)
+	}
+	start := len(b.slab)
+	b.slab = append(b.slab, line...)
+	// Cap the view so appending to it can't overwrite the next line
+	return b.slab[start:len(b.slab):len(b.slab)]
+}
+
+// addLine appends a line to the ring buffer.
+func (b *ScrollbackBuffer) addLine(line []byte) {
+	b.size += len(line) - len(b.lines[b.head])
+	b.lines[b.head] = line
+	b.head = (b.head + 1) % b.cap
+	if b.count < b.cap {
+		b.count++
+	}
+
+	if bytes.Contains(line, promptMark) {
+		b.prompts = append(b.prompts, b.written)
+	}
+	b.written++
+	// Forget prompts whose lines have been overwritten
+	oldest := b.written - b.count
+	i := 0
+	for i < len(b.prompts) && b.prompts[i] < oldest {
+		i++
+	}
+	b.prompts = b.prompts[i:]
+}
+
+// Capacity returns the maximum number of lines the buffer holds.
+func (b *ScrollbackBuffer) Capacity() int {
+	return b.cap
+}
+
+// Bytes returns the number of bytes stored, including the partial line.
+// It is kept up to date as lines come and go, so it is cheap to call.
+func (b *ScrollbackBuffer) Bytes() int {
+	return b.size + len(b.partial)
+}
+
+// Prompts returns the indices, as used by GetLine, of the lines where a
+// shell prompt starts, oldest first. Prompts are found by their OSC 133
+// marker, so this is empty unless the shell emits them.
+func (b *ScrollbackBuffer) Prompts() []int {
+	oldest := b.written - b.count
+	out := make([]int, len(b.prompts))
+	for i, p := range b.prompts {
+		out[i] = p - oldest
+	}
+	return out
+}
+
+// Lines returns the number of lines currently stored.
+func (b *ScrollbackBuffer) Lines() int {
+	return b.count
+}
+
+// GetLine returns the line at the given index, where 0 is the oldest line.
+// Returns nil if index is out of range. The result is a view into the
+// buffer and must not be modified.
+func (b *ScrollbackBuffer) GetLine(index int) []byte {
+	if index < 0 || index >= b.count {
+		return nil
+	}
+	// oldest line is at (head - count) mod cap
+	actual := (b.head - b.count + index + b.cap) % b.cap
+	return b.lines[actual]
+}
+
+// GetPartial returns a copy of the current partial line (data written without
+// a trailing newline). Returns nil if there is no partial line.
+func (b *ScrollbackBuffer) GetPartial() []byte {
+	if len(b.partial) == 0 {
+		return nil
+	}
+	out := make([]byte, len(b.partial))
+	copy(out, b.partial)
+	return out
+}
+
+// GetRange returns count lines starting from start index.
+// Clamps to available range. Like GetLine, the lines are views into the
+// buffer and must not be modified.
+func (b *ScrollbackBuffer) GetRange(start, count int) [][]byte {
+	if start < 0 {
+		start = 0
+	}
+	if start >= b.count {
+		return nil
+	}
+	end := start + count
+	if end > b.count {
+		end = b.count
+	}
+	result := make([][]byte, end-start)
+	for i := start; i < end; i++ {
+		result[i-start] = b.GetLine(i)
+	}
+	return result
+}
+
+// GetTail returns the last count lines, or all of them if there are
+// fewer. Like GetRange, the lines are views into the buffer.
+func (b *ScrollbackBuffer) GetTail(count int) [][]byte {
+	return b.GetRange(b.TailStart(0, count), count)
+}
+
+// TailStart returns the index of the first of count lines that end
+// fromEnd lines before the last one, or 0 if that is before the oldest
+// line.
+func (b *ScrollbackBuffer) TailStart(fromEnd, count int) int {
+	return max(0, b.count-fromEnd-count)
+}
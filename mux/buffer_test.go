@@ -0,0 +1,407 @@
+package mux
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestBufferEmpty(t *testing.T) {
+	b := NewScrollbackBuffer(100)
+	if b.Lines() != 0 {
+		t.Errorf("expected 0 lines, got %d", b.Lines())
+	}
+	if line := b.GetLine(0); line != nil {
+		t.Errorf("expected nil for empty buffer, got %q", line)
+	}
+}
+
+func TestBufferSingleLine(t *testing.T) {
+	b := NewScrollbackBuffer(100)
+	b.Write([]byte("hello world\n"))
+	if b.Lines() != 1 {
+		t.Fatalf("expected 1 line, got %d", b.Lines())
+	}
+	if !bytes.Equal(b.GetLine(0), []byte("hello world")) {
+		t.Errorf("expected 'hello world', got %q", b.GetLine(0))
+	}
+}
+
+func TestBufferMultipleLines(t *testing.T) {
+	b := NewScrollbackBuffer(100)
+	b.Write([]byte("line1\nline2\nline3\n"))
+	if b.Lines() != 3 {
+		t.Fatalf("expected 3 lines, got %d", b.Lines())
+	}
+	if !bytes.Equal(b.GetLine(0), []byte("line1")) {
+		t.Errorf("line 0: expected 'line1', got %q", b.GetLine(0))
+	}
+	if !bytes.Equal(b.GetLine(1), []byte("line2")) {
+		t.Errorf("line 1: expected 'line2', got %q", b.GetLine(1))
+	}
+	if !bytes.Equal(b.GetLine(2), []byte("line3")) {
+		t.Errorf("line 2: expected 'line3', got %q", b.GetLine(2))
+	}
+}
+
+func TestBufferWraparound(t *testing.T) {
+	b := NewScrollbackBuffer(3)
+	b.Write([]byte("a\nb\nc\nd\ne\n"))
+	if b.Lines() != 3 {
+		t.Fatalf("expected 3 lines (capacity), got %d", b.Lines())
+	}
+	// Oldest should be "c", newest "e"
+	if !bytes.Equal(b.GetLine(0), []byte("c")) {
+		t.Errorf("oldest: expected 'c', got %q", b.GetLine(0))
+	}
+	if !bytes.Equal(b.GetLine(1), []byte("d")) {
+		t.Errorf("middle: expected 'd', got %q", b.GetLine(1))
+	}
+	if !bytes.Equal(b.GetLine(2), []byte("e")) {
+		t.Errorf("newest: expected 'e', got %q", b.GetLine(2))
+	}
+}
+
+func TestBufferPartialLines(t *testing.T) {
+	b := NewScrollbackBuffer(100)
+	// Write partial line
+	b.Write([]byte("hel"))
+	if b.Lines() != 0 {
+		t.Errorf("expected 0 lines after partial write, got %d", b.Lines())
+	}
+	// Complete the line
+	b.Write([]byte("lo\n"))
+	if b.Lines() != 1 {
+		t.Fatalf("expected 1 line after completing, got %d", b.Lines())
+	}
+	if !bytes.Equal(b.GetLine(0), []byte("hello")) {
+		t.Errorf("expected 'hello', got %q", b.GetLine(0))
+	}
+}
+
+func TestBufferPartialAcrossWrites(t *testing.T) {
+	b := NewScrollbackBuffer(100)
+	b.Write([]byte("first\nsec"))
+	if b.Lines() != 1 {
+		t.Fatalf("expected 1 line, got %d", b.Lines())
+	}
+	b.Write([]byte("ond\nthird\n"))
+	if b.Lines() != 3 {
+		t.Fatalf("expected 3 lines, got %d", b.Lines())
+	}
+	if !bytes.Equal(b.GetLine(1), []byte("second")) {
+		t.Errorf("expected 'second', got %q", b.GetLine(1))
+	}
+}
+
+func TestBufferGetRangeBounds(t *testing.T) {
+	b := NewScrollbackBuffer(100)
+	b.Write([]byte("a\nb\nc\nd\ne\n"))
+
+	// Normal range
+	r := b.GetRange(1, 3)
+	if len(r) != 3 {
+		t.Fatalf("expected 3 lines, got %d", len(r))
+	}
+	if !bytes.Equal(r[0], []byte("b")) {
+		t.Errorf("expected 'b', got %q", r[0])
+	}
+	if !bytes.Equal(r[2], []byte("d")) {
+		t.Errorf("expected 'd', got %q", r[2])
+	}
+
+	// Range exceeding end
+	r = b.GetRange(3, 10)
+	if len(r) != 2 {
+		t.Fatalf("expected 2 lines (clamped), got %d", len(r))
+	}
+
+	// Range starting past end
+	r = b.GetRange(10, 5)
+	if r != nil {
+		t.Errorf("expected nil for out-of-range start, got %v", r)
+	}
+
+	// Negative start clamped to 0
+	r = b.GetRange(-1, 2)
+	if len(r) != 2 {
+		t.Fatalf("expected 2 lines, got %d", len(r))
+	}
+	if !bytes.Equal(r[0], []byte("a")) {
+		t.Errorf("expected 'a', got %q", r[0])
+	}
+}
+
+func TestBufferGetTail(t *testing.T) {
+	b := NewScrollbackBuffer(3)
+	b.Write([]byte("a\nb\nc\nd\ne\npartial"))
+
+	// The last lines after wraparound, without the partial line
+	r := b.GetTail(2)
+	if len(r) != 2 || string(r[0]) != "d" || string(r[1]) != "e" {
+		t.Errorf("GetTail(2) = %q, want d, e", r)
+	}
+	// More than are stored gives them all
+	if r := b.GetTail(10); len(r) != 3 || string(r[0]) != "c" {
+		t.Errorf("GetTail(10) = %q, want c, d, e", r)
+	}
+	if r := b.GetTail(0); len(r) != 0 {
+		t.Errorf("GetTail(0) = %q, want nothing", r)
+	}
+
+	for _, tt := range []struct{ fromEnd, count, want int }{
+		{0, 2, 1},
+		{1, 2, 0},
+		{2, 2, 0}, // clamped to the oldest line
+		{0, 10, 0},
+	} {
+		if got := b.TailStart(tt.fromEnd, tt.count); got != tt.want {
+			t.Errorf("TailStart(%d, %d) = %d, want %d", tt.fromEnd, tt.count, got, tt.want)
+		}
+	}
+}
+
+func TestBufferGetLineOutOfRange(t *testing.T) {
+	b := NewScrollbackBuffer(100)
+	b.Write([]byte("only\n"))
+	if b.GetLine(-1) != nil {
+		t.Error("expected nil for negative index")
+	}
+	if b.GetLine(1) != nil {
+		t.Error("expected nil for index beyond count")
+	}
+}
+
+func TestBufferGetPartial(t *testing.T) {
+	b := NewScrollbackBuffer(100)
+	b.Write([]byte("hello"))
+	p := b.GetPartial()
+	if !bytes.Equal(p, []byte("hello")) {
+		t.Errorf("expected 'hello', got %q", p)
+	}
+}
+
+func TestBufferGetPartialEmpty(t *testing.T) {
+	b := NewScrollbackBuffer(100)
+	if p := b.GetPartial(); p != nil {
+		t.Errorf("expected nil on fresh buffer, got %q", p)
+	}
+}
+
+func TestBufferGetPartialAfterNewline(t *testing.T) {
+	b := NewScrollbackBuffer(100)
+	b.Write([]byte("hello\n"))
+	if p := b.GetPartial(); p != nil {
+		t.Errorf("expected nil after complete line, got %q", p)
+	}
+}
+
+func TestBufferLargeWraparound(t *testing.T) {
+	b := NewScrollbackBuffer(5)
+	for i := 0; i < 20; i++ {
+		b.Write([]byte(fmt.Sprintf("line%d\n", i)))
+	}
+	if b.Lines() != 5 {
+		t.Fatalf("expected 5 lines, got %d", b.Lines())
+	}
+	// Should have lines 15-19
+	if !bytes.Equal(b.GetLine(0), []byte("line15")) {
+		t.Errorf("oldest: expected 'line15', got %q", b.GetLine(0))
+	}
+	if !bytes.Equal(b.GetLine(4), []byte("line19")) {
+		t.Errorf("newest: expected 'line19', got %q", b.GetLine(4))
+	}
+}
+
+func TestBufferCapacityOne(t *testing.T) {
+	b := NewScrollbackBuffer(1)
+	for i := 0; i < 3; i++ {
+		b.Write([]byte(fmt.Sprintf("line%d\n", i)))
+		if b.Lines() != 1 {
+			t.Fatalf("after line%d: expected 1 line, got %d", i, b.Lines())
+		}
+		if want := fmt.Sprintf("line%d", i); !bytes.Equal(b.GetLine(0), []byte(want)) {
+			t.Errorf("expected %q, got %q", want, b.GetLine(0))
+		}
+	}
+	if b.Bytes() != len("line2") {
+		t.Errorf("expected %d bytes, got %d", len("line2"), b.Bytes())
+	}
+}
+
+func TestBufferCapacityZero(t *testing.T) {
+	// Taken as 1 rather than dividing by zero on the first line
+	for _, capacity := range []int{0, -1} {
+		b := NewScrollbackBuffer(capacity)
+		b.Write([]byte("old\nnew\n"))
+		if b.Capacity() != 1 || b.Lines() != 1 || !bytes.Equal(b.GetLine(0), []byte("new")) {
+			t.Errorf("capacity %d: got capacity %d, %d lines, newest %q", capacity, b.Capacity(), b.Lines(), b.GetLine(0))
+		}
+	}
+	b := NewRawScrollbackBuffer(0)
+	b.Write(bytes.Repeat([]byte("x"), 2*rawChunkSize))
+	if b.Lines() != 1 {
+		t.Errorf("raw: expected 1 chunk, got %d", b.Lines())
+	}
+}
+
+func TestBufferPrompts(t *testing.T) {
+	b := NewScrollbackBuffer(100)
+	b.Write([]byte("\x1b]133;A\x07$ ls\n"))
+	b.Write([]byte("a b c\n"))
+	b.Write([]byte("\x1b]133;A\x1b\\$ pwd\n/tmp\n"))
+	b.Write([]byte("\x1b]133;A\x07$ ")) // current prompt, still partial
+	got := fmt.Sprint(b.Prompts())
+	if got != "[0 2]" {
+		t.Errorf("prompts = %s, want [0 2]", got)
+	}
+}
+
+func TestBufferPromptsWraparound(t *testing.T) {
+	b := NewScrollbackBuffer(5)
+	for i := 0; i < 10; i++ {
+		if i%3 == 0 {
+			b.Write([]byte("\x1b]133;A\x07"))
+		}
+		b.Write([]byte(fmt.Sprintf("line%d\n", i)))
+	}
+	// Lines 5-9 remain; prompts were on lines 0, 3, 6 and 9
+	got := fmt.Sprint(b.Prompts())
+	if got != "[1 4]" {
+		t.Errorf("prompts = %s, want [1 4]", got)
+	}
+	for _, p := range b.Prompts() {
+		if !bytes.Contains(b.GetLine(p), promptMark) {
+			t.Errorf("line %d %q has no prompt mark", p, b.GetLine(p))
+		}
+	}
+}
+
+func TestBufferBytes(t *testing.T) {
+	b := NewScrollbackBuffer(2)
+	if b.Capacity() != 2 || b.Bytes() != 0 {
+		t.Fatalf("fresh buffer: capacity %d, bytes %d", b.Capacity(), b.Bytes())
+	}
+	b.Write([]byte("abc\nde\nf\ngh"))
+	// "abc" has been overwritten; "de", "f" and the partial "gh" remain
+	if b.Bytes() != 5 {
+		t.Errorf("bytes = %d, want 5", b.Bytes())
+	}
+
+	// The running total matches the lines actually stored as they wrap
+	for i := 0; i < 20; i++ {
+		b.Write([]byte(strings.Repeat("x", i) + "\n"))
+		want := len(b.GetPartial())
+		for _, line := range b.GetRange(0, b.Lines()) {
+			want += len(line)
+		}
+		if b.Bytes() != want {
+			t.Fatalf("after %d writes: bytes = %d, want %d", i+1, b.Bytes(), want)
+		}
+	}
+}
+
+// mixedOutput returns shell-like output: lines of varying length, some
+// with SGR colors, ending in a partial line like a prompt.
+func mixedOutput() []byte {
+	var out bytes.Buffer
+	for i := 0; i < 200; i++ {
+		switch i % 4 {
+		case 0:
+			out.WriteString("\n")
+		case 1:
+			fmt.Fprintf(&out, "short %d\n", i)
+		case 2:
+			fmt.Fprintf(&out, "\x1b[32m%s\x1b[0m\n", bytes.Repeat([]byte("colored "), 10))
+		case 3:
+			out.Write(bytes.Repeat([]byte("w"), 300))
+			out.WriteString("\r\n")
+		}
+	}
+	out.WriteString("$ ")
+	return out.Bytes()
+}
+
+func BenchmarkBufferWriteMixed(b *testing.B) {
+	data := mixedOutput()
+	buf := NewScrollbackBuffer(10000)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf.Write(data)
+	}
+}
+
+// BenchmarkBufferWriteLarge pushes a large volume through a full buffer in
+// small chunks, as a PTY read delivers it, so lines are often split across
+// writes and old lines are evicted.
+func BenchmarkBufferWriteLarge(b *testing.B) {
+	data := bytes.Repeat(mixedOutput(), 50)
+	const chunk = 512
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf := NewScrollbackBuffer(1000)
+		for off := 0; off < len(data); off += chunk {
+			buf.Write(data[off:min(off+chunk, len(data))])
+		}
+	}
+}
+
+func TestBufferSlabBoundaries(t *testing.T) {
+	b := NewScrollbackBuffer(5000)
+	var want []string
+	for i := 0; i < 5000; i++ {
+		// Vary lengths so lines land across slab boundaries, with some
+		// long enough to get their own allocation
+		line := fmt.Sprintf("%d:%s", i, bytes.Repeat([]byte("x"), (i*37)%200))
+		if i%1000 == 999 {
+			line += string(bytes.Repeat([]byte("y"), slabSize))
+		}
+		want = append(want, line)
+		// Split each line across two writes to go through the partial path
+		half := len(line) / 2
+		b.Write([]byte(line[:half]))
+		b.Write([]byte(line[half:] + "\n"))
+	}
+	for i, w := range want {
+		if got := string(b.GetLine(i)); got != w {
+			t.Fatalf("line %d: got %d bytes %.20q, want %d bytes %.20q", i, len(got), got, len(w), w)
+		}
+	}
+
+	// Appending to a returned line must not clobber its neighbour
+	_ = append(b.GetLine(10), "clobber"...)
+	if got := string(b.GetLine(11)); got != want[11] {
+		t.Errorf("line 11 changed after append to line 10: %q", got)
+	}
+}
+
+func TestBufferRaw(t *testing.T) {
+	b := NewRawScrollbackBuffer(3)
+	if !b.Raw() {
+		t.Fatal("Raw() = false")
+	}
+
+	// Newlines don't split; output is cut into chunks wherever it falls
+	out := bytes.Repeat([]byte("ab\ncd\x00\x1b[2J"), 50) // 500 bytes
+	b.Write(out[:123])
+	b.Write(out[123:])
+	if b.Lines() != 3 {
+		t.Fatalf("Lines() = %d, want 3 (capacity)", b.Lines())
+	}
+
+	// The chunks kept and the partial one are the end of the output
+	var got []byte
+	for _, line := range b.GetRange(0, 3) {
+		if len(line) != rawChunkSize {
+			t.Errorf("chunk of %d bytes, want %d", len(line), rawChunkSize)
+		}
+		got = append(got, line...)
+	}
+	got = append(got, b.GetPartial()...)
+	if want := out[len(out)-len(got):]; !bytes.Equal(got, want) || len(b.GetPartial()) != 500%rawChunkSize {
+		t.Errorf("raw contents = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,1916 @@
+package mux
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/term"
+)
+
+const scrollLines = 3 // default lines to scroll per step or mouse wheel event
+
+const tabWidth = 8 // default columns between tab stops
+
+// stdinData represents a chunk read from stdin.
+type stdinData struct {
+	buf []byte
+	err error
+}
+
+// inputReaders holds one reader goroutine per input source. The goroutine
+// outlives individual clients, which prevents goroutine leaks and lost
+// keystrokes when switching sessions.
+var (
+	inputMu      sync.Mutex
+	inputReaders = map[io.Reader]<-chan stdinData{}
+)
+
+// inputChannel returns the shared channel of chunks read from r, starting
+// its reader goroutine on first use.
+func inputChannel(r io.Reader) <-chan stdinData {
+	inputMu.Lock()
+	defer inputMu.Unlock()
+	if ch, ok := inputReaders[r]; ok {
+		return ch
+	}
+	ch := make(chan stdinData, 1)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := r.Read(buf)
+			data := make([]byte, n)
+			copy(data, buf[:n])
+			ch <- stdinData{buf: data, err: err}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	inputReaders[r] = ch
+	return ch
+}
+
+// ClientOptions configures where a Client reads input and writes output.
+// The zero value uses the process's stdin and stdout.
+type ClientOptions struct {
+	Input  io.Reader // keyboard input; defaults to os.Stdin
+	Output io.Writer // terminal output; defaults to os.Stdout
+
+	// Rows and Cols give the screen size when Input is not a terminal or its
+	// size can't be read. Default to 24x80.
+	Rows, Cols int
+
+	// NoRedraw attaches without replaying the session's current screen.
+	NoRedraw bool
+
+	// Sanitize asks the session to strip escape sequences that do more
+	// than draw from the redraw and history; see Hello.
+	Sanitize bool
+
+	// NoTakeover gives up, with DetachBusy, if another client is attached
+	// rather than taking the session over from it.
+	NoTakeover bool
+
+	// Term and ColorTerm are reported to the session as the terminal's
+	// type and color support. Default to $TERM and $COLORTERM.
+	Term, ColorTerm string
+
+	// Keymap binds the prefix and history mode keys. Nil means
+	// DefaultKeymap.
+	Keymap *Keymap
+
+	// ScrollLines is how far one scroll step moves in history mode.
+	// Defaults to 3.
+	ScrollLines int
+
+	// SplitRows is how many rows of live output history mode's split view
+	// keeps at the bottom of the screen. Defaults to 5.
+	SplitRows int
+
+	// TabWidth is how many columns apart the terminal's tab stops are,
+	// for working out how wide tabbed lines of history are. Defaults to 8.
+	TabWidth int
+
+	// Banner, if set, is shown at the top right of the screen once the
+	// client has attached, until bannerTime passes or a key is pressed.
+	Banner string
+}
+
+// Client connects to a session's Unix socket and relays I/O.
+type Client struct {
+	conn        net.Conn
+	in          <-chan stdinData
+	out         io.Writer
+	termFd      int // terminal file descriptor, or -1 if input isn't a terminal
+	sizeFd      int // terminal the window size is read from, or -1
+	oldState    *term.State
+	sessionID   string
+	sessionName string
+	hello       Hello // attach options sent to the session
+	keys        Keymap
+	scrollStep  int // lines per scroll step in history mode
+	tabWidth    int // columns between tab stops
+	done        chan struct{}
+	once        sync.Once
+	writeMu     sync.Mutex // serializes framed writes to conn
+	wbuf        []byte     // encode buffer, guarded by writeMu
+	connErr     error      // why the connection broke, if it did; guarded by writeMu
+
+	// History mode state. historyMode and choosingSession are set by
+	// relayStdin and read by relaySocket to decide whether output is shown.
+	historyMode   atomic.Bool
+	mouseOn       bool // mouse reporting is enabled in the terminal
+	mouseCapable  bool // the terminal is expected to support SGR mouse
+	historyOffset int  // offset from end of buffer (0 = live)
+
+	// The terminal's size. handleSignals updates it while relaySocket and
+	// relayStdin read it, so it goes through termSize and setTermSize.
+	sizeMu   sync.Mutex
+	termRows int
+	termCols int
+
+	// Pause state. relaySocket writes output while relayStdin toggles the
+	// pause, so both go through outMu.
+	outMu       sync.Mutex
+	paused      bool
+	held        []byte // output received while paused
+	heldDropped bool   // held passed pauseLimit and was dropped
+
+	// Width of the history mode position indicator on screen, 0 if none
+	historyIndicator int
+
+	// The history screen on display, if it can be scrolled in place;
+	// guarded by outMu
+	shown *historyView
+
+	// Split view: history mode shows scrollback above and the last
+	// splitRows lines of live output below. split is toggled by relayStdin
+	// and read by relaySocket, which refreshes the live rows as output
+	// arrives.
+	split       atomic.Bool
+	splitRows   int
+	tailPending atomic.Bool // a refresh of the live rows is scheduled
+	tail        []byte      // lines in the live rows, guarded by outMu
+
+	// What each history request still awaiting a response is for, oldest
+	// first. The session answers them in order. Only one screen request
+	// is out at a time: while it is, the latest one made is held in
+	// screenPending, so scrolling fast doesn't queue up a screen for
+	// every step.
+	historyMu     sync.Mutex
+	historyKinds  []historyKind
+	screenBusy    bool
+	screenPending []byte
+	copyRegisters []byte // the register each copy request is for, oldest first
+
+	// Copy registers, like vim's: copy-history yanks into one as well as
+	// onto the clipboard, and paste types one back in. Which is used is
+	// chosen with select-register just before; unnamedRegister otherwise,
+	// which also gets every copy. Guarded by outMu.
+	registers map[byte][]byte
+
+	// Whether the program in the session has bracketed paste mode on, so
+	// pastes from a register are bracketed as the terminal would. pasteMode
+	// follows the output in relaySocket.
+	pasteMode modeTracker
+	bracketed atomic.Bool
+
+	// Attach banner, also drawn under outMu
+	banner      string
+	bannerDue   bool // waiting for the redraw to draw over
+	bannerShown bool
+
+	// Prompt lists requested by jumpToPrompt, handed over by relaySocket
+	prompts chan []byte
+
+	// Session switching
+	choosingSession atomic.Bool
+	sessionChoices  []SessionInfo
+	pickerCursor    int                 // index of the selected session in sessionChoices
+	pickerPreviews  map[string][][]byte // last lines of each session, by ID
+	SwitchTarget    *SessionInfo
+
+	// Exit state. detachReason is set from both relay goroutines, so it is
+	// guarded by writeMu; sessionErr is only set by relaySocket, which Run
+	// waits for.
+	detachReason DetachReason  // why the client left, if it detached
+	sessionErr   *SessionError // why the session refused the client, if it did
+}
+
+// NewClient connects to the session at the given socket path, using the
+// process's terminal for I/O and the key bindings and scroll step from the
+// user's config file.
+func NewClient(socketPath, sessionID, sessionName string) (*Client, error) {
+	cfg, err := LoadConfig(ConfigPath())
+	if err != nil {
+		return nil, err
+	}
+	return DialClient(UnixTransport{}, socketPath, sessionID, sessionName, ClientOptions{
+		Keymap:      &cfg.Keymap,
+		ScrollLines: cfg.ScrollLines,
+		SplitRows:   cfg.SplitRows,
+		TabWidth:    cfg.TabWidth,
+	})
+}
+
+// DialClient connects to a session at addr over the given transport.
+// Raw mode and resize tracking are only used when the input is a terminal,
+// so a Client can also be driven from pipes, e.g. in tests.
+func DialClient(t Transport, addr, sessionID, sessionName string, opts ClientOptions) (*Client, error) {
+	conn, err := Dial(t, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Input == nil {
+		opts.Input = os.Stdin
+	}
+	if opts.Output == nil {
+		opts.Output = os.Stdout
+	}
+	c := &Client{
+		conn:        conn,
+		in:          inputChannel(opts.Input),
+		out:         opts.Output,
+		termFd:      terminalFd(opts.Input),
+		sessionID:   sessionID,
+		sessionName: sessionName,
+		done:        make(chan struct{}),
+		prompts:     make(chan []byte, 1),
+		termRows:    opts.Rows,
+		termCols:    opts.Cols,
+		banner:      opts.Banner,
+		pasteMode:   modeTracker{switches: pasteSwitches},
+		hello: Hello{
+			NoRedraw:   opts.NoRedraw,
+			Sanitize:   opts.Sanitize,
+			NoTakeover: opts.NoTakeover,
+			Version:    ProtocolVersion,
+			Term:       opts.Term,
+			ColorTerm:  opts.ColorTerm,
+		},
+	}
+	if opts.Keymap != nil {
+		c.keys = *opts.Keymap
+	} else {
+		c.keys = DefaultKeymap()
+	}
+	if c.hello.Term == "" {
+		c.hello.Term = os.Getenv("TERM")
+	}
+	if c.hello.ColorTerm == "" {
+		c.hello.ColorTerm = os.Getenv("COLORTERM")
+	}
+	c.scrollStep = opts.ScrollLines
+	if c.scrollStep <= 0 {
+		c.scrollStep = scrollLines
+	}
+	c.splitRows = opts.SplitRows
+	if c.splitRows <= 0 {
+		c.splitRows = splitRows
+	}
+	c.tabWidth = opts.TabWidth
+	if c.tabWidth <= 0 {
+		c.tabWidth = tabWidth
+	}
+	// The size always comes from one terminal, so the initial size and
+	// later resizes agree. That is the input terminal, or the output if
+	// only that is a terminal (e.g. input redirected from a file).
+	c.sizeFd = c.termFd
+	if c.sizeFd < 0 {
+		c.sizeFd = terminalFd(opts.Output)
+	}
+	return c, nil
+}
+
+// terminalFd returns the file descriptor behind v if it is a terminal,
+// or -1.
+func terminalFd(v any) int {
+	if f, ok := v.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		return int(f.Fd())
+	}
+	return -1
+}
+
+// Detached reports whether the client exited because it was detached, by
+// the user or by the session, as opposed to the session ending.
+func (c *Client) Detached() bool {
+	return c.DetachReason() != DetachNone
+}
+
+// DetachReason reports why the client was detached, or DetachNone if the
+// session ended.
+func (c *Client) DetachReason() DetachReason {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.detachReason
+}
+
+// setDetachReason records why the client is leaving.
+func (c *Client) setDetachReason(r DetachReason) {
+	c.writeMu.Lock()
+	c.detachReason = r
+	c.writeMu.Unlock()
+}
+
+// Run starts the client I/O relay. Blocks until detach or disconnect.
+func (c *Client) Run() error {
+	if c.termFd >= 0 {
+		// Put terminal in raw mode
+		oldState, err := enableRawMode(c.termFd)
+		if err != nil {
+			c.conn.Close()
+			return fmt.Errorf("enable raw mode: %w", err)
+		}
+		c.oldState = oldState
+	}
+	if c.sizeFd >= 0 {
+		if rows, cols, err := getTerminalSize(c.sizeFd); err == nil {
+			c.setTermSize(rows, cols)
+		}
+	}
+	if rows, cols := c.termSize(); rows <= 0 || cols <= 0 {
+		c.setTermSize(24, 80)
+	}
+
+	// Mouse mode starts disabled (enables on scroll mode entry for copy/paste compat)
+	c.mouseCapable = mouseCapable(c.hello.Term)
+
+	// Introduce ourselves, then send the initial size. A session that
+	// can't take even that is wedged, so give up rather than hang.
+	c.conn.SetWriteDeadline(time.Now().Add(DialTimeout))
+	if err := c.send(c.hello.message()); err != nil {
+		c.restore()
+		return fmt.Errorf("attach: %w", err)
+	}
+	c.sendResize()
+	c.conn.SetWriteDeadline(time.Time{})
+
+	// The banner goes over the redraw, or on the screen as it is if none
+	// comes soon
+	if c.banner != "" {
+		c.bannerDue = true
+		time.AfterFunc(bannerDelay, func() {
+			c.outMu.Lock()
+			c.showBanner()
+			c.outMu.Unlock()
+		})
+	}
+
+	// Handle terminal resize and hangup signals
+	if c.sizeFd >= 0 {
+		go c.handleSignals()
+	}
+
+	// Start I/O relay goroutines. relayStdin can stay blocked reading
+	// input after the client is done, so only relaySocket is waited for.
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		defer c.restoreOnPanic()
+		c.relayStdin()
+	}()
+
+	go func() {
+		defer wg.Done()
+		defer c.restoreOnPanic()
+		c.relaySocket()
+	}()
+
+	// Wait for either goroutine to finish
+	<-c.done
+
+	// Close conn to unblock relaySocket, and let it finish with the last
+	// message, which may be why we are done
+	c.conn.Close()
+	wg.Wait()
+
+	// The terminal is back to normal before the caller reports an error
+	c.restore()
+	if c.sessionErr != nil {
+		return c.sessionErr
+	}
+	c.writeMu.Lock()
+	err, reason := c.connErr, c.detachReason
+	c.writeMu.Unlock()
+	if err != nil && reason == DetachNone {
+		return fmt.Errorf("lost connection to session: %w", err)
+	}
+	return nil
+}
+
+// resizeDebounce is how long the terminal size must stay put before a
+// resize is sent to the session.
+const resizeDebounce = 50 * time.Millisecond
+
+// handleSignals handles signals delivered to the client process.
+//
+// In raw mode Ctrl+C, Ctrl+\ and Ctrl+Z arrive as bytes and are forwarded
+// to the session, where the PTY turns them into signals for the foreground
+// job. If the client itself is sent SIGINT or SIGQUIT (e.g. by kill), that
+// was meant for the job too, so the matching control byte is forwarded
+// instead of letting the signal end the client.
+//
+// The client only reacts to its own lifecycle signals: SIGWINCH resizes,
+// and SIGHUP (the terminal window was closed) or SIGTERM detach, leaving
+// the session alive for a later reattach.
+func (c *Client) handleSignals() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
+	if resizeSignal != nil {
+		signal.Notify(sigCh, resizeSignal)
+	}
+
+	// A terminal being dragged to a new size fires a burst of SIGWINCH.
+	// Each one restarts the timer, so only the size it settles on is sent.
+	var resizeTimer *time.Timer
+	var resizeC <-chan time.Time
+
+	for {
+		select {
+		case <-resizeC:
+			resizeC = nil
+			rows, cols, err := getTerminalSize(c.sizeFd)
+			if err == nil {
+				c.setTermSize(rows, cols)
+				c.sendResize()
+			}
+		case sig := <-sigCh:
+			switch sig {
+			case syscall.SIGHUP, syscall.SIGTERM:
+				c.detach()
+			case syscall.SIGINT:
+				c.send(Message{Type: MsgData, Payload: []byte{0x03}})
+			case syscall.SIGQUIT:
+				c.send(Message{Type: MsgData, Payload: []byte{0x1c}})
+			case resizeSignal:
+				if resizeTimer == nil {
+					resizeTimer = time.NewTimer(resizeDebounce)
+				} else {
+					// Drain a tick that fired but wasn't received, so
+					// it can't trigger a second resize after Reset
+					if !resizeTimer.Stop() {
+						select {
+						case <-resizeTimer.C:
+						default:
+						}
+					}
+					resizeTimer.Reset(resizeDebounce)
+				}
+				resizeC = resizeTimer.C
+			}
+		case <-c.done:
+			signal.Stop(sigCh)
+			if resizeTimer != nil {
+				resizeTimer.Stop()
+			}
+			return
+		}
+	}
+}
+
+// relayStdin reads from stdin and sends to the session, handling prefix key and history.
+func (c *Client) relayStdin() {
+	defer c.signalDone()
+
+	prefixActive := false
+	quoting := false // the next key goes to the session as it is
+
+	// The register the next copy or paste in history mode uses, and
+	// whether the next key names it
+	register := byte(unnamedRegister)
+	selectingRegister := false
+	pasting := false // inside a bracketed paste
+
+	// Regular input is batched per read into a single MsgData so a paste
+	// doesn't turn into one message per byte. It is flushed at the end of
+	// every read, so keystrokes are never held back.
+	var pending []byte
+	flush := func() {
+		if len(pending) > 0 {
+			c.send(Message{Type: MsgData, Payload: pending})
+			pending = nil
+		}
+	}
+
+	var keys keySplitter
+	var escTimer <-chan time.Time
+	for {
+		var input [][]byte
+		select {
+		case <-c.done:
+			return
+		case <-escTimer:
+			input = keys.flush()
+		case data := <-c.in:
+			if data.err != nil {
+				// Input is gone (e.g. the terminal closed): detach rather
+				// than leave the session wondering.
+				flush()
+				c.detach()
+				return
+			}
+			keys.x10 = c.mouseOn
+			input = keys.split(data.buf)
+			// A prefix at the end of the previous read takes one key.
+			// More keys at once are a paste, which shouldn't lose its
+			// first character to a prefix command.
+			if prefixActive && len(input) > 1 {
+				prefixActive = false
+			}
+		}
+
+		if len(input) > 0 && c.banner != "" {
+			c.clearBanner()
+		}
+		for _, key := range input {
+			b := key[0]
+
+			// Session picker input
+			if c.choosingSession.Load() {
+				c.handleSessionChoice(key)
+				continue
+			}
+
+			// A bracketed paste goes to the session as it is, even the
+			// bytes that are key bindings, and cancels a pending prefix
+			if string(key) == pasteStart {
+				pasting, prefixActive, quoting = true, false, false
+				if c.historyMode.Load() {
+					c.exitHistoryMode()
+				}
+			}
+			if pasting {
+				pasting = string(key) != pasteEnd
+				pending = append(pending, key...)
+				continue
+			}
+
+			// A quoted key is sent whatever it is bound to, even the
+			// prefix key or Ctrl+s, and whether or not it is a sequence
+			// the client would handle itself
+			if quoting {
+				quoting = false
+				if c.historyMode.Load() {
+					c.exitHistoryMode()
+				}
+				pending = append(pending, key...)
+				continue
+			}
+
+			if prefixActive {
+				prefixActive = false
+				switch c.keys.Prefix[b] {
+				case ActionDetach:
+					flush()
+					c.detach()
+					return
+				case ActionSessions:
+					c.showSessionPicker()
+				case ActionHistory:
+					// Enter history/scroll mode
+					if !c.historyMode.Load() {
+						c.enterHistoryMode(c.scrollStep)
+					}
+				case ActionSendPrefix:
+					// Send the prefix key itself
+					if c.historyMode.Load() {
+						c.exitHistoryMode()
+					}
+					pending = append(pending, c.keys.PrefixKey)
+				case ActionSuspend:
+					// Suspend the client back to the launching shell
+					flush()
+					c.suspend()
+				case ActionPause:
+					c.togglePause()
+				case ActionClearHistory:
+					c.send(Message{Type: MsgClearHistory})
+				case ActionQuote:
+					quoting = true
+				case ActionPasteBuffer:
+					// Paste the last copy
+					if text := c.pasteText(unnamedRegister); text != nil {
+						if c.historyMode.Load() {
+							c.exitHistoryMode()
+						}
+						pending = append(pending, text...)
+					}
+				default:
+					// Unbound prefix command — ignore
+				}
+				continue
+			}
+
+			if len(key) == 1 && b == c.keys.PrefixKey {
+				prefixActive = true
+				continue
+			}
+
+			// The key after select-register names the register; any
+			// other key just cancels it
+			if selectingRegister {
+				selectingRegister = false
+				if len(key) == 1 && isRegister(b) {
+					register = b
+				}
+				continue
+			}
+
+			// Ctrl+s toggles scroll/history mode
+			if len(key) == 1 && b == 0x13 {
+				if c.historyMode.Load() {
+					c.exitHistoryMode()
+				} else {
+					c.enterHistoryMode(c.scrollStep)
+				}
+				continue
+			}
+
+			if len(key) > 1 && c.handleEscape(key) {
+				continue
+			}
+
+			// History mode key bindings (vim-style by default). Any other
+			// escape sequence leaves history mode, as Esc does.
+			if c.historyMode.Load() {
+				switch c.keys.History[b] {
+				case ActionScrollUp:
+					c.historyOffset += c.scrollStep
+					c.requestHistory()
+				case ActionScrollDown:
+					c.historyOffset -= c.scrollStep
+					if c.historyOffset <= 0 {
+						c.exitHistoryMode()
+					} else {
+						c.requestHistory()
+					}
+				case ActionHalfPageUp:
+					c.historyOffset += c.viewRows() / 2
+					c.requestHistory()
+				case ActionHalfPageDown:
+					c.historyOffset -= c.viewRows() / 2
+					if c.historyOffset <= 0 {
+						c.exitHistoryMode()
+					} else {
+						c.requestHistory()
+					}
+				case ActionPrevPrompt:
+					c.jumpToPrompt(false)
+				case ActionNextPrompt:
+					c.jumpToPrompt(true)
+				case ActionExitHistory:
+					c.exitHistoryMode()
+				case ActionCopyHistory:
+					c.requestLinesFor(0, maxCopyLines, historyCopy, register)
+					register = unnamedRegister
+				case ActionRegister:
+					selectingRegister = true
+				case ActionPaste:
+					if text := c.pasteText(register); text != nil {
+						c.exitHistoryMode()
+						pending = append(pending, text...)
+					}
+					register = unnamedRegister
+				case ActionToggleSplit:
+					c.split.Store(!c.split.Load())
+					c.requestHistory()
+					if c.splitting() {
+						c.requestTail()
+					}
+				default:
+					c.exitHistoryMode()
+				}
+				continue
+			}
+
+			// Regular data — forward to session
+			pending = append(pending, key...)
+		}
+		flush()
+
+		escTimer = nil
+		if keys.holding() {
+			escTimer = time.After(escTimeout)
+		}
+	}
+}
+
+// pasteStart and pasteEnd bracket pasted text when the program in the
+// session has turned on bracketed paste mode.
+const (
+	pasteStart = "\x1b[200~"
+	pasteEnd   = "\x1b[201~"
+)
+
+// handleEscape acts on an escape sequence the client itself handles: Page
+// Up, which enters history mode, and in history mode mouse reports, Page
+// Down and arrows. Returns false for any other sequence, which in live
+// mode is forwarded to the session untouched. Mouse reports in live mode
+// are for the program in the session, which asked for them.
+func (c *Client) handleEscape(seq []byte) bool {
+	if len(seq) < 3 || seq[1] != '[' {
+		return false
+	}
+	switch {
+	case seq[2] == '<' && c.mouseOn:
+		// SGR mouse: ESC [ < ...
+		if ev, _, ok := ParseSGRMouse(seq); ok {
+			c.handleMouse(ev)
+			return true
+		}
+
+	case seq[2] == 'M' && c.mouseOn:
+		// Legacy mouse: ESC [ M ..., only while we asked for reports,
+		// since some keyboards send ESC [ M for F1
+		if ev, _, ok := ParseX10Mouse(seq); ok {
+			c.handleMouse(ev)
+			return true
+		}
+
+	case string(seq) == "\x1b[5~":
+		// Page Up
+		if !c.historyMode.Load() {
+			c.enterHistoryMode(c.viewRows())
+		} else {
+			c.historyOffset += c.viewRows()
+			c.requestHistory()
+		}
+		return true
+
+	case c.historyMode.Load() && string(seq) == "\x1b[6~":
+		// Page Down
+		c.historyOffset -= c.viewRows()
+		if c.historyOffset <= 0 {
+			c.exitHistoryMode()
+		} else {
+			c.requestHistory()
+		}
+		return true
+
+	case c.historyMode.Load() && string(seq) == "\x1b[A":
+		// Arrow up scrolls up in history mode
+		c.historyOffset += c.scrollStep
+		c.requestHistory()
+		return true
+
+	case c.historyMode.Load() && string(seq) == "\x1b[B":
+		// Arrow down scrolls down
+		c.historyOffset -= c.scrollStep
+		if c.historyOffset <= 0 {
+			c.exitHistoryMode()
+		} else {
+			c.requestHistory()
+		}
+		return true
+	}
+	return false
+}
+
+// handleMouse processes a parsed mouse event.
+func (c *Client) handleMouse(ev MouseEvent) {
+	switch ev.Button {
+	case 64: // Scroll up
+		if !c.historyMode.Load() {
+			c.enterHistoryMode(c.scrollStep)
+		} else {
+			c.historyOffset += c.scrollStep
+			c.requestHistory()
+		}
+
+	case 65: // Scroll down
+		if c.historyMode.Load() {
+			c.historyOffset -= c.scrollStep
+			if c.historyOffset <= 0 {
+				c.exitHistoryMode()
+				return
+			}
+			c.requestHistory()
+		}
+		// If not in history mode, ignore scroll down
+
+	default:
+		// Other mouse events in history mode → exit
+		if c.historyMode.Load() && ev.Press {
+			c.exitHistoryMode()
+		}
+	}
+}
+
+// requestHistory sends a history request to the session.
+func (c *Client) requestHistory() {
+	c.requestLines(c.historyOffset, c.viewRows(), historyScreen)
+}
+
+// historyKind tells what a history request was for, and so where its
+// response is drawn.
+type historyKind int
+
+const (
+	historyScreen historyKind = iota // the whole screen, or the top of a split
+	historyTail                      // the live rows of the split view
+	historyCopy                      // the whole scrollback, for the clipboard
+)
+
+// requestLines asks the session for count lines ending fromEnd lines
+// before the end of its scrollback, noting what they are for. A screen
+// request made while another is out waits for its response, replacing
+// any that was already waiting.
+func (c *Client) requestLines(fromEnd, count int, kind historyKind) {
+	c.requestLinesFor(fromEnd, count, kind, unnamedRegister)
+}
+
+// requestLinesFor is requestLines for a copy into register reg.
+func (c *Client) requestLinesFor(fromEnd, count int, kind historyKind, reg byte) {
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint32(payload[0:4], historyFromEnd|uint32(fromEnd))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(count))
+	if kind == historyCopy {
+		payload = append(payload, historyPlain)
+	}
+
+	c.historyMu.Lock()
+	defer c.historyMu.Unlock()
+	if kind == historyScreen && c.screenBusy {
+		c.screenPending = payload
+		return
+	}
+	if c.sendHistoryRequest(payload, kind) && kind == historyCopy {
+		c.copyRegisters = append(c.copyRegisters, reg)
+	}
+}
+
+// sendHistoryRequest sends a history request and reports whether it went
+// out. The caller holds historyMu.
+func (c *Client) sendHistoryRequest(payload []byte, kind historyKind) bool {
+	c.historyKinds = append(c.historyKinds, kind)
+	if c.send(Message{Type: MsgHistoryRequest, Payload: payload}) != nil {
+		c.historyKinds = c.historyKinds[:len(c.historyKinds)-1]
+		return false
+	}
+	if kind == historyScreen {
+		c.screenBusy = true
+	}
+	return true
+}
+
+// historyResponse returns what the history response just received is
+// for. A screen is stale if a newer one was waiting to be requested; that
+// request goes out now.
+func (c *Client) historyResponse() (kind historyKind, stale bool) {
+	c.historyMu.Lock()
+	defer c.historyMu.Unlock()
+	if len(c.historyKinds) == 0 {
+		return historyScreen, false
+	}
+	kind = c.historyKinds[0]
+	c.historyKinds = c.historyKinds[1:]
+	if kind != historyScreen {
+		return kind, false
+	}
+	c.screenBusy = false
+	if c.screenPending == nil {
+		return kind, false
+	}
+	payload := c.screenPending
+	c.screenPending = nil
+	c.sendHistoryRequest(payload, historyScreen)
+	return kind, true
+}
+
+// splitRows is the default height of the split view's live rows, and
+// minSplitView the fewest rows of scrollback it leaves above them. On a
+// terminal too short for both, history mode uses the whole screen.
+const (
+	splitRows    = 5
+	minSplitView = 3
+)
+
+// splitting reports whether history mode shows the split view.
+func (c *Client) splitting() bool {
+	rows, _ := c.termSize()
+	return c.split.Load() && rows-c.splitRows-1 >= minSplitView
+}
+
+// viewRows returns how many rows of scrollback history mode shows: the
+// whole screen, less the live rows and the divider above them when split.
+func (c *Client) viewRows() int {
+	rows, _ := c.termSize()
+	if rows <= 0 {
+		rows = 24
+	}
+	if c.splitting() {
+		rows -= c.splitRows + 1
+	}
+	return rows
+}
+
+// requestTail asks for the lines shown in the split view's live rows.
+func (c *Client) requestTail() {
+	c.requestLines(0, c.splitRows, historyTail)
+}
+
+// tailDelay batches live output arriving in history mode into one
+// refresh of the split view's live rows.
+const tailDelay = 50 * time.Millisecond
+
+// scheduleTail refreshes the live rows shortly, unless that is already
+// scheduled.
+func (c *Client) scheduleTail() {
+	if !c.tailPending.CompareAndSwap(false, true) {
+		return
+	}
+	time.AfterFunc(tailDelay, func() {
+		c.tailPending.Store(false)
+		if c.historyMode.Load() && c.splitting() {
+			c.requestTail()
+		}
+	})
+}
+
+// promptTimeout bounds how long a prompt jump waits for the session.
+const promptTimeout = time.Second
+
+// jumpToPrompt scrolls history so the previous or next shell prompt is at
+// the top of the screen. Does nothing if there is no such prompt, e.g.
+// because the shell doesn't emit OSC 133 markers.
+func (c *Client) jumpToPrompt(next bool) {
+	// Drop a reply to an earlier request that timed out
+	select {
+	case <-c.prompts:
+	default:
+	}
+	c.send(Message{Type: MsgPromptsRequest})
+
+	var payload []byte
+	select {
+	case payload = <-c.prompts:
+	case <-time.After(promptTimeout):
+		return
+	case <-c.done:
+		return
+	}
+	if len(payload) < 4 {
+		return
+	}
+	total := int(binary.BigEndian.Uint32(payload[0:4]))
+
+	rows := c.viewRows()
+	top := total - c.historyOffset - rows
+	if top < 0 {
+		top = 0
+	}
+
+	target := -1
+	for i := 4; i+4 <= len(payload); i += 4 {
+		p := int(binary.BigEndian.Uint32(payload[i : i+4]))
+		if next && p > top {
+			target = p
+			break
+		}
+		if !next && p < top {
+			target = p // keep going: the last one before top wins
+		}
+	}
+	if target < 0 {
+		return
+	}
+
+	c.historyOffset = total - target - rows
+	if c.historyOffset <= 0 {
+		// The prompt is on the live screen
+		c.exitHistoryMode()
+		return
+	}
+	c.requestHistory()
+}
+
+// enterHistoryMode switches to history mode, offset lines back from the
+// end, and turns on mouse reporting so the wheel scrolls. Mouse reporting
+// is off in live mode so the terminal's own text selection keeps working.
+func (c *Client) enterHistoryMode(offset int) {
+	c.historyMode.Store(true)
+	c.historyOffset = offset
+	c.forgetHistoryScreen()
+	c.setMouse(true)
+	c.requestHistory()
+	if c.splitting() {
+		c.requestTail()
+	}
+}
+
+// exitHistoryMode returns to live output mode.
+func (c *Client) exitHistoryMode() {
+	c.historyMode.Store(false)
+	c.historyOffset = 0
+	c.setMouse(false)
+
+	// The redraw shows everything held by a pause, so that ends too.
+	// The position indicator goes now rather than when the redraw
+	// arrives, in case that is slow.
+	c.outMu.Lock()
+	c.paused = false
+	c.held, c.heldDropped = nil, false
+	c.shown = nil
+	if c.historyIndicator > 0 {
+		c.eraseIndicator(c.historyIndicator)
+		c.historyIndicator = 0
+	}
+	c.outMu.Unlock()
+
+	// Request redraw of latest lines
+	c.sendRedrawRequest()
+}
+
+// relaySocket reads messages from the session socket and writes to stdout.
+func (c *Client) relaySocket() {
+	defer c.signalDone()
+
+	r := bufio.NewReader(c.conn)
+	for {
+		msg, err := Decode(r)
+		if err != nil {
+			// EOF is the session closing the connection, which it does
+			// when it ends or drops us; anything else is a broken one
+			if !errors.Is(err, io.EOF) {
+				c.writeMu.Lock()
+				c.connBroken(err)
+				c.writeMu.Unlock()
+			}
+			return
+		}
+
+		switch msg.Type {
+		case MsgData:
+			c.pasteMode.Write(msg.Payload)
+			c.bracketed.Store(c.pasteMode.on)
+			switch {
+			case c.historyMode.Load():
+				if c.splitting() {
+					c.scheduleTail()
+				}
+			case !c.choosingSession.Load():
+				c.writeOutput(msg.Payload)
+			}
+
+		case MsgHistoryResponse:
+			switch kind, stale := c.historyResponse(); {
+			case kind == historyTail:
+				c.renderTail(msg.Payload)
+			case kind == historyCopy:
+				c.copyHistory(msg.Payload)
+			case !stale:
+				c.renderHistory(msg.Payload)
+			}
+
+		case MsgPromptsResponse:
+			select {
+			case c.prompts <- msg.Payload:
+			default:
+			}
+
+		case MsgError:
+			// The session refused us; it closes the connection next
+			c.sessionErr = parseSessionError(msg.Payload)
+
+		case MsgDetach:
+			// The session dropped us; it closes the connection next
+			reason := DetachTakeover
+			if len(msg.Payload) > 0 {
+				reason = DetachReason(msg.Payload[0])
+			}
+			c.setDetachReason(reason)
+
+		default:
+			// From a newer session, or a sign the stream is out of step
+			if debug {
+				log.Printf("client: ignoring unexpected %s message (%d bytes)", msg.Type, len(msg.Payload))
+			}
+		}
+	}
+}
+
+// renderHistory renders history lines and optional position indicator.
+func (c *Client) renderHistory(payload []byte) {
+	if len(payload) < 8 {
+		return
+	}
+
+	startLine := int(binary.BigEndian.Uint32(payload[0:4]))
+	totalLines := int(binary.BigEndian.Uint32(payload[4:8]))
+	lineData := payload[8:]
+
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	// Reset attributes first, or colors left on by the previous screen
+	// would fill the cleared one
+	io.WriteString(c.out, "\x1b[0m")
+
+	// A small scroll step shifts the screen already shown and draws only
+	// the lines it uncovers, rather than redrawing it all
+	prev := c.shown
+	c.shown = nil
+	scrolled := false
+	if c.historyMode.Load() {
+		_, cols := c.termSize()
+		screen := &historyView{
+			start: startLine,
+			lines: bytes.Split(lineData, crlf),
+			rows:  c.viewRows(),
+			cols:  cols,
+			split: c.splitting(),
+		}
+		if screen.fits(c.tabWidth) {
+			c.shown = screen
+			scrolled = c.scrollHistory(prev, screen)
+		}
+	}
+
+	if !scrolled {
+		clearScreen(c.out)
+		if c.historyMode.Load() && c.splitting() {
+			// Long lines are cut off rather than wrapped into the live rows
+			io.WriteString(c.out, "\x1b[?7l")
+			c.out.Write(lineData)
+			io.WriteString(c.out, "\x1b[?7h")
+			c.drawTail()
+		} else {
+			c.out.Write(lineData)
+		}
+	}
+	c.historyIndicator = 0
+
+	// Show scroll position indicator at top-right if in history mode
+	if c.historyMode.Load() && totalLines > 0 {
+		text := fmt.Sprintf("[line %d/%d]", startLine+1, totalLines)
+		c.drawIndicator(text)
+		c.historyIndicator = len(text)
+	}
+}
+
+// historyView is a screen of history as drawn by renderHistory.
+type historyView struct {
+	start int      // number of the first line in the scrollback
+	lines [][]byte // the lines, one per row
+	rows  int      // rows of history on screen
+	cols  int      // terminal width
+	split bool     // the split view is shown below
+}
+
+// fits reports whether the screen's lines fill its rows exactly, one row
+// each, so that rows and lines stay in step when it is scrolled. Tab stops
+// are tabWidth columns apart.
+func (h *historyView) fits(tabWidth int) bool {
+	if len(h.lines) != h.rows {
+		return false
+	}
+	for _, line := range h.lines {
+		if w := displayWidth(line, tabWidth); w < 0 || w > h.cols {
+			return false
+		}
+	}
+	return true
+}
+
+// scrollHistory draws next by scrolling prev, the screen on display,
+// and drawing only the lines that were not on it. It does nothing and
+// returns false if that isn't possible: nothing is on display, the layout
+// changed, the step is more than half a screen, or the lines the two have
+// in common differ, as they do once new output has pushed old lines out
+// of the scrollback. The caller holds outMu.
+func (c *Client) scrollHistory(prev, next *historyView) bool {
+	if prev == nil || prev.rows != next.rows || prev.cols != next.cols || prev.split != next.split {
+		return false
+	}
+	d := next.start - prev.start // lines moved towards the end
+	rows := next.rows
+	if d == 0 || abs(d) > rows/2 {
+		return false
+	}
+	kept := rows - abs(d)
+	for i := 0; i < kept; i++ {
+		old, cur := prev.lines[i+max(d, 0)], next.lines[i+max(-d, 0)]
+		if !bytes.Equal(old, cur) {
+			return false
+		}
+	}
+
+	// The indicator was drawn over the top row, which may move down:
+	// draw that row again without it first
+	if c.historyIndicator > 0 {
+		c.drawHistoryLine(1, prev.lines[0])
+	}
+	fmt.Fprintf(c.out, "\x1b[1;%dr", rows) // scroll only the history rows
+	moveCursor(c.out, 1, 1)
+	first := 0 // the first row drawn, counting from 0
+	if d > 0 {
+		fmt.Fprintf(c.out, "\x1b[%dM", d) // delete lines at the top
+		first = kept
+	} else {
+		fmt.Fprintf(c.out, "\x1b[%dL", -d) // insert lines at the top
+	}
+	for i := first; i < first+abs(d); i++ {
+		c.drawHistoryLine(i+1, next.lines[i])
+	}
+	io.WriteString(c.out, "\x1b[r") // whole screen scrolls again
+	moveCursor(c.out, rows, 1)
+	return true
+}
+
+// abs returns the absolute value of n.
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// forgetHistoryScreen makes the next history screen a full redraw, for
+// when something else has drawn over the last one.
+func (c *Client) forgetHistoryScreen() {
+	c.outMu.Lock()
+	c.shown = nil
+	c.outMu.Unlock()
+}
+
+// drawHistoryLine draws line on a cleared row of the screen.
+func (c *Client) drawHistoryLine(row int, line []byte) {
+	moveCursor(c.out, row, 1)
+	io.WriteString(c.out, "\x1b[0m\x1b[2K")
+	c.out.Write(line)
+	io.WriteString(c.out, "\x1b[0m")
+}
+
+// renderTail draws a response to requestTail in the split view's live
+// rows, if they are still on screen.
+func (c *Client) renderTail(payload []byte) {
+	if len(payload) < 8 {
+		return
+	}
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	if !c.historyMode.Load() || !c.splitting() {
+		return
+	}
+	c.tail = append(c.tail[:0], payload[8:]...)
+	c.drawTail()
+}
+
+// maxCopyLines asks for all of the scrollback, however long.
+const maxCopyLines = 1 << 30
+
+// clipboardLimit caps the text copy-history puts on the clipboard. Some
+// terminals ignore or cut short bigger OSC 52 writes, so past it only the
+// most recent lines are copied.
+const clipboardLimit = 512 << 10
+
+// copyHistory puts the scrollback in payload, a history response, on the
+// system clipboard with OSC 52, and says what was copied in the
+// indicator.
+func (c *Client) copyHistory(payload []byte) {
+	reg := c.copyRegister()
+	if len(payload) < 8 {
+		return
+	}
+	text, copied, total := clipboardText(payload[8:], clipboardLimit)
+
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	if copied > 0 {
+		io.WriteString(c.out, "\x1b]52;c;")
+		io.WriteString(c.out, base64.StdEncoding.EncodeToString(text))
+		io.WriteString(c.out, "\x07")
+		if c.registers == nil {
+			c.registers = make(map[byte][]byte)
+		}
+		text = bytes.Clone(text)
+		c.registers[reg] = text
+		c.registers[unnamedRegister] = text
+	}
+	var notice string
+	switch {
+	case copied == 0:
+		notice = "[nothing to copy]"
+	case copied < total:
+		notice = fmt.Sprintf("[copied last %d of %d lines]", copied, total)
+	default:
+		notice = fmt.Sprintf("[copied %d lines]", total)
+	}
+	if copied > 0 && reg != unnamedRegister {
+		notice = fmt.Sprintf("%s into \"%c]", strings.TrimSuffix(notice, "]"), reg)
+	}
+	c.showNotice(notice)
+}
+
+// showNotice shows notice in place of the history mode position
+// indicator, until the next screen draws it again. The caller holds
+// outMu.
+func (c *Client) showNotice(notice string) {
+	if !c.historyMode.Load() {
+		return
+	}
+	if c.historyIndicator > 0 {
+		c.eraseIndicator(c.historyIndicator)
+	}
+	c.drawIndicator(notice)
+	c.historyIndicator = len(notice)
+}
+
+// unnamedRegister is the register copies and pastes use unless another is
+// selected first, named after vim's.
+const unnamedRegister = '"'
+
+// isRegister reports whether b names a register: a letter, a digit or
+// the unnamed register.
+func isRegister(b byte) bool {
+	return b >= 'a' && b <= 'z' || b >= '0' && b <= '9' || b == unnamedRegister
+}
+
+// copyRegister returns the register the copy response just received is
+// for.
+func (c *Client) copyRegister() byte {
+	c.historyMu.Lock()
+	defer c.historyMu.Unlock()
+	if len(c.copyRegisters) == 0 {
+		return unnamedRegister
+	}
+	reg := c.copyRegisters[0]
+	c.copyRegisters = c.copyRegisters[1:]
+	return reg
+}
+
+// pasteText returns what register reg holds, to be typed into the session
+// as a terminal would send it pasted. Line breaks become carriage returns,
+// so each line is entered as if Enter had been pressed, and if the program
+// has bracketed paste mode on, the text is bracketed, with any end marker
+// in it removed so the text can't end the paste early. If the register is
+// empty it says so in history mode and returns nil.
+func (c *Client) pasteText(reg byte) []byte {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	text := c.registers[reg]
+	if len(text) == 0 {
+		c.showNotice(fmt.Sprintf("[register \"%c is empty]", reg))
+		return nil
+	}
+	text = bytes.ReplaceAll(text, lf, cr)
+	if !c.bracketed.Load() {
+		return text
+	}
+	text = bytes.ReplaceAll(text, []byte(pasteEnd), nil)
+	out := make([]byte, 0, len(pasteStart)+len(text)+len(pasteEnd))
+	out = append(out, pasteStart...)
+	out = append(out, text...)
+	return append(out, pasteEnd...)
+}
+
+// clipboardText returns the lines in data, at most limit bytes of them
+// from the end, and how many lines that is out of the total.
+func clipboardText(data []byte, limit int) (text []byte, copied, total int) {
+	if len(data) == 0 {
+		return nil, 0, 0
+	}
+	total = bytes.Count(data, lf) + 1
+	text = data
+	if len(text) > limit {
+		text = text[len(text)-limit:]
+		// Whole lines only
+		if i := bytes.IndexByte(text, '\n'); i >= 0 {
+			text = text[i+1:]
+		} else {
+			text = nil
+		}
+	}
+	if len(text) == 0 {
+		return nil, 0, total
+	}
+	return text, bytes.Count(text, lf) + 1, total
+}
+
+// splitLabel heads the split view's live rows.
+const splitLabel = " live "
+
+// drawTail draws the divider and the live rows at the bottom of the
+// split view, leaving the cursor and attributes as they were. The caller
+// holds outMu.
+func (c *Client) drawTail() {
+	rows, cols := c.termSize()
+	top := rows - c.splitRows // the divider's row
+	lines := bytes.Split(c.tail, crlf)
+	if len(lines) > c.splitRows {
+		lines = lines[len(lines)-c.splitRows:]
+	}
+
+	io.WriteString(c.out, "\x1b7\x1b[?7l")
+	moveCursor(c.out, top, 1)
+	io.WriteString(c.out, "\x1b[0;7m")
+	io.WriteString(c.out, splitLabel)
+	io.WriteString(c.out, strings.Repeat(" ", max(0, cols-len(splitLabel))))
+	for i := 0; i < c.splitRows; i++ {
+		moveCursor(c.out, top+1+i, 1)
+		io.WriteString(c.out, "\x1b[0m\x1b[2K")
+		if i < len(lines) {
+			c.out.Write(lines[i])
+		}
+	}
+	io.WriteString(c.out, "\x1b[0m\x1b[?7h\x1b8")
+}
+
+// drawIndicator prints text in reverse video at the top-right corner,
+// leaving the cursor and attributes as they were. Attributes are reset
+// first, so colors left on by the output around it don't bleed in.
+func (c *Client) drawIndicator(text string) {
+	_, cols := c.termSize()
+	col := cols - len(text) + 1
+	if col < 1 {
+		col = 1
+	}
+	// Save cursor, move to top-right, print indicator, restore cursor
+	io.WriteString(c.out, "\x1b7")     // save cursor and attributes
+	moveCursor(c.out, 1, col)          // move to top-right
+	io.WriteString(c.out, "\x1b[0;7m") // plain reverse video
+	io.WriteString(c.out, text)        // print indicator
+	io.WriteString(c.out, "\x1b[0m")   // reset attributes
+	io.WriteString(c.out, "\x1b8")     // restore cursor and attributes
+}
+
+// eraseIndicator blanks an indicator of width cells drawn by drawIndicator.
+func (c *Client) eraseIndicator(width int) {
+	_, cols := c.termSize()
+	col := cols - width + 1
+	if col < 1 {
+		col = 1
+	}
+	io.WriteString(c.out, "\x1b7")
+	moveCursor(c.out, 1, col)
+	io.WriteString(c.out, "\x1b[0m")
+	io.WriteString(c.out, strings.Repeat(" ", width))
+	io.WriteString(c.out, "\x1b8")
+}
+
+// pauseLimit caps the output held while paused. Past it the held output
+// is dropped and the screen is redrawn on resume instead, so a pause never
+// holds up the session or grows without bound.
+const pauseLimit = 1 << 20
+
+// pauseIndicator is shown while live output is paused.
+const pauseIndicator = "[paused]"
+
+// bannerDelay is how long the banner waits for the redraw on attach, and
+// bannerTime how long it stays up.
+const (
+	bannerDelay = 200 * time.Millisecond
+	bannerTime  = 3 * time.Second
+)
+
+// showBanner draws the attach banner if it is due, and arranges for it to
+// go. The caller holds outMu.
+func (c *Client) showBanner() {
+	if !c.bannerDue {
+		return
+	}
+	c.bannerDue = false
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	c.bannerShown = true
+	c.drawIndicator(c.banner)
+	time.AfterFunc(bannerTime, c.clearBanner)
+}
+
+// clearBanner removes the attach banner, or stops it from being drawn.
+// History mode and the picker have replaced the screen it was on.
+func (c *Client) clearBanner() {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	c.bannerDue = false
+	if !c.bannerShown {
+		return
+	}
+	c.bannerShown = false
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	if !c.historyMode.Load() && !c.choosingSession.Load() {
+		c.eraseIndicator(len(c.banner))
+	}
+}
+
+// writeOutput writes live session output, or holds it while paused.
+func (c *Client) writeOutput(p []byte) {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	if !c.paused {
+		c.out.Write(p)
+		c.showBanner()
+		return
+	}
+	if c.heldDropped {
+		return
+	}
+	if len(c.held)+len(p) > pauseLimit {
+		c.held = nil
+		c.heldDropped = true
+		return
+	}
+	c.held = append(c.held, p...)
+}
+
+// togglePause pauses live output, or resumes it by writing out everything
+// that arrived in the meantime.
+func (c *Client) togglePause() {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	if !c.paused {
+		c.paused = true
+		c.drawIndicator(pauseIndicator)
+		return
+	}
+
+	c.paused = false
+	c.eraseIndicator(len(pauseIndicator))
+	held, dropped := c.held, c.heldDropped
+	c.held, c.heldDropped = nil, false
+	if dropped {
+		c.sendRedrawRequest()
+	} else {
+		c.out.Write(held)
+	}
+}
+
+// termSize returns the terminal's rows and columns.
+func (c *Client) termSize() (rows, cols int) {
+	c.sizeMu.Lock()
+	defer c.sizeMu.Unlock()
+	return c.termRows, c.termCols
+}
+
+// setTermSize records a new size for the terminal.
+func (c *Client) setTermSize(rows, cols int) {
+	c.sizeMu.Lock()
+	c.termRows, c.termCols = rows, cols
+	c.sizeMu.Unlock()
+}
+
+// sendResize sends the current terminal dimensions to the session.
+func (c *Client) sendResize() {
+	rows, cols := c.termSize()
+	if rows <= 0 || cols <= 0 {
+		// The size couldn't be read; the session keeps its current one
+		return
+	}
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint16(payload[0:2], uint16(rows))
+	binary.BigEndian.PutUint16(payload[2:4], uint16(cols))
+
+	c.send(Message{Type: MsgResize, Payload: payload})
+}
+
+// send writes a framed message to the session. Writes are serialized so
+// messages sent from different goroutines never interleave on the wire.
+func (c *Client) send(msg Message) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.wbuf = EncodeTo(c.wbuf[:0], msg)
+	_, err := c.conn.Write(c.wbuf)
+	if cap(c.wbuf) > maxScratch {
+		c.wbuf = nil
+	}
+	if err != nil {
+		c.connBroken(err)
+	}
+	return err
+}
+
+// connBroken records that the connection failed with err and shuts the
+// client down, so callers of send can ignore its error unless they have
+// something to undo. Errors once the client is already shutting down are
+// from Run closing the connection and aren't recorded. The caller holds
+// writeMu.
+func (c *Client) connBroken(err error) {
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	if c.connErr == nil {
+		c.connErr = err
+	}
+	c.signalDone()
+}
+
+// suspend stops the client with SIGTSTP so the user gets their launching
+// shell back. The terminal is restored first; when the client is continued
+// it re-enters raw mode, reports the (possibly changed) size and redraws.
+func (c *Client) suspend() {
+	if c.termFd < 0 {
+		return
+	}
+
+	// Hand the shell back a terminal without mouse reporting, and turn it
+	// on again afterwards if we are still in history mode
+	c.setMouse(false)
+	defer c.setMouse(c.historyMode.Load())
+	if c.oldState != nil {
+		restoreTerminal(c.termFd, c.oldState)
+	}
+
+	if err := stopProcessGroup(); err != nil {
+		c.oldState, _ = enableRawMode(c.termFd)
+		return
+	}
+
+	if state, err := enableRawMode(c.termFd); err == nil {
+		c.oldState = state
+	}
+	c.forgetHistoryScreen()
+	if rows, cols, err := getTerminalSize(c.sizeFd); err == nil {
+		c.setTermSize(rows, cols)
+	}
+	c.sendResize()
+	c.sendRedrawRequest()
+}
+
+// detach tells the session this client is leaving and shuts the client
+// down. The session keeps running.
+func (c *Client) detach() {
+	select {
+	case <-c.done:
+		return // already shutting down, e.g. the session ended
+	default:
+	}
+	c.setDetachReason(DetachUser)
+	c.send(Message{Type: MsgDetach, Payload: nil})
+	c.signalDone()
+}
+
+// signalDone signals that the client should shut down.
+func (c *Client) signalDone() {
+	c.once.Do(func() {
+		close(c.done)
+	})
+}
+
+// showSessionPicker displays a list of sessions for the user to choose from.
+func (c *Client) showSessionPicker() {
+	// The picker takes over from history mode; cancelling it redraws the
+	// live screen
+	if c.historyMode.Load() {
+		c.historyMode.Store(false)
+		c.historyOffset = 0
+		c.setMouse(false)
+	}
+	c.forgetHistoryScreen()
+	c.sessionChoices = ListSessions()
+	c.choosingSession.Store(true)
+	c.pickerPreviews = make(map[string][][]byte)
+	// Start on the session we're attached to
+	c.pickerCursor = 0
+	for i, info := range c.sessionChoices {
+		if info.ID == c.sessionID {
+			c.pickerCursor = i
+		}
+	}
+	c.drawPicker()
+}
+
+// pickerPageSize is the number of sessions listed per picker page, one
+// for each digit key.
+const pickerPageSize = 9
+
+// pickerPages returns the number of pages the session list takes.
+func (c *Client) pickerPages() int {
+	return max(1, (len(c.sessionChoices)+pickerPageSize-1)/pickerPageSize)
+}
+
+// drawPicker draws the page of the session picker holding the cursor,
+// with the selected session in reverse video.
+func (c *Client) drawPicker() {
+	clearScreen(c.out)
+	io.WriteString(c.out, "\x1b[1mSwitch session:\x1b[0m\r\n\r\n")
+
+	page := c.pickerCursor / pickerPageSize
+	first := page * pickerPageSize
+	last := min(first+pickerPageSize, len(c.sessionChoices))
+	for i := first; i < last; i++ {
+		info := c.sessionChoices[i]
+		shortID := info.ID
+		if len(shortID) > 8 {
+			shortID = shortID[:8]
+		}
+		marker := "  "
+		if info.ID == c.sessionID {
+			marker = "* "
+		}
+		line := fmt.Sprintf("%s%d) %s [%s]", marker, i-first+1, info.Name, shortID)
+		if i == c.pickerCursor {
+			line = "\x1b[7m" + line + "\x1b[27m"
+		}
+		io.WriteString(c.out, "  "+line+"\r\n")
+	}
+	if pages := c.pickerPages(); pages > 1 {
+		fmt.Fprintf(c.out, "\r\n  Page %d/%d, < > to turn\r\n", page+1, pages)
+	}
+	c.drawPreview()
+
+	io.WriteString(c.out, "\r\n  j/k or arrows to move, Enter to attach\r\n")
+	io.WriteString(c.out, "  n) New session\r\n")
+	io.WriteString(c.out, "  d) Delete selected session\r\n")
+	io.WriteString(c.out, "  q) Cancel\r\n\r\n")
+	io.WriteString(c.out, "Choice: ")
+}
+
+// pickerPreviewLines is how many of the selected session's last lines the
+// picker shows, and previewTimeout how long it waits for them.
+const (
+	pickerPreviewLines = 5
+	previewTimeout     = 300 * time.Millisecond
+)
+
+// drawPreview shows the last lines of the selected session so it can be
+// told apart from the others. The lines are fetched with a history
+// request, which doesn't attach, and kept for as long as the picker is
+// open. Autowrap is off while they're drawn so long lines are cut off at
+// the edge of the screen instead of pushing the rest of the picker down.
+func (c *Client) drawPreview() {
+	if c.pickerCursor >= len(c.sessionChoices) {
+		return
+	}
+	info := c.sessionChoices[c.pickerCursor]
+	lines, ok := c.pickerPreviews[info.ID]
+	if !ok {
+		// A session that doesn't answer just has no preview
+		lines, _ = QueryHistory(info, pickerPreviewLines, previewTimeout)
+		c.pickerPreviews[info.ID] = lines
+	}
+	if len(lines) == 0 {
+		return
+	}
+	io.WriteString(c.out, "\r\n\x1b[?7l")
+	for _, line := range lines {
+		io.WriteString(c.out, "  \x1b[2m│\x1b[0m ")
+		c.out.Write(line)
+		io.WriteString(c.out, "\x1b[0m\x1b[K\r\n")
+	}
+	io.WriteString(c.out, "\x1b[?7h")
+}
+
+// movePickerCursor moves the picker's selection by delta, clamped to the list,
+// and redraws it.
+func (c *Client) movePickerCursor(delta int) {
+	c.pickerCursor = max(0, min(c.pickerCursor+delta, len(c.sessionChoices)-1))
+	c.drawPicker()
+}
+
+// handleSessionChoice processes a key while the session picker is shown.
+func (c *Client) handleSessionChoice(key []byte) {
+	switch string(key) {
+	case "j", "\x1b[B", "\x1bOB":
+		c.movePickerCursor(1)
+		return
+	case "k", "\x1b[A", "\x1bOA":
+		c.movePickerCursor(-1)
+		return
+	case ">", "\x1b[6~":
+		c.movePickerCursor(pickerPageSize)
+		return
+	case "<", "\x1b[5~":
+		c.movePickerCursor(-pickerPageSize)
+		return
+	}
+
+	b := key[0]
+	switch {
+	case b == 'd' || b == 'D':
+		if c.pickerCursor >= len(c.sessionChoices) {
+			return
+		}
+		chosen := c.sessionChoices[c.pickerCursor]
+		if chosen.ID == c.sessionID {
+			c.deleteCurrentSession()
+			return
+		}
+		KillSession(chosen)
+		// Brief pause so the session has time to clean up
+		time.Sleep(200 * time.Millisecond)
+		cursor := c.pickerCursor
+		c.showSessionPicker()
+		// Keep the selection where the deleted session was
+		c.pickerCursor = max(0, min(cursor, len(c.sessionChoices)-1))
+		c.drawPicker()
+		return
+	}
+
+	c.choosingSession.Store(false)
+
+	switch {
+	case b == 'n' || b == 'N':
+		c.SwitchTarget = &SessionInfo{}
+		c.detach()
+
+	case b == '\r' || b == '\n':
+		c.switchTo(c.pickerCursor)
+
+	case b >= '1' && b <= '9':
+		page := c.pickerCursor / pickerPageSize
+		c.switchTo(page*pickerPageSize + int(b-'1'))
+
+	default:
+		// q, Esc or any other key cancels
+		c.sendRedrawRequest()
+	}
+}
+
+// deleteCurrentSession kills the session the client is attached to and
+// switches to the session listed next to it, or to a new one if it was
+// the last. The client detaches before the kill, so it leaves with a
+// switch to make rather than seeing its session end under it.
+func (c *Client) deleteCurrentSession() {
+	c.choosingSession.Store(false)
+	current := c.sessionChoices[c.pickerCursor]
+
+	next := &SessionInfo{}
+	if i := c.pickerCursor + 1; i < len(c.sessionChoices) {
+		next = &c.sessionChoices[i]
+	} else if i := c.pickerCursor - 1; i >= 0 {
+		next = &c.sessionChoices[i]
+	}
+	c.SwitchTarget = next
+	c.setDetachReason(DetachUser)
+	c.send(Message{Type: MsgDetach, Payload: nil})
+	KillSession(current)
+	c.signalDone()
+}
+
+// switchTo leaves the picker for the session at index idx of the list.
+// Picking the current session, or none, just returns to it.
+func (c *Client) switchTo(idx int) {
+	if idx < 0 || idx >= len(c.sessionChoices) || c.sessionChoices[idx].ID == c.sessionID {
+		c.sendRedrawRequest()
+		return
+	}
+	chosen := c.sessionChoices[idx]
+	c.SwitchTarget = &chosen
+	c.detach()
+}
+
+// sendRedrawRequest asks the session to resend the current screen.
+func (c *Client) sendRedrawRequest() {
+	rows, _ := c.termSize()
+	if rows <= 0 {
+		rows = 24
+	}
+	c.requestLines(0, rows, historyScreen)
+}
+
+// setMouse turns the terminal's mouse reporting on or off, if it supports
+// it.
+func (c *Client) setMouse(on bool) {
+	if on == c.mouseOn || !c.mouseCapable {
+		return
+	}
+	if on {
+		enableMouseMode(c.out)
+	} else {
+		disableMouseMode(c.out)
+	}
+	c.mouseOn = on
+}
+
+// restoreOnPanic puts the terminal back before a panic in one of the
+// client's goroutines kills the process, so the user isn't left in raw
+// mode with mouse reporting on. Must be deferred.
+func (c *Client) restoreOnPanic() {
+	if r := recover(); r != nil {
+		c.restore()
+		panic(r)
+	}
+}
+
+// restore restores terminal state and disables mouse mode.
+func (c *Client) restore() {
+	c.setMouse(false)
+	if c.oldState != nil {
+		restoreTerminal(c.termFd, c.oldState)
+	}
+	c.conn.Close()
+}
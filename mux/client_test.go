@@ -0,0 +1,1046 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// waitFor polls cond until it returns true or the timeout expires.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testClient is a Client wired to in-memory input and output.
+type testClient struct {
+	*Client
+	input  *io.PipeWriter
+	output *syncBuffer
+	result chan error
+}
+
+// startTestClient attaches a Client to s and runs it in the background.
+func startTestClient(t *testing.T, s *Session) *testClient {
+	t.Helper()
+	return startTestClientWith(t, s, ClientOptions{})
+}
+
+// startTestClientWith is startTestClient with extra client options.
+func startTestClientWith(t *testing.T, s *Session, opts ClientOptions) *testClient {
+	t.Helper()
+	r, w := io.Pipe()
+	out := &syncBuffer{}
+	opts.Input, opts.Output = r, out
+	opts.Rows, opts.Cols = 24, 80
+	c, err := DialClient(UnixTransport{}, s.socketPath, s.id, s.name, opts)
+	if err != nil {
+		t.Fatalf("DialClient: %v", err)
+	}
+	tc := &testClient{Client: c, input: w, output: out, result: make(chan error, 1)}
+	go func() { tc.result <- c.Run() }()
+	t.Cleanup(func() { w.Close() })
+	return tc
+}
+
+// typeInput feeds keystrokes to the client as one read.
+func (tc *testClient) typeInput(t *testing.T, s string) {
+	t.Helper()
+	if _, err := tc.input.Write([]byte(s)); err != nil {
+		t.Fatalf("write input: %v", err)
+	}
+}
+
+// wait waits for the client's Run to return.
+func (tc *testClient) wait(t *testing.T) {
+	t.Helper()
+	select {
+	case err := <-tc.result:
+		if err != nil {
+			t.Fatalf("Run: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("client did not exit")
+	}
+}
+
+func TestClientEchoRoundTrip(t *testing.T) {
+	s := startTestSession(t)
+	tc := startTestClient(t, s)
+
+	tc.typeInput(t, "echo round-$((1+1))\r")
+	waitFor(t, "echoed output", func() bool {
+		return strings.Contains(tc.output.String(), "round-2")
+	})
+}
+
+func TestClientDetachLeavesSessionRunning(t *testing.T) {
+	s := startTestSession(t)
+	tc := startTestClient(t, s)
+
+	tc.typeInput(t, "echo before-$((1+1))\r")
+	waitFor(t, "first output", func() bool {
+		return strings.Contains(tc.output.String(), "before-2")
+	})
+
+	tc.typeInput(t, "\x01d")
+	tc.wait(t)
+	if !tc.Detached() {
+		t.Error("expected client to report a user detach")
+	}
+
+	// The session survives and replays its screen to the next client
+	if _, err := os.Stat(s.socketPath); err != nil {
+		t.Fatalf("socket gone after detach: %v", err)
+	}
+	again := startTestClient(t, s)
+	waitFor(t, "redraw on reattach", func() bool {
+		return strings.Contains(again.output.String(), "before-2")
+	})
+}
+
+func TestClientInputEOFDetaches(t *testing.T) {
+	s := startTestSession(t)
+	tc := startTestClient(t, s)
+
+	tc.typeInput(t, "echo up-$((1+1))\r")
+	waitFor(t, "output", func() bool {
+		return strings.Contains(tc.output.String(), "up-2")
+	})
+
+	// Losing the input (e.g. the terminal closed) detaches cleanly
+	tc.input.Close()
+	tc.wait(t)
+	if !tc.Detached() {
+		t.Error("expected input EOF to be reported as a detach")
+	}
+	if _, err := os.Stat(s.socketPath); err != nil {
+		t.Fatalf("session gone after input EOF: %v", err)
+	}
+}
+
+func TestClientHistoryMode(t *testing.T) {
+	s := startTestSession(t)
+	tc := startTestClient(t, s)
+
+	tc.typeInput(t, "i=0; while [ $i -lt 100 ]; do echo hist-$i; i=$((i+1)); done\r")
+	waitFor(t, "output", func() bool {
+		return strings.Contains(tc.output.String(), "hist-99")
+	})
+
+	// Ctrl+s enters history mode and renders the position indicator,
+	// in plain reverse video whatever colors the history left on
+	tc.typeInput(t, "\x13")
+	waitFor(t, "history indicator", func() bool {
+		return strings.Contains(tc.output.String(), "\x1b[0;7m[line ")
+	})
+	_, indicator, _ := strings.Cut(tc.output.String(), "\x1b[0;7m")
+	indicator, _, _ = strings.Cut(indicator, "\x1b[0m")
+
+	// q returns to live mode, erasing the indicator; the client keeps
+	// running
+	tc.typeInput(t, "q")
+	waitFor(t, "indicator erased", func() bool {
+		return strings.Contains(tc.output.String(), "\x1b[0m"+strings.Repeat(" ", len(indicator))+"\x1b8")
+	})
+	tc.typeInput(t, "echo live-$((1+1))\r")
+	waitFor(t, "live output after history", func() bool {
+		return strings.Contains(tc.output.String(), "live-2")
+	})
+}
+
+func TestClientHistoryCoalesced(t *testing.T) {
+	s := startTestSession(t)
+	tc := startTestClient(t, s)
+
+	tc.typeInput(t, "i=0; while [ $i -lt 300 ]; do echo hist-$i; i=$((i+1)); done\r")
+	waitFor(t, "output", func() bool {
+		return strings.Contains(tc.output.String(), "hist-299")
+	})
+	tc.typeInput(t, "\x13")
+	waitFor(t, "history mode", func() bool {
+		return strings.Contains(tc.output.String(), "[line ")
+	})
+
+	// Twenty steps up at once draw far fewer screens, ending on the last
+	const steps = 20
+	before := strings.Count(tc.output.String(), "[line ")
+	tc.typeInput(t, strings.Repeat("k", steps))
+	offset := (steps + 1) * scrollLines
+	waitFor(t, "final screen", func() bool {
+		out := tc.output.String()
+		var line, total int
+		fmt.Sscanf(out[strings.LastIndex(out, "[line "):], "[line %d/%d]", &line, &total)
+		return line == total-offset-24+1
+	})
+	if drawn := strings.Count(tc.output.String(), "[line ") - before; drawn >= steps/2 {
+		t.Errorf("%d screens drawn for %d steps", drawn, steps)
+	}
+}
+
+func TestClientHistoryScrollsInPlace(t *testing.T) {
+	s := startTestSession(t)
+	tc := startTestClient(t, s)
+
+	tc.typeInput(t, "i=0; while [ $i -lt 100 ]; do echo hist-$i; i=$((i+1)); done\r")
+	waitFor(t, "output", func() bool {
+		return strings.Contains(tc.output.String(), "hist-99")
+	})
+
+	// step presses key and returns what the client drew for it
+	step := func(key string) string {
+		t.Helper()
+		before := tc.output.String()
+		tc.typeInput(t, key)
+		waitFor(t, "history screen", func() bool {
+			return strings.Contains(tc.output.String()[len(before):], "[line ")
+		})
+		return tc.output.String()[len(before):]
+	}
+	step("\x13")
+
+	// A scroll step shifts the screen down and draws the 3 lines above it
+	if out := step("k"); strings.Contains(out, "\x1b[2J") || !strings.Contains(out, "\x1b[1;24r\x1b[1;1H\x1b[3L") {
+		t.Errorf("scroll up drew %q", out)
+	}
+	if out := step("j"); strings.Contains(out, "\x1b[2J") || !strings.Contains(out, "\x1b[3M") {
+		t.Errorf("scroll down drew %q", out)
+	}
+	// A whole page is drawn afresh
+	if out := step("\x1b[5~"); !strings.Contains(out, "\x1b[2J") {
+		t.Errorf("page up drew %q", out)
+	}
+}
+
+func TestClientCopyHistory(t *testing.T) {
+	s := startTestSession(t)
+	tc := startTestClient(t, s)
+
+	tc.typeInput(t, "i=0; while [ $i -lt 100 ]; do echo hist-$i; i=$((i+1)); done\r")
+	waitFor(t, "output", func() bool {
+		return strings.Contains(tc.output.String(), "hist-99")
+	})
+	tc.typeInput(t, "\x13")
+	waitFor(t, "history mode", func() bool {
+		return strings.Contains(tc.output.String(), "[line ")
+	})
+
+	// Y puts the whole scrollback on the clipboard as plain text
+	tc.typeInput(t, "Y")
+	waitFor(t, "copy notice", func() bool {
+		return strings.Contains(tc.output.String(), " lines]")
+	})
+	out := tc.output.String()
+	_, b64, _ := strings.Cut(out, "\x1b]52;c;")
+	b64, _, _ = strings.Cut(b64, "\x07")
+	text, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		t.Fatalf("OSC 52 payload %q: %v", b64, err)
+	}
+	if !strings.Contains(string(text), "hist-0\nhist-1\n") || !strings.Contains(string(text), "hist-99\n") || strings.Contains(string(text), "\r") {
+		t.Errorf("copied %q", text)
+	}
+	if !tc.historyMode.Load() {
+		t.Error("left history mode")
+	}
+}
+
+func TestClientRegisters(t *testing.T) {
+	s := startTestSession(t)
+	tc := startTestClient(t, s)
+
+	tc.typeInput(t, "echo reg-$((6*7))\r")
+	waitFor(t, "output", func() bool {
+		return strings.Contains(tc.output.String(), "reg-42")
+	})
+	tc.typeInput(t, "\x13")
+	waitFor(t, "history mode", func() bool {
+		return strings.Contains(tc.output.String(), "[line ")
+	})
+
+	// An empty register pastes nothing
+	tc.typeInput(t, "\"bP")
+	waitFor(t, "empty register notice", func() bool {
+		return strings.Contains(tc.output.String(), "[register \"b is empty]")
+	})
+
+	// "aY copies into register a, and the unnamed one as every copy does
+	tc.typeInput(t, "\"aY")
+	waitFor(t, "copy notice", func() bool {
+		return strings.Contains(tc.output.String(), " lines into \"a]")
+	})
+	tc.outMu.Lock()
+	a, unnamed := string(tc.registers['a']), string(tc.registers[unnamedRegister])
+	tc.outMu.Unlock()
+	if !strings.Contains(a, "reg-42\n") || unnamed != a {
+		t.Errorf("register a = %q, unnamed = %q", a, unnamed)
+	}
+
+	// "aP types it back in, reg-42 line and all
+	tc.typeInput(t, "\"aP")
+	waitFor(t, "pasted lines run", func() bool {
+		return strings.Contains(tc.output.String(), "reg-42: ")
+	})
+	if tc.historyMode.Load() {
+		t.Error("still in history mode after paste")
+	}
+
+	// Ctrl+a ] pastes the last copy from live mode
+	tc.typeInput(t, "\x01]")
+	waitFor(t, "pasted lines run again", func() bool {
+		return strings.Count(tc.output.String(), "reg-42: ") >= 2
+	})
+}
+
+func TestClientPasteText(t *testing.T) {
+	c := &Client{registers: map[byte][]byte{unnamedRegister: []byte("one\ntwo\x1b[201~three")}}
+	if got := string(c.pasteText(unnamedRegister)); got != "one\rtwo\x1b[201~three" {
+		t.Errorf("unbracketed: %q", got)
+	}
+	// Bracketed, without an end marker the text could end the paste with
+	c.bracketed.Store(true)
+	if got := string(c.pasteText(unnamedRegister)); got != "\x1b[200~one\rtwothree\x1b[201~" {
+		t.Errorf("bracketed: %q", got)
+	}
+	if got := c.pasteText('a'); got != nil {
+		t.Errorf("empty register: %q", got)
+	}
+}
+
+func TestClipboardText(t *testing.T) {
+	data := []byte("one\ntwo\nthree")
+	if text, copied, total := clipboardText(data, 100); string(text) != "one\ntwo\nthree" || copied != 3 || total != 3 {
+		t.Errorf("under the limit: %q, %d of %d", text, copied, total)
+	}
+	// Past the limit, whole lines from the end
+	if text, copied, total := clipboardText(data, 8); string(text) != "three" || copied != 1 || total != 3 {
+		t.Errorf("over the limit: %q, %d of %d", text, copied, total)
+	}
+	if text, copied, total := clipboardText(data, 3); text != nil || copied != 0 || total != 3 {
+		t.Errorf("no whole line fits: %q, %d of %d", text, copied, total)
+	}
+	if text, copied, total := clipboardText(nil, 10); text != nil || copied != 0 || total != 0 {
+		t.Errorf("empty: %q, %d of %d", text, copied, total)
+	}
+}
+
+func TestClientQuote(t *testing.T) {
+	s := startTestSession(t)
+	tc := startTestClient(t, s)
+
+	tc.typeInput(t, "cat -v\r")
+	waitFor(t, "command echoed", func() bool {
+		return strings.Contains(tc.output.String(), "cat -v")
+	})
+
+	// Page Up would enter history mode; quoted, it goes to cat instead
+	tc.typeInput(t, "\x01q\x1b[5~\r")
+	waitFor(t, "quoted key echoed", func() bool {
+		return strings.Contains(tc.output.String(), "^[[5~")
+	})
+	if tc.historyMode.Load() {
+		t.Error("quoted Page Up entered history mode")
+	}
+	tc.typeInput(t, "\x04")
+}
+
+func TestClientHistorySplit(t *testing.T) {
+	s := startTestSession(t)
+	tc := startTestClientWith(t, s, ClientOptions{SplitRows: 4})
+
+	tc.typeInput(t, "sleep 1; echo tail-$((2+3))\r")
+	waitFor(t, "command echoed", func() bool {
+		return strings.Contains(tc.output.String(), "tail-$((2+3))")
+	})
+
+	// t in history mode splits the screen: the divider goes above the
+	// last 4 rows of the 24
+	tc.typeInput(t, "\x13")
+	waitFor(t, "history mode", func() bool {
+		return strings.Contains(tc.output.String(), "[line ")
+	})
+	tc.typeInput(t, "t")
+	waitFor(t, "divider", func() bool {
+		return strings.Contains(tc.output.String(), "\x1b[20;1H\x1b[0;7m"+splitLabel)
+	})
+
+	// Output arriving while scrolled back shows up in the live rows
+	waitFor(t, "live output in split", func() bool {
+		_, after, _ := strings.Cut(tc.output.String(), splitLabel)
+		return strings.Contains(after, "tail-5")
+	})
+	if !tc.historyMode.Load() {
+		t.Error("left history mode")
+	}
+}
+
+func TestClientSessionEnds(t *testing.T) {
+	s := startTestSession(t)
+	tc := startTestClient(t, s)
+
+	tc.typeInput(t, "exit\r")
+	tc.wait(t)
+	if tc.Detached() {
+		t.Error("session exit should not be reported as a detach")
+	}
+}
+
+func TestConnRoundTrip(t *testing.T) {
+	s := startTestSession(t)
+
+	conn, err := Attach(UnixTransport{}, s.socketPath)
+	if err != nil {
+		t.Fatalf("Attach: %v", err)
+	}
+	defer conn.Close()
+
+	if err := conn.Resize(30, 100); err != nil {
+		t.Fatalf("Resize: %v", err)
+	}
+	if _, err := conn.Write([]byte("stty size\n")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	var got []byte
+	timeout := time.After(5 * time.Second)
+	for !bytes.Contains(got, []byte("30 100")) {
+		select {
+		case out, ok := <-conn.Output():
+			if !ok {
+				t.Fatalf("connection closed: %v", conn.Err())
+			}
+			got = append(got, out...)
+		case <-timeout:
+			t.Fatalf("timed out; output so far %q", got)
+		}
+	}
+
+	if err := conn.Detach(); err != nil {
+		t.Fatalf("Detach: %v", err)
+	}
+	for range conn.Output() {
+	}
+}
+
+// serveFrames listens on a Unix socket, sends the first client to connect
+// msgs and then leaves the connection open. It returns the socket path.
+func serveFrames(t *testing.T, msgs ...Message) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "fake.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { conn.Close() })
+		for _, msg := range msgs {
+			if _, err := conn.Write(Encode(msg)); err != nil {
+				return
+			}
+		}
+	}()
+	return path
+}
+
+func TestConnHello(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fake.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	first := make(chan Message, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		msg, _ := Decode(conn)
+		first <- msg
+	}()
+
+	conn, err := Attach(UnixTransport{}, path)
+	if err != nil {
+		t.Fatalf("Attach: %v", err)
+	}
+	defer conn.Close()
+
+	var msg Message
+	select {
+	case msg = <-first:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the hello")
+	}
+	if msg.Type != MsgHello {
+		t.Fatalf("first message is %s, want hello", msg.Type)
+	}
+	var hello Hello
+	if err := json.Unmarshal(msg.Payload, &hello); err != nil {
+		t.Fatalf("decode hello %q: %v", msg.Payload, err)
+	}
+	if hello.Version != ProtocolVersion {
+		t.Errorf("hello version = %d, want %d", hello.Version, ProtocolVersion)
+	}
+}
+
+func TestConnDetachReason(t *testing.T) {
+	tests := []struct {
+		payload []byte
+		want    error
+	}{
+		{nil, ErrTakenOver},
+		{[]byte{byte(DetachTakeover)}, ErrTakenOver},
+		{[]byte{byte(DetachRemote)}, ErrDetachedRemotely},
+		{[]byte{byte(DetachUser)}, ErrDetached},
+	}
+	for _, tt := range tests {
+		conn, err := Attach(UnixTransport{}, serveFrames(t, Message{Type: MsgDetach, Payload: tt.payload}))
+		if err != nil {
+			t.Fatalf("Attach: %v", err)
+		}
+		for range conn.Output() {
+		}
+		if conn.Err() != tt.want {
+			t.Errorf("detach payload %v: Err() = %v, want %v", tt.payload, conn.Err(), tt.want)
+		}
+		conn.Close()
+	}
+}
+
+func TestConnCloseWithoutReading(t *testing.T) {
+	// More output than Output buffers, none of it read
+	msgs := make([]Message, 100)
+	for i := range msgs {
+		msgs[i] = Message{Type: MsgData, Payload: []byte("x")}
+	}
+	conn, err := Attach(UnixTransport{}, serveFrames(t, msgs...))
+	if err != nil {
+		t.Fatalf("Attach: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	conn.Close()
+
+	// The reader gives up waiting for Output to have room, rather than
+	// only noticing the close once Output is read
+	time.Sleep(50 * time.Millisecond)
+	for range conn.Output() {
+	}
+	if conn.Err() != net.ErrClosed {
+		t.Errorf("Err() = %v, want %v", conn.Err(), net.ErrClosed)
+	}
+}
+
+func TestClientPauseHoldsOutput(t *testing.T) {
+	s := startTestSession(t)
+	tc := startTestClient(t, s)
+
+	tc.typeInput(t, "echo ready-$((1+1))\r")
+	waitFor(t, "output", func() bool {
+		return strings.Contains(tc.output.String(), "ready-2")
+	})
+
+	tc.typeInput(t, "\x01 ")
+	waitFor(t, "pause indicator", func() bool {
+		return strings.Contains(tc.output.String(), "[paused]")
+	})
+	tc.typeInput(t, "echo held-$((1+1))\r")
+	time.Sleep(200 * time.Millisecond)
+	if strings.Contains(tc.output.String(), "held-2") {
+		t.Fatal("output was written while paused")
+	}
+
+	tc.typeInput(t, "\x01 ")
+	waitFor(t, "held output after resume", func() bool {
+		return strings.Contains(tc.output.String(), "held-2")
+	})
+}
+
+func TestClientJumpToPrompt(t *testing.T) {
+	s := startTestSession(t)
+	tc := startTestClient(t, s)
+
+	// Mark one line as a prompt start with OSC 133;A
+	tc.typeInput(t, `i=0; while [ $i -lt 100 ]; do if [ $i -eq 50 ]; then printf '\033]133;A\007'; fi; echo cmd-$i; i=$((i+1)); done`+"\r")
+	waitFor(t, "output", func() bool {
+		return strings.Contains(tc.output.String(), "cmd-99")
+	})
+
+	tc.typeInput(t, "\x13")
+	waitFor(t, "history indicator", func() bool {
+		return strings.Contains(tc.output.String(), "[line ")
+	})
+	time.Sleep(100 * time.Millisecond)
+	before := len(tc.output.String())
+
+	tc.typeInput(t, "p")
+	waitFor(t, "jump to the marked prompt", func() bool {
+		after := tc.output.String()[before:]
+		return strings.Contains(after, "cmd-50") && !strings.Contains(after, "cmd-99")
+	})
+}
+
+func TestClientCustomKeymap(t *testing.T) {
+	s := startTestSession(t)
+	km := DefaultKeymap()
+	km.unbindAction(ActionDetach)
+	km.Prefix['x'] = ActionDetach
+	tc := startTestClientWith(t, s, ClientOptions{Keymap: &km})
+
+	// The old key does nothing; the typed text after it still reaches the shell
+	tc.typeInput(t, "\x01decho bound-$((1+1))\r")
+	waitFor(t, "output", func() bool {
+		return strings.Contains(tc.output.String(), "bound-2")
+	})
+
+	tc.typeInput(t, "\x01x")
+	tc.wait(t)
+	if !tc.Detached() {
+		t.Error("expected the rebound key to detach")
+	}
+}
+
+func TestClientCustomPrefixKey(t *testing.T) {
+	s := startTestSession(t)
+	km := DefaultKeymap()
+	km.PrefixKey = 0x02 // Ctrl+b
+	tc := startTestClientWith(t, s, ClientOptions{Keymap: &km})
+
+	tc.typeInput(t, "\x02d")
+	tc.wait(t)
+	if !tc.Detached() {
+		t.Error("expected Ctrl+b d to detach")
+	}
+}
+
+func TestClientTakeover(t *testing.T) {
+	s := startTestSession(t)
+	first := startTestClient(t, s)
+	first.typeInput(t, "echo first-$((1+1))\r")
+	waitFor(t, "output", func() bool {
+		return strings.Contains(first.output.String(), "first-2")
+	})
+
+	second := startTestClient(t, s)
+	first.wait(t)
+	if got := first.DetachReason(); got != DetachTakeover {
+		t.Errorf("DetachReason = %d, want DetachTakeover", got)
+	}
+
+	second.typeInput(t, "\x01d")
+	second.wait(t)
+	if got := second.DetachReason(); got != DetachUser {
+		t.Errorf("DetachReason = %d, want DetachUser", got)
+	}
+}
+
+func TestClientNoTakeover(t *testing.T) {
+	s := startTestSession(t)
+	first := startTestClient(t, s)
+	first.typeInput(t, "echo first-$((1+1))\r")
+	waitFor(t, "output", func() bool {
+		return strings.Contains(first.output.String(), "first-2")
+	})
+
+	// The second client is turned away, without output, and the first
+	// stays attached
+	second := startTestClientWith(t, s, ClientOptions{NoTakeover: true})
+	select {
+	case err := <-second.result:
+		var se *SessionError
+		if !errors.As(err, &se) || se.Code != ErrorBusy {
+			t.Errorf("Run = %v, want a busy SessionError", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("client did not exit")
+	}
+	if strings.Contains(second.output.String(), "first-2") {
+		t.Errorf("refused client got output: %q", second.output.String())
+	}
+	first.typeInput(t, "echo still-$((1+1))\r")
+	waitFor(t, "first client still attached", func() bool {
+		return strings.Contains(first.output.String(), "still-2")
+	})
+}
+
+// breakableTransport dials Unix sockets whose writes start failing once
+// broken is set, as if the connection had gone bad under the client.
+type breakableTransport struct {
+	UnixTransport
+	broken *atomic.Bool
+}
+
+func (t breakableTransport) Dial(addr string) (net.Conn, error) {
+	conn, err := t.UnixTransport.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	return breakableConn{conn, t.broken}, nil
+}
+
+type breakableConn struct {
+	net.Conn
+	broken *atomic.Bool
+}
+
+func (c breakableConn) Write(p []byte) (int, error) {
+	if c.broken.Load() {
+		return 0, syscall.EPIPE
+	}
+	return c.Conn.Write(p)
+}
+
+func TestClientWriteError(t *testing.T) {
+	s := startTestSession(t)
+	var broken atomic.Bool
+	r, w := io.Pipe()
+	defer w.Close()
+	out := &syncBuffer{}
+	c, err := DialClient(breakableTransport{broken: &broken}, s.socketPath, s.id, s.name,
+		ClientOptions{Input: r, Output: out, Rows: 24, Cols: 80})
+	if err != nil {
+		t.Fatalf("DialClient: %v", err)
+	}
+	result := make(chan error, 1)
+	go func() { result <- c.Run() }()
+
+	w.Write([]byte("echo alive-$((1+1))\r"))
+	waitFor(t, "output", func() bool {
+		return strings.Contains(out.String(), "alive-2")
+	})
+
+	// The session is still sending, but a failed write ends the client
+	broken.Store(true)
+	w.Write([]byte("x"))
+	select {
+	case err := <-result:
+		if !errors.Is(err, syscall.EPIPE) {
+			t.Errorf("Run = %v, want a broken pipe error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("client did not exit")
+	}
+	if c.Detached() {
+		t.Error("client reports a detach after losing its connection")
+	}
+}
+
+func TestClientMouseOnlyInHistoryMode(t *testing.T) {
+	s := startTestSession(t)
+	tc := startTestClientWith(t, s, ClientOptions{Term: "xterm-256color"})
+
+	tc.typeInput(t, "echo live-$((1+1))\r")
+	waitFor(t, "output", func() bool {
+		return strings.Contains(tc.output.String(), "live-2")
+	})
+	if strings.Contains(tc.output.String(), "\x1b[?1000h") {
+		t.Fatal("mouse reporting enabled in live mode")
+	}
+
+	tc.typeInput(t, "\x13")
+	waitFor(t, "mouse enabled in history mode", func() bool {
+		return strings.Contains(tc.output.String(), "\x1b[?1000h\x1b[?1006h")
+	})
+	tc.typeInput(t, "q")
+	waitFor(t, "mouse disabled on leaving history mode", func() bool {
+		return strings.Contains(tc.output.String(), "\x1b[?1006l\x1b[?1000l")
+	})
+}
+
+func TestClientMouseOffInPicker(t *testing.T) {
+	s := startTestSession(t)
+	tc := startTestClientWith(t, s, ClientOptions{Term: "xterm"})
+
+	tc.typeInput(t, "\x13")
+	waitFor(t, "mouse enabled in history mode", func() bool {
+		return strings.Contains(tc.output.String(), "\x1b[?1000h")
+	})
+	tc.typeInput(t, "\x01s")
+	waitFor(t, "session picker", func() bool {
+		return strings.Contains(tc.output.String(), "Switch session:")
+	})
+	out := tc.output.String()
+	if i := strings.Index(out, "Switch session:"); !strings.Contains(out[:i], "\x1b[?1000l") {
+		t.Error("mouse reporting still on in the session picker")
+	}
+
+	// Detaching turns nothing back on
+	tc.typeInput(t, "q\x01d")
+	tc.wait(t)
+	if out := tc.output.String(); strings.LastIndex(out, "\x1b[?1000h") > strings.LastIndex(out, "\x1b[?1000l") {
+		t.Error("mouse reporting left on after detach")
+	}
+}
+
+func TestClientSplitEscapeSequence(t *testing.T) {
+	s := startTestSession(t)
+	tc := startTestClient(t, s)
+	tc.typeInput(t, "i=0; while [ $i -lt 100 ]; do echo split-$i; i=$((i+1)); done\r")
+	waitFor(t, "output", func() bool {
+		return strings.Contains(tc.output.String(), "split-99")
+	})
+
+	// Page Up arriving in two reads still enters history mode
+	tc.typeInput(t, "\x1b[5")
+	time.Sleep(10 * time.Millisecond)
+	tc.typeInput(t, "~")
+	waitFor(t, "history indicator", func() bool {
+		return strings.Contains(tc.output.String(), "[line ")
+	})
+
+	// A lone Esc is taken as typed once no more bytes follow
+	tc.typeInput(t, "\x1b")
+	time.Sleep(2 * escTimeout)
+	tc.typeInput(t, "echo after-$((1+1))\r")
+	waitFor(t, "live output after Esc", func() bool {
+		return strings.Contains(tc.output.String(), "after-2")
+	})
+}
+
+func TestClientLiveEscapePassthrough(t *testing.T) {
+	s := startTestSession(t)
+	tc := startTestClientWith(t, s, ClientOptions{Term: "xterm"})
+
+	// Page Down, an F-key, a modified arrow and a mouse report meant for a
+	// program in the session all reach it unchanged
+	tc.typeInput(t, "stty -echo; read x; stty echo; printf '%s' \"$x\" | od -An -c\r")
+	time.Sleep(100 * time.Millisecond)
+	tc.typeInput(t, "\x1b[6~\x1b[15~\x1b[1;5C\x1b[<64;1;1M\r")
+	waitFor(t, "sequences echoed by od", func() bool {
+		out := strings.Join(strings.Fields(tc.output.String()), " ")
+		return strings.Contains(out, `033 [ 6 ~ 033 [ 1 5 ~ 033 [ 1 ; 5 C 033 [ < 6 4 ; 1 ; 1 M`)
+	})
+	if strings.Contains(tc.output.String(), "[line ") {
+		t.Error("live mode input entered history mode")
+	}
+}
+
+func TestClientPrefixAtEndOfRead(t *testing.T) {
+	s := startTestSession(t)
+
+	// The prefix ends one read and the next key, read on its own, is
+	// its command
+	tc := startTestClient(t, s)
+	tc.typeInput(t, "\x01")
+	tc.typeInput(t, "d")
+	tc.wait(t)
+	if !tc.Detached() {
+		t.Error("prefix then d in separate reads didn't detach")
+	}
+
+	// A paste following the prefix is sent whole, first character included
+	tc = startTestClient(t, s)
+	tc.typeInput(t, "\x01")
+	tc.typeInput(t, "echo pasted-$((6*7))\r")
+	waitFor(t, "pasted command output", func() bool {
+		return strings.Contains(tc.output.String(), "pasted-42")
+	})
+	tc.typeInput(t, "\x01d")
+	tc.wait(t)
+}
+
+func TestClientBracketedPaste(t *testing.T) {
+	s := startTestSession(t)
+	tc := startTestClient(t, s)
+	tc.typeInput(t, "stty -echo; read x; stty echo; printf '%s' \"$x\" | od -An -c\r")
+	time.Sleep(100 * time.Millisecond)
+
+	// A prefix and the detach key inside a paste reach the session
+	tc.typeInput(t, "\x01")
+	tc.typeInput(t, "\x1b[200~a\x01d\x1b[201~\r")
+	waitFor(t, "pasted bytes echoed by od", func() bool {
+		out := strings.Join(strings.Fields(tc.output.String()), " ")
+		return strings.Contains(out, `033 [ 2 0 0 ~ a 001 d 033 [ 2 0 1 ~`)
+	})
+	if tc.Detached() {
+		t.Fatal("paste detached the client")
+	}
+
+	// Key bindings work again after the paste
+	tc.typeInput(t, "\x01d")
+	tc.wait(t)
+	if !tc.Detached() {
+		t.Error("prefix after a paste didn't detach")
+	}
+}
+
+func TestClientBanner(t *testing.T) {
+	s := startTestSession(t)
+	const banner = "[attached to test]"
+	tc := startTestClientWith(t, s, ClientOptions{Banner: banner})
+	waitFor(t, "banner", func() bool {
+		return strings.Contains(tc.output.String(), banner)
+	})
+
+	// The first key clears it
+	tc.typeInput(t, "x")
+	waitFor(t, "banner erased", func() bool {
+		return strings.Contains(tc.output.String(), strings.Repeat(" ", len(banner))+"\x1b8")
+	})
+}
+
+// writeFakeSession adds an info file for a session that looks alive, for
+// tests of the session list.
+func writeFakeSession(t *testing.T, id string) {
+	t.Helper()
+	sock := filepath.Join(SocketDir(), id+".sock")
+	listenFake(t, sock)
+	data, _ := json.Marshal(SessionInfo{ID: id, Name: id, PID: os.Getpid(), Socket: sock})
+	if err := os.WriteFile(filepath.Join(SocketDir(), id+".json"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientPickerPages(t *testing.T) {
+	s := startTestSession(t)
+	for i := 0; i < 11; i++ {
+		writeFakeSession(t, fmt.Sprintf("zz-%02d", i))
+	}
+	tc := startTestClient(t, s)
+
+	// The picker opens on the page of the attached session, listed last
+	// as the newest
+	tc.typeInput(t, "\x01s")
+	waitFor(t, "second page", func() bool {
+		return strings.Contains(tc.output.String(), "Page 2/2")
+	})
+	tc.typeInput(t, "<")
+	waitFor(t, "first page", func() bool {
+		return strings.Contains(tc.output.String(), "Page 1/2")
+	})
+	tc.typeInput(t, ">")
+	waitFor(t, "second page again", func() bool {
+		return strings.Count(tc.output.String(), "Page 2/2") == 2
+	})
+
+	// The 11th session is the second on the second page
+	tc.typeInput(t, "2")
+	tc.wait(t)
+	if tc.SwitchTarget == nil || tc.SwitchTarget.ID != "zz-10" {
+		t.Errorf("SwitchTarget = %+v, want zz-10", tc.SwitchTarget)
+	}
+}
+
+func TestClientPickerCursor(t *testing.T) {
+	s := startTestSession(t)
+	writeFakeSession(t, "zz-00")
+	writeFakeSession(t, "zz-01")
+	tc := startTestClient(t, s)
+
+	sessions := ListSessions()
+	cur := -1
+	for i, info := range sessions {
+		if info.ID == tc.sessionID {
+			cur = i
+		}
+	}
+	if cur < 0 {
+		t.Fatal("attached session not listed")
+	}
+	// Move to a neighbour, down if there is one below
+	move, want := "j", cur+1
+	if want >= len(sessions) {
+		move, want = "\x1b[A", cur-1
+	}
+
+	tc.typeInput(t, "\x01s")
+	waitFor(t, "picker", func() bool {
+		return strings.Contains(tc.output.String(), "\x1b[7m* ")
+	})
+	tc.typeInput(t, move)
+	waitFor(t, "cursor moved", func() bool {
+		return strings.Count(tc.output.String(), "\x1b[7m") >= 2
+	})
+	tc.typeInput(t, "\r")
+	tc.wait(t)
+	if tc.SwitchTarget == nil || tc.SwitchTarget.ID != sessions[want].ID {
+		t.Errorf("SwitchTarget = %+v, want %s", tc.SwitchTarget, sessions[want].ID)
+	}
+}
+
+func TestClientPickerPreview(t *testing.T) {
+	s := startTestSession(t)
+	tc := startTestClient(t, s)
+
+	tc.typeInput(t, "echo preview-$((6*7))\r")
+	waitFor(t, "echo output", func() bool {
+		return strings.Contains(tc.output.String(), "preview-42")
+	})
+
+	// The picker starts on this session and shows its last lines
+	tc.typeInput(t, "\x01s")
+	waitFor(t, "preview", func() bool {
+		out := tc.output.String()
+		i := strings.LastIndex(out, "Switch session:")
+		return i >= 0 && strings.Contains(out[i:], "preview-42")
+	})
+	tc.typeInput(t, "q")
+
+	// The preview didn't take over the session
+	tc.typeInput(t, "echo still-$((2*3))\r")
+	waitFor(t, "still attached", func() bool {
+		return strings.Contains(tc.output.String(), "still-6")
+	})
+}
+
+func TestClientPickerDeleteCurrent(t *testing.T) {
+	s := startTestSession(t)
+	writeFakeSession(t, "zz-00")
+	tc := startTestClient(t, s)
+
+	// The picker starts on the attached session
+	tc.typeInput(t, "\x01s")
+	waitFor(t, "picker", func() bool {
+		return strings.Contains(tc.output.String(), "\x1b[7m* ")
+	})
+	tc.typeInput(t, "d")
+	tc.wait(t)
+	if tc.SwitchTarget == nil || tc.SwitchTarget.ID != "zz-00" {
+		t.Errorf("SwitchTarget = %+v, want zz-00", tc.SwitchTarget)
+	}
+	waitFor(t, "session killed", func() bool {
+		_, err := os.Stat(s.socketPath)
+		return os.IsNotExist(err)
+	})
+}
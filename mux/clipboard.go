@@ -0,0 +1,63 @@
+package mux
+
+import "bytes"
+
+// osc52Start begins an OSC 52 sequence, with which a program asks the
+// terminal to set the system clipboard. It ends with BEL or ST (ESC \).
+var osc52Start = []byte("\x1b]52;")
+
+// clipboardFilter removes OSC 52 sequences from PTY output. A sequence may
+// be split across reads, so the start of one at the end of a read is held
+// back until the next shows whether it is one. Only those few bytes are
+// held: the body of a sequence is dropped as it arrives, however long.
+type clipboardFilter struct {
+	matched int  // bytes of osc52Start at the end of the last write
+	inside  bool // in the body of a sequence
+	esc     bool // in the body, just after an ESC
+}
+
+// strip returns data without OSC 52 sequences. It returns data itself,
+// and false, if there was nothing to remove or hold back.
+func (f *clipboardFilter) strip(data []byte) ([]byte, bool) {
+	if f.matched == 0 && !f.inside && bytes.IndexByte(data, 0x1b) < 0 {
+		return data, false
+	}
+	out := make([]byte, 0, len(data)+f.matched)
+	for i := 0; i < len(data); i++ {
+		b := data[i]
+		if f.inside {
+			switch {
+			case f.esc:
+				f.inside, f.esc = false, false
+				if b != '\\' {
+					// An ESC starting another sequence cuts this one off
+					f.matched = 1
+					i--
+				}
+			case b == 0x07:
+				f.inside = false
+			case b == 0x1b:
+				f.esc = true
+			}
+			continue
+		}
+		if b == osc52Start[f.matched] {
+			f.matched++
+			if f.matched == len(osc52Start) {
+				f.inside, f.matched = true, 0
+			}
+			continue
+		}
+		if f.matched > 0 {
+			// Not OSC 52 after all
+			out = append(out, osc52Start[:f.matched]...)
+			f.matched = 0
+			if b == osc52Start[0] {
+				f.matched = 1
+				continue
+			}
+		}
+		out = append(out, b)
+	}
+	return out, true
+}
@@ -0,0 +1,37 @@
+package mux
+
+import "testing"
+
+func TestClipboardFilter(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		in   []string // successive writes
+		want string
+	}{
+		{"plain", []string{"hello\r\n"}, "hello\r\n"},
+		{"other escapes", []string{"\x1b[1mbold\x1b[0m \x1b]0;title\x07"}, "\x1b[1mbold\x1b[0m \x1b]0;title\x07"},
+		{"BEL", []string{"a\x1b]52;c;aGk=\x07b"}, "ab"},
+		{"ST", []string{"a\x1b]52;c;aGk=\x1b\\b"}, "ab"},
+		{"split start", []string{"a\x1b]5", "2;c;aGk=\x07b"}, "ab"},
+		{"split body", []string{"a\x1b]52;c;aG", "k=\x1b", "\\b"}, "ab"},
+		{"not OSC 52", []string{"a\x1b]5", "3;x\x07"}, "a\x1b]53;x\x07"},
+		{"cut off", []string{"\x1b]52;c;aGk=\x1b[31mred"}, "\x1b[31mred"},
+		{"ESC ESC", []string{"\x1b\x1b]52;c;x\x07!"}, "\x1b!"},
+	} {
+		var f clipboardFilter
+		got := ""
+		for _, w := range tt.in {
+			out, _ := f.strip([]byte(w))
+			got += string(out)
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	var f clipboardFilter
+	in := []byte("no escapes")
+	if out, changed := f.strip(in); changed || &out[0] != &in[0] {
+		t.Error("output without escapes was copied")
+	}
+}
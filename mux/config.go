@@ -0,0 +1,271 @@
+package mux
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the settings read from the user's config file. Zero values
+// mean the built-in default.
+type Config struct {
+	Keymap      Keymap
+	Scrollback  int           // scrollback lines kept per session
+	Shell       string        // shell for new sessions, instead of $SHELL
+	ScrollLines int           // lines moved per scroll step in history mode
+	SplitRows   int           // rows of live output under history when split
+	TabWidth    int           // columns between the terminal's tab stops
+	SocketDir   string        // directory for session sockets
+	KeepLogs    bool          // keep session logs after a clean exit
+	Banner      bool          // show the session's name and ID on attach
+	NoClipboard bool          // drop OSC 52 clipboard writes from sessions
+	Sanitize    bool          // strip risky sequences from replayed output
+	ReplayBuf   int           // bytes of output kept to redraw the screen on attach
+	Timeout     time.Duration // how long to wait on an unresponsive session
+}
+
+// DefaultConfig returns the settings used when there is no config file.
+func DefaultConfig() *Config {
+	return &Config{Keymap: DefaultKeymap()}
+}
+
+// ConfigPath returns the config file location: $MHIST_CONFIG if set, else
+// mhist/config under $XDG_CONFIG_HOME or ~/.config.
+func ConfigPath() string {
+	if p := os.Getenv("MHIST_CONFIG"); p != "" {
+		return p
+	}
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "mhist", "config")
+}
+
+// LoadConfig reads the config file at path. A missing file is not an
+// error; it gives the defaults.
+//
+// The file has one directive per line; blank lines and lines starting
+// with # are ignored:
+//
+//	bind <action> <key>    bind key to action, e.g. "bind detach x"
+//	set <option> <value>   set an option, e.g. "set prefix C-b"
+//
+// The first bind for an action replaces its default keys; further binds
+// add more keys. See ParseKey for key names. The options are:
+//
+//	prefix        the prefix key (default C-a)
+//	scrollback    scrollback lines kept per session (default 10000)
+//	shell         shell for new sessions (default $SHELL)
+//	scroll-lines  lines moved per scroll step (default 3)
+//	split-rows    rows of live output shown under history mode's split
+//	              view (default 5)
+//	tab-width     columns between the terminal's tab stops (default 8)
+//	socket-dir    directory for session sockets; $MHIST_SOCKET_DIR wins
+//	replay-buffer bytes of output kept to redraw the screen on attach,
+//	              e.g. 256k (default 64k, grown to fit the terminal)
+//	keep-logs     on to keep a session's log after it exits cleanly
+//	              (default off; logs of sessions that crash are kept)
+//	clipboard     off to stop programs in new sessions from setting the
+//	              clipboard with OSC 52 (default on)
+//	sanitize      on to strip escape sequences that could query or
+//	              retitle the terminal from redraws and history (default off)
+//	banner        on to show the session's name, ID and start time for a
+//	              moment after attaching (default off)
+//	timeout       how long commands wait on a session that doesn't
+//	              respond, e.g. 2s (default 5s); $MHIST_TIMEOUT wins
+func LoadConfig(path string) (*Config, error) {
+	cfg := DefaultConfig()
+	if path == "" {
+		return cfg, nil
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rebound := map[Action]bool{}
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if err := cfg.apply(fields, rebound); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// apply applies one directive.
+func (cfg *Config) apply(fields []string, rebound map[Action]bool) error {
+	switch fields[0] {
+	case "bind":
+		if len(fields) != 3 {
+			return fmt.Errorf("usage: bind <action> <key>")
+		}
+		action := Action(fields[1])
+		table := cfg.Keymap.table(action)
+		if table == nil {
+			return fmt.Errorf("unknown action %q", fields[1])
+		}
+		key, err := ParseKey(fields[2])
+		if err != nil {
+			return err
+		}
+		if !rebound[action] {
+			cfg.Keymap.unbindAction(action)
+			rebound[action] = true
+		}
+		table[key] = action
+	case "set":
+		if len(fields) != 3 {
+			return fmt.Errorf("usage: set <option> <value>")
+		}
+		return cfg.set(fields[1], fields[2])
+	default:
+		return fmt.Errorf("unknown directive %q", fields[0])
+	}
+	return nil
+}
+
+// set sets one option.
+func (cfg *Config) set(name, value string) error {
+	switch name {
+	case "prefix":
+		key, err := ParseKey(value)
+		if err != nil {
+			return err
+		}
+		cfg.Keymap.PrefixKey = key
+	case "scrollback":
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("scrollback: want a positive number of lines, got %q", value)
+		}
+		cfg.Scrollback = n
+	case "scroll-lines":
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("scroll-lines: want a positive number, got %q", value)
+		}
+		cfg.ScrollLines = n
+	case "split-rows":
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("split-rows: want a positive number, got %q", value)
+		}
+		cfg.SplitRows = n
+	case "tab-width":
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("tab-width: want a positive number of columns, got %q", value)
+		}
+		cfg.TabWidth = n
+	case "shell":
+		cfg.Shell = value
+	case "socket-dir":
+		cfg.SocketDir = expandHome(value)
+	case "replay-buffer":
+		n, err := ParseSize(value)
+		if err != nil {
+			return fmt.Errorf("replay-buffer: %w", err)
+		}
+		cfg.ReplayBuf = n
+	case "timeout":
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("timeout: want a duration like 5s, got %q", value)
+		}
+		cfg.Timeout = d
+	case "keep-logs":
+		on, err := parseOnOff(value)
+		if err != nil {
+			return fmt.Errorf("keep-logs: %w", err)
+		}
+		cfg.KeepLogs = on
+	case "clipboard":
+		on, err := parseOnOff(value)
+		if err != nil {
+			return fmt.Errorf("clipboard: %w", err)
+		}
+		cfg.NoClipboard = !on
+	case "sanitize":
+		on, err := parseOnOff(value)
+		if err != nil {
+			return fmt.Errorf("sanitize: %w", err)
+		}
+		cfg.Sanitize = on
+	case "banner":
+		on, err := parseOnOff(value)
+		if err != nil {
+			return fmt.Errorf("banner: %w", err)
+		}
+		cfg.Banner = on
+	default:
+		return fmt.Errorf("unknown option %q", name)
+	}
+	return nil
+}
+
+// parseOnOff parses the value of an on/off setting.
+func parseOnOff(value string) (bool, error) {
+	switch value {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("want on or off, got %q", value)
+}
+
+// ParseSize parses a positive size in bytes, optionally with a k or m
+// suffix for KiB or MiB, e.g. "65536", "256k" or "1M".
+func ParseSize(s string) (int, error) {
+	mult := 1
+	switch {
+	case strings.HasSuffix(s, "k"), strings.HasSuffix(s, "K"):
+		mult, s = 1<<10, s[:len(s)-1]
+	case strings.HasSuffix(s, "m"), strings.HasSuffix(s, "M"):
+		mult, s = 1<<20, s[:len(s)-1]
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("want a positive size like 65536 or 256k, got %q", s)
+	}
+	if n > math.MaxInt/mult {
+		return 0, fmt.Errorf("size %q is too large", s)
+	}
+	return n * mult, nil
+}
+
+// expandHome replaces a leading ~/ with the user's home directory.
+func expandHome(path string) string {
+	if !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[2:])
+}
@@ -0,0 +1,156 @@
+package mux
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigMissingFile(t *testing.T) {
+	cfg, err := LoadConfig(filepath.Join(t.TempDir(), "nope"))
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if cfg.Keymap.Prefix['d'] != ActionDetach || cfg.Keymap.History['k'] != ActionScrollUp {
+		t.Error("expected default bindings")
+	}
+}
+
+func TestLoadConfigBind(t *testing.T) {
+	cfg, err := LoadConfig(writeConfig(t, `
+# detach with x instead of d
+bind detach x
+
+bind scroll-up C-p
+bind scroll-up K
+`))
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	km := cfg.Keymap
+	if km.Prefix['x'] != ActionDetach {
+		t.Error("x not bound to detach")
+	}
+	if _, ok := km.Prefix['d']; ok {
+		t.Error("d still bound after rebinding detach")
+	}
+	if km.History[0x10] != ActionScrollUp || km.History['K'] != ActionScrollUp {
+		t.Error("scroll-up keys not bound")
+	}
+	if _, ok := km.History['k']; ok {
+		t.Error("k still bound after rebinding scroll-up")
+	}
+	if km.History['j'] != ActionScrollDown {
+		t.Error("unrelated binding changed")
+	}
+}
+
+func TestLoadConfigSet(t *testing.T) {
+	home, _ := os.UserHomeDir()
+	cfg, err := LoadConfig(writeConfig(t, `
+set prefix C-b
+set scrollback 50000
+set shell /bin/zsh
+set scroll-lines 5
+set split-rows 8
+set tab-width 4
+set socket-dir ~/mhist-sockets
+set keep-logs on
+set banner on
+set clipboard off
+set sanitize on
+set replay-buffer 256k
+set timeout 2s
+`))
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if cfg.Keymap.PrefixKey != 0x02 {
+		t.Errorf("PrefixKey = %#x, want 0x02", cfg.Keymap.PrefixKey)
+	}
+	if cfg.Scrollback != 50000 || cfg.Shell != "/bin/zsh" || cfg.ScrollLines != 5 {
+		t.Errorf("got scrollback %d, shell %q, scroll-lines %d", cfg.Scrollback, cfg.Shell, cfg.ScrollLines)
+	}
+	if cfg.SplitRows != 8 || cfg.TabWidth != 4 {
+		t.Errorf("SplitRows = %d, TabWidth = %d; want 8 and 4", cfg.SplitRows, cfg.TabWidth)
+	}
+	if want := filepath.Join(home, "mhist-sockets"); cfg.SocketDir != want {
+		t.Errorf("SocketDir = %q, want %q", cfg.SocketDir, want)
+	}
+	if !cfg.KeepLogs || !cfg.Banner || !cfg.NoClipboard || !cfg.Sanitize {
+		t.Errorf("KeepLogs %v, Banner %v, NoClipboard %v, Sanitize %v; want all on", cfg.KeepLogs, cfg.Banner, cfg.NoClipboard, cfg.Sanitize)
+	}
+	if cfg.Timeout != 2*time.Second {
+		t.Errorf("Timeout = %v, want 2s", cfg.Timeout)
+	}
+	if cfg.ReplayBuf != 256<<10 {
+		t.Errorf("ReplayBuf = %d, want %d", cfg.ReplayBuf, 256<<10)
+	}
+}
+
+func TestSocketDirEnv(t *testing.T) {
+	t.Setenv("MHIST_SOCKET_DIR", "/srv/mhist")
+	if got := SocketDir(); got != "/srv/mhist" {
+		t.Errorf("SocketDir() = %q, want /srv/mhist", got)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	for _, content := range []string{
+		"bind detach\n",
+		"bind fly x\n",
+		"bind detach C-!\n",
+		"frobnicate\n",
+		"set scrollback lots\n",
+		"set scroll-lines 0\n",
+		"set split-rows none\n",
+		"set tab-width 0\n",
+		"set colour red\n",
+		"set shell\n",
+		"set keep-logs maybe\n",
+		"set banner yes\n",
+		"set clipboard deny\n",
+		"set sanitize 1\n",
+		"set replay-buffer 0\n",
+		"set replay-buffer 2G\n",
+		"set replay-buffer 99999999999999M\n",
+		"set timeout 5\n",
+		"set timeout -1s\n",
+	} {
+		_, err := LoadConfig(writeConfig(t, content))
+		if err == nil || !strings.Contains(err.Error(), ":1:") {
+			t.Errorf("config %q: got %v, want an error naming line 1", content, err)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		want int
+	}{
+		{"65536", 65536},
+		{"256k", 256 << 10},
+		{"1M", 1 << 20},
+	} {
+		if got, err := ParseSize(tt.s); err != nil || got != tt.want {
+			t.Errorf("ParseSize(%q) = %d, %v; want %d", tt.s, got, err, tt.want)
+		}
+	}
+	for _, s := range []string{"", "0", "-1k", "lots", "99999999999999M", "9223372036854775807k"} {
+		if got, err := ParseSize(s); err == nil {
+			t.Errorf("ParseSize(%q) = %d, want an error", s, got)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package mux
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Conn is a programmatic connection to a session, for building frontends
+// other than the terminal client (a web socket bridge, a GUI, a test).
+// It does no terminal handling: session output arrives on a channel and
+// input is sent with Write.
+type Conn struct {
+	conn    net.Conn
+	output  chan []byte
+	done    chan struct{} // closed by Close, so readLoop stops waiting on output
+	once    sync.Once
+	writeMu sync.Mutex
+	wbuf    []byte // encode buffer, guarded by writeMu
+	err     error  // why output was closed; valid after Output is drained
+}
+
+// Errors reported by Conn.Err when the session dropped the connection,
+// one for each DetachReason it gives.
+var (
+	ErrTakenOver        = errors.New("another client attached to the session")
+	ErrDetachedRemotely = errors.New("detached by mhist detach")
+	ErrDetached         = errors.New("detached from the session")
+)
+
+// detachError returns the error for a MsgDetach with the given payload.
+// Sessions from before DetachReason send none, and only on a takeover.
+func detachError(payload []byte) error {
+	if len(payload) == 0 {
+		return ErrTakenOver
+	}
+	switch DetachReason(payload[0]) {
+	case DetachTakeover:
+		return ErrTakenOver
+	case DetachRemote:
+		return ErrDetachedRemotely
+	}
+	return ErrDetached
+}
+
+// Attach connects to the session at addr over the given transport and
+// starts delivering its output. The session replays its current screen as
+// the first output.
+func Attach(t Transport, addr string) (*Conn, error) {
+	conn, err := Dial(t, addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{
+		conn:   conn,
+		output: make(chan []byte, 16),
+		done:   make(chan struct{}),
+	}
+	if err := c.send(Hello{Version: ProtocolVersion}.message()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+// readLoop decodes messages from the session and forwards output data.
+func (c *Conn) readLoop() {
+	defer close(c.output)
+	r := bufio.NewReader(c.conn)
+	for {
+		msg, err := Decode(r)
+		if err != nil {
+			c.err = err
+			return
+		}
+		switch msg.Type {
+		case MsgData:
+			select {
+			case c.output <- msg.Payload:
+			case <-c.done:
+				c.err = net.ErrClosed
+				return
+			}
+		case MsgDetach:
+			c.err = detachError(msg.Payload)
+			return
+		case MsgError:
+			c.err = parseSessionError(msg.Payload)
+			return
+		}
+	}
+}
+
+// Output returns the channel of session output. It is closed when the
+// connection ends; Err then reports why.
+func (c *Conn) Output() <-chan []byte {
+	return c.output
+}
+
+// Err returns the error that ended the connection. Only valid after the
+// Output channel has been closed.
+func (c *Conn) Err() error {
+	return c.err
+}
+
+// Write sends input to the session as if typed on its terminal.
+func (c *Conn) Write(p []byte) (int, error) {
+	if err := c.send(Message{Type: MsgData, Payload: p}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Resize sets the session's terminal size. Both dimensions must be
+// between 1 and 1000.
+func (c *Conn) Resize(rows, cols int) error {
+	if !validSize(rows, cols) {
+		return fmt.Errorf("invalid terminal size %dx%d", rows, cols)
+	}
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint16(payload[0:2], uint16(rows))
+	binary.BigEndian.PutUint16(payload[2:4], uint16(cols))
+	return c.send(Message{Type: MsgResize, Payload: payload})
+}
+
+// Detach tells the session this client is leaving and closes the
+// connection. The session keeps running.
+func (c *Conn) Detach() error {
+	err := c.send(Message{Type: MsgDetach})
+	c.Close()
+	return err
+}
+
+// Close closes the connection without detaching first. Output is closed
+// soon after, whether or not anything is still reading it.
+func (c *Conn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.conn.Close()
+}
+
+// send writes a framed message, serializing concurrent callers.
+func (c *Conn) send(msg Message) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.wbuf = EncodeTo(c.wbuf[:0], msg)
+	_, err := c.conn.Write(c.wbuf)
+	if cap(c.wbuf) > maxScratch {
+		c.wbuf = nil
+	}
+	return err
+}
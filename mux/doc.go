@@ -0,0 +1,9 @@
+// Package mux implements the reusable core of mhist: the scrollback
+// buffer, the framed wire protocol, the session process that owns a PTY,
+// and discovery of running sessions.
+//
+// The mhist command is a thin CLI on top of this package. Other programs
+// can use it to start sessions or talk to existing ones, for example to
+// build a dashboard. The wire protocol is the same one the mhist client
+// speaks, so sessions are interchangeable between the two.
+package mux
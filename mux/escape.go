@@ -0,0 +1,103 @@
+package mux
+
+import "time"
+
+// escTimeout is how long an escape sequence cut off at the end of the
+// input waits for the rest before it is taken as typed, e.g. a lone Esc.
+const escTimeout = 50 * time.Millisecond
+
+// maxEscLen bounds how long a CSI sequence can get before the splitter
+// stops waiting for its final byte.
+const maxEscLen = 64
+
+// keySplitter splits terminal input into keys: single bytes, or whole
+// escape sequences (CSI, SS3 and Alt+key). A sequence cut off at the end
+// of one read is held until the rest arrives, so a slow link or a paste
+// that splits "ESC [ 5 ~" can't make its bytes be read as separate keys.
+type keySplitter struct {
+	held []byte // incomplete sequence from the previous read
+
+	// x10 makes "ESC [ M" take three more bytes, as a legacy mouse report
+	x10 bool
+}
+
+// split returns the keys in data, after any held bytes. An incomplete
+// sequence at the end is held for the next call.
+func (k *keySplitter) split(data []byte) [][]byte {
+	if len(k.held) > 0 {
+		data = append(k.held, data...)
+		k.held = nil
+	}
+	var keys [][]byte
+	for len(data) > 0 {
+		n := k.keyLen(data)
+		if n == 0 {
+			k.held = append([]byte(nil), data...)
+			break
+		}
+		keys = append(keys, data[:n])
+		data = data[n:]
+	}
+	return keys
+}
+
+// holding reports whether an incomplete sequence is waiting for more input.
+func (k *keySplitter) holding() bool {
+	return len(k.held) > 0
+}
+
+// flush returns the held bytes as one key, once escTimeout has passed
+// without the rest of the sequence arriving.
+func (k *keySplitter) flush() [][]byte {
+	if len(k.held) == 0 {
+		return nil
+	}
+	key := k.held
+	k.held = nil
+	return [][]byte{key}
+}
+
+// keyLen returns the length of the key at the start of b, or 0 if b is an
+// escape sequence that hasn't finished yet.
+func (k *keySplitter) keyLen(b []byte) int {
+	if b[0] != '\x1b' {
+		return 1
+	}
+	if len(b) < 2 {
+		return 0
+	}
+	switch b[1] {
+	case '[':
+		if k.x10 && len(b) >= 3 && b[2] == 'M' {
+			if len(b) < 6 {
+				return 0
+			}
+			return 6
+		}
+		// CSI: parameter and intermediate bytes, then a final byte
+		for i := 2; i < len(b); i++ {
+			switch c := b[i]; {
+			case c >= 0x40 && c <= 0x7e:
+				return i + 1
+			case c < 0x20 || c > 0x7e:
+				// Not part of a sequence; it ends before this byte
+				return i
+			case i+1 >= maxEscLen:
+				return i + 1
+			}
+		}
+		return 0
+	case 'O':
+		// SS3, e.g. F1-F4 or arrows in application mode
+		if len(b) < 3 {
+			return 0
+		}
+		return 3
+	case '\x1b':
+		// Esc pressed twice; the first stands alone
+		return 1
+	default:
+		// Alt+key
+		return 2
+	}
+}
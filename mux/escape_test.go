@@ -0,0 +1,59 @@
+package mux
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestKeySplitter(t *testing.T) {
+	tests := []struct {
+		name  string
+		reads []string
+		x10   bool
+		want  []string
+		held  bool
+	}{
+		{"plain", []string{"ab"}, false, []string{"a", "b"}, false},
+		{"csi", []string{"x\x1b[5~y"}, false, []string{"x", "\x1b[5~", "y"}, false},
+		{"split csi", []string{"\x1b[", "5", "~"}, false, []string{"\x1b[5~"}, false},
+		{"split after esc", []string{"a\x1b", "[A"}, false, []string{"a", "\x1b[A"}, false},
+		{"sgr mouse", []string{"\x1b[<64;10", ";5M"}, false, []string{"\x1b[<64;10;5M"}, false},
+		{"modified arrow", []string{"\x1b[1;5C"}, false, []string{"\x1b[1;5C"}, false},
+		{"ss3", []string{"\x1bO", "P"}, false, []string{"\x1bOP"}, false},
+		{"alt key", []string{"\x1bx"}, false, []string{"\x1bx"}, false},
+		{"double esc", []string{"\x1b\x1b[B"}, false, []string{"\x1b", "\x1b[B"}, false},
+		{"lone esc held", []string{"q\x1b"}, false, []string{"q"}, true},
+		{"csi cut by control", []string{"\x1b[1\r"}, false, []string{"\x1b[1", "\r"}, false},
+		{"x10 mouse", []string{"\x1b[M", "`!!"}, true, []string{"\x1b[M`!!"}, false},
+		{"csi M without mouse", []string{"\x1b[M`"}, false, []string{"\x1b[M", "`"}, false},
+	}
+	for _, tt := range tests {
+		k := keySplitter{x10: tt.x10}
+		var got []string
+		for _, r := range tt.reads {
+			for _, key := range k.split([]byte(r)) {
+				got = append(got, string(key))
+			}
+		}
+		if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", tt.want) {
+			t.Errorf("%s: keys = %q, want %q", tt.name, got, tt.want)
+		}
+		if k.holding() != tt.held {
+			t.Errorf("%s: holding = %v, want %v", tt.name, k.holding(), tt.held)
+		}
+	}
+}
+
+func TestKeySplitterFlush(t *testing.T) {
+	var k keySplitter
+	if keys := k.split([]byte("\x1b[")); len(keys) != 0 {
+		t.Fatalf("incomplete sequence returned keys %q", keys)
+	}
+	keys := k.flush()
+	if len(keys) != 1 || string(keys[0]) != "\x1b[" {
+		t.Errorf("flush = %q, want the held bytes", keys)
+	}
+	if k.holding() {
+		t.Error("still holding after flush")
+	}
+}
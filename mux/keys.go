@@ -0,0 +1,140 @@
+package mux
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Action is a client command that can be bound to a key.
+type Action string
+
+// Actions run by a key pressed after the prefix key.
+const (
+	ActionDetach       Action = "detach"
+	ActionSessions     Action = "choose-session"
+	ActionHistory      Action = "history"
+	ActionSendPrefix   Action = "send-prefix"
+	ActionSuspend      Action = "suspend"
+	ActionPause        Action = "pause"
+	ActionClearHistory Action = "clear-history"
+	ActionQuote        Action = "quote"
+	ActionPasteBuffer  Action = "paste-buffer"
+)
+
+// Actions run by a key pressed in history mode.
+const (
+	ActionScrollUp     Action = "scroll-up"
+	ActionScrollDown   Action = "scroll-down"
+	ActionHalfPageUp   Action = "half-page-up"
+	ActionHalfPageDown Action = "half-page-down"
+	ActionPrevPrompt   Action = "previous-prompt"
+	ActionNextPrompt   Action = "next-prompt"
+	ActionExitHistory  Action = "exit-history"
+	ActionToggleSplit  Action = "toggle-split"
+	ActionCopyHistory  Action = "copy-history"
+	ActionRegister     Action = "select-register"
+	ActionPaste        Action = "paste"
+)
+
+// Keymap maps keys to actions. Prefix holds the keys that follow the
+// prefix key; History holds the keys used in history mode, where any
+// unbound key leaves history mode.
+type Keymap struct {
+	PrefixKey byte
+	Prefix    map[byte]Action
+	History   map[byte]Action
+}
+
+// DefaultKeymap returns the built-in bindings.
+func DefaultKeymap() Keymap {
+	return Keymap{
+		PrefixKey: 0x01, // Ctrl+a
+		Prefix: map[byte]Action{
+			'd':  ActionDetach,
+			's':  ActionSessions,
+			'[':  ActionHistory,
+			0x01: ActionSendPrefix,
+			0x1a: ActionSuspend,
+			' ':  ActionPause,
+			'K':  ActionClearHistory,
+			'q':  ActionQuote,
+			']':  ActionPasteBuffer,
+		},
+		History: map[byte]Action{
+			'k':  ActionScrollUp,
+			'j':  ActionScrollDown,
+			'u':  ActionHalfPageUp,
+			'd':  ActionHalfPageDown,
+			'p':  ActionPrevPrompt,
+			'n':  ActionNextPrompt,
+			't':  ActionToggleSplit,
+			'Y':  ActionCopyHistory,
+			'"':  ActionRegister,
+			'P':  ActionPaste,
+			'q':  ActionExitHistory,
+			0x1b: ActionExitHistory,
+		},
+	}
+}
+
+// table returns the key table an action belongs in, or nil if the action
+// is unknown.
+func (km Keymap) table(a Action) map[byte]Action {
+	switch a {
+	case ActionDetach, ActionSessions, ActionHistory, ActionSendPrefix,
+		ActionSuspend, ActionPause, ActionClearHistory, ActionQuote, ActionPasteBuffer:
+		return km.Prefix
+	case ActionScrollUp, ActionScrollDown, ActionHalfPageUp, ActionHalfPageDown,
+		ActionPrevPrompt, ActionNextPrompt, ActionExitHistory, ActionToggleSplit,
+		ActionCopyHistory, ActionRegister, ActionPaste:
+		return km.History
+	}
+	return nil
+}
+
+// unbindAction removes every key bound to a.
+func (km Keymap) unbindAction(a Action) {
+	t := km.table(a)
+	for k, v := range t {
+		if v == a {
+			delete(t, k)
+		}
+	}
+}
+
+// ParseKey parses a key name: a single character ("x"), a control key in
+// caret or Emacs notation ("^A", "C-a"), or one of "Space", "Tab",
+// "Enter" and "Esc".
+func ParseKey(s string) (byte, error) {
+	switch strings.ToLower(s) {
+	case "space":
+		return ' ', nil
+	case "tab":
+		return '\t', nil
+	case "enter":
+		return '\r', nil
+	case "esc", "escape":
+		return 0x1b, nil
+	}
+
+	var ctrl string
+	switch {
+	case len(s) == 2 && s[0] == '^':
+		ctrl = s[1:]
+	case len(s) == 3 && (strings.HasPrefix(s, "C-") || strings.HasPrefix(s, "c-")):
+		ctrl = s[2:]
+	case len(s) == 1 && s[0] >= 0x20 && s[0] < 0x7f:
+		return s[0], nil
+	default:
+		return 0, fmt.Errorf("invalid key %q", s)
+	}
+
+	c := ctrl[0]
+	if c >= 'a' && c <= 'z' {
+		c -= 'a' - 'A'
+	}
+	if c < '@' || c > '_' {
+		return 0, fmt.Errorf("invalid control key %q", s)
+	}
+	return c - '@', nil
+}
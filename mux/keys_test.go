@@ -0,0 +1,35 @@
+package mux
+
+import "testing"
+
+func TestParseKey(t *testing.T) {
+	tests := []struct {
+		in   string
+		want byte
+	}{
+		{"x", 'x'},
+		{"K", 'K'},
+		{"[", '['},
+		{"^A", 0x01},
+		{"^a", 0x01},
+		{"C-b", 0x02},
+		{"C-z", 0x1a},
+		{"^[", 0x1b},
+		{"C-\\", 0x1c},
+		{"Space", ' '},
+		{"esc", 0x1b},
+		{"Enter", '\r'},
+	}
+	for _, tt := range tests {
+		got, err := ParseKey(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseKey(%q) = %#x, %v; want %#x", tt.in, got, err, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"", "xy", "C-", "^1", "C-ab", "F1", "\x01"} {
+		if _, err := ParseKey(bad); err == nil {
+			t.Errorf("ParseKey(%q): expected error", bad)
+		}
+	}
+}
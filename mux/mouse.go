@@ -1,4 +1,4 @@
-package main
+package mux
 
 import "strconv"
 
@@ -62,6 +62,24 @@ func ParseSGRMouse(data []byte) (MouseEvent, int, bool) {
 	return MouseEvent{Button: button, Col: col, Row: row, Press: press}, termIdx + 1, true
 }
 
+// ParseX10Mouse parses a legacy mouse sequence, sent by terminals that
+// report the mouse but ignore the request for SGR encoding.
+// Format: ESC [ M button col row, each byte offset by 32.
+// Returns the event, bytes consumed, and whether parsing succeeded.
+func ParseX10Mouse(data []byte) (MouseEvent, int, bool) {
+	if len(data) < 6 || data[0] != '\x1b' || data[1] != '[' || data[2] != 'M' {
+		return MouseEvent{}, 0, false
+	}
+	if data[3] < 32 || data[4] < 33 || data[5] < 33 {
+		return MouseEvent{}, 0, false
+	}
+	button := int(data[3]) - 32
+	// Button bits 3 mean "released"; wheel events (64 and up) have no
+	// release
+	press := button&3 != 3 || button >= 64
+	return MouseEvent{Button: button, Col: int(data[4]) - 32, Row: int(data[5]) - 32, Press: press}, 6, true
+}
+
 // splitSemicolon splits a string on semicolons.
 func splitSemicolon(s string) []string {
 	var parts []string
@@ -1,4 +1,4 @@
-package main
+package mux
 
 import "testing"
 
@@ -135,3 +135,38 @@ func TestMouseBadParams(t *testing.T) {
 		t.Error("expected failure for bad params")
 	}
 }
+
+func BenchmarkParseSGRMouse(b *testing.B) {
+	data := []byte("\x1b[<64;120;45M")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, _, ok := ParseSGRMouse(data); !ok {
+			b.Fatal("parse failed")
+		}
+	}
+}
+
+func TestMouseX10(t *testing.T) {
+	tests := []struct {
+		data  string
+		want  MouseEvent
+		valid bool
+	}{
+		{"\x1b[M`!!", MouseEvent{Button: 64, Col: 1, Row: 1, Press: true}, true},
+		{"\x1b[Ma+*", MouseEvent{Button: 65, Col: 11, Row: 10, Press: true}, true},
+		{"\x1b[M #$", MouseEvent{Button: 0, Col: 3, Row: 4, Press: true}, true},
+		{"\x1b[M#!!", MouseEvent{Button: 3, Col: 1, Row: 1, Press: false}, true},
+		{"\x1b[M`!", MouseEvent{}, false},
+		{"\x1b[<64;1;1M", MouseEvent{}, false},
+	}
+	for _, tt := range tests {
+		ev, n, ok := ParseX10Mouse([]byte(tt.data))
+		if ok != tt.valid {
+			t.Errorf("ParseX10Mouse(%q) ok = %v", tt.data, ok)
+			continue
+		}
+		if ok && (ev != tt.want || n != 6) {
+			t.Errorf("ParseX10Mouse(%q) = %+v, %d; want %+v, 6", tt.data, ev, n, tt.want)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+//go:build !unix
+
+package mux
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Stand-ins for platform_unix.go. They keep the package building on
+// systems without Unix signals and job control; mhist itself doesn't run
+// there yet.
+
+// signalNames are the signals that can be sent to a session's shell.
+var signalNames = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"KILL": syscall.SIGKILL,
+	"ALRM": syscall.SIGALRM,
+	"TERM": syscall.SIGTERM,
+}
+
+// resizeSignal is nil: there is no signal for a terminal resize.
+var resizeSignal os.Signal
+
+// tmpSocketDir is the socket directory used when there is no runtime
+// directory.
+func tmpSocketDir() string {
+	return filepath.Join(os.TempDir(), "mhist")
+}
+
+// fallbackSocketDirs are the other places a session may have put its
+// socket; there is only the one.
+func fallbackSocketDirs() []string {
+	return []string{tmpSocketDir()}
+}
+
+// checkPrivateDir only checks that dir is a directory; access to it is
+// left to the system's defaults.
+func checkPrivateDir(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	return nil
+}
+
+// processAlive reports whether a process with the given PID exists.
+func processAlive(pid int) bool {
+	_, err := os.FindProcess(pid)
+	return err == nil
+}
+
+// stopProcessGroup fails: there is no job control to suspend to.
+func stopProcessGroup() error {
+	return errors.ErrUnsupported
+}
+
+// signalForeground does nothing: there are no process groups to signal.
+func signalForeground(f *os.File) {}
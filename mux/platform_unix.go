@@ -0,0 +1,111 @@
+//go:build unix
+
+package mux
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// The Unix side of the few things that differ between platforms. Each has
+// a stand-in in platform_other.go so the package builds everywhere.
+
+// signalNames are the signals that can be sent to a session's shell.
+var signalNames = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"KILL":  syscall.SIGKILL,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"ALRM":  syscall.SIGALRM,
+	"TERM":  syscall.SIGTERM,
+	"CONT":  syscall.SIGCONT,
+	"STOP":  syscall.SIGSTOP,
+	"TSTP":  syscall.SIGTSTP,
+	"WINCH": syscall.SIGWINCH,
+}
+
+// resizeSignal is delivered when the client's terminal changes size.
+var resizeSignal os.Signal = syscall.SIGWINCH
+
+// tmpSocketDir is the per-user socket directory used when there is no
+// runtime directory. It is under $TMPDIR if set, which macOS points at a
+// directory private to the user, else in /tmp.
+func tmpSocketDir() string {
+	name := fmt.Sprintf("mhist-%d", os.Getuid())
+	if dir := os.Getenv("TMPDIR"); dir != "" {
+		return filepath.Join(dir, name)
+	}
+	return filepath.Join("/tmp", name)
+}
+
+// fallbackSocketDirs are the other places a session may have put its
+// socket when started with a different environment: the usual per-user
+// runtime directory, for a session started while $XDG_RUNTIME_DIR was
+// set, and the temporary directories with and without $TMPDIR.
+func fallbackSocketDirs() []string {
+	return []string{
+		fmt.Sprintf("/run/user/%d/mhist", os.Getuid()),
+		tmpSocketDir(),
+		fmt.Sprintf("/tmp/mhist-%d", os.Getuid()),
+	}
+}
+
+// checkPrivateDir makes sure the socket directory dir is owned by this
+// user and closed to everyone else. One left in a shared /tmp by another
+// user could otherwise be used to watch or hijack sessions.
+func checkPrivateDir(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Getuid() {
+		return fmt.Errorf("%s belongs to another user (uid %d)", dir, st.Uid)
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		// Ours, just too open
+		return os.Chmod(dir, 0700)
+	}
+	return nil
+}
+
+// processAlive reports whether a process with the given PID exists.
+func processAlive(pid int) bool {
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	return proc.Signal(syscall.Signal(0)) == nil
+}
+
+// stopProcessGroup stops the calling process's group, as the terminal
+// would for Ctrl+Z, and returns once it is continued.
+func stopProcessGroup() error {
+	contCh := make(chan os.Signal, 1)
+	signal.Notify(contCh, syscall.SIGCONT)
+	defer signal.Stop(contCh)
+	if err := syscall.Kill(0, syscall.SIGTSTP); err != nil {
+		return err
+	}
+	<-contCh
+	return nil
+}
+
+// signalForeground sends SIGWINCH to the foreground process group of the
+// pty f. It does nothing if f isn't a pty, e.g. in a playback session.
+func signalForeground(f *os.File) {
+	pgrp, err := unix.IoctlGetInt(int(f.Fd()), unix.TIOCGPGRP)
+	if err != nil || pgrp <= 0 {
+		return
+	}
+	unix.Kill(-pgrp, unix.SIGWINCH)
+}
@@ -0,0 +1,84 @@
+//go:build unix
+
+package mux
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestTmpSocketDir(t *testing.T) {
+	t.Setenv("MHIST_SOCKET_DIR", "")
+	t.Setenv("XDG_RUNTIME_DIR", "")
+	name := fmt.Sprintf("mhist-%d", os.Getuid())
+
+	// macOS sets $TMPDIR to a directory of the user's own
+	t.Setenv("TMPDIR", "/var/folders/xy/T")
+	if got := SocketDir(); got != "/var/folders/xy/T/"+name {
+		t.Errorf("with TMPDIR, SocketDir() = %q", got)
+	}
+	// Sessions started without it are still found
+	if dirs := socketDirs(); !slices.Contains(dirs, "/tmp/"+name) {
+		t.Errorf("socketDirs() = %q, want /tmp/%s among them", dirs, name)
+	}
+
+	t.Setenv("TMPDIR", "")
+	if got := SocketDir(); got != "/tmp/"+name {
+		t.Errorf("without TMPDIR, SocketDir() = %q", got)
+	}
+}
+
+func TestEnsureSocketDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "sockets")
+	t.Setenv("MHIST_SOCKET_DIR", dir)
+	if got, err := EnsureSocketDir(); err != nil || got != dir {
+		t.Fatalf("EnsureSocketDir() = %q, %v", got, err)
+	}
+
+	// Too open is fixed; another user's, or not a directory, is refused
+	os.Chmod(dir, 0755)
+	if _, err := EnsureSocketDir(); err != nil {
+		t.Fatalf("EnsureSocketDir on a 0755 dir: %v", err)
+	}
+	if fi, _ := os.Stat(dir); fi.Mode().Perm() != 0700 {
+		t.Errorf("mode = %v, want 0700", fi.Mode().Perm())
+	}
+	if os.Getuid() == 0 {
+		os.Chown(dir, 12345, 12345)
+		if _, err := EnsureSocketDir(); err == nil {
+			t.Error("EnsureSocketDir accepted another user's dir")
+		}
+	}
+	file := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(file, nil, 0600)
+	t.Setenv("MHIST_SOCKET_DIR", file)
+	if _, err := EnsureSocketDir(); err == nil {
+		t.Error("EnsureSocketDir accepted a file")
+	}
+}
+
+func TestListSkipsForeignDir(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("needs root to give the directory away")
+	}
+	dir := t.TempDir()
+	t.Setenv("MHIST_SOCKET_DIR", dir)
+	sock := filepath.Join(dir, "fake.sock")
+	listenFake(t, sock)
+	info := SessionInfo{ID: "planted", PID: os.Getpid(), Socket: sock}
+	if err := (FileStore{}).Put(info); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if got := (FileStore{}).List(); len(got) != 1 {
+		t.Fatalf("List() in our own dir = %v, want the session", got)
+	}
+
+	// The same session in a directory another user made isn't trusted
+	os.Chown(dir, 12345, 12345)
+	if got := (FileStore{}).List(); len(got) != 0 {
+		t.Errorf("List() in another user's dir = %v, want none", got)
+	}
+}
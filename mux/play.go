@@ -0,0 +1,182 @@
+package mux
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// castHeader is the first line of an asciinema v2 cast file.
+type castHeader struct {
+	Version       int     `json:"version"`
+	Width         int     `json:"width"`
+	Height        int     `json:"height"`
+	IdleTimeLimit float64 `json:"idle_time_limit"`
+}
+
+// castEvent is one [time, type, data] line of a cast file.
+type castEvent struct {
+	Time float64
+	Type string
+	Data string
+}
+
+// UnmarshalJSON decodes an event from its array form.
+func (e *castEvent) UnmarshalJSON(b []byte) error {
+	var fields []any
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return err
+	}
+	if len(fields) != 3 {
+		return fmt.Errorf("event has %d fields, want 3", len(fields))
+	}
+	t, ok1 := fields[0].(float64)
+	typ, ok2 := fields[1].(string)
+	data, ok3 := fields[2].(string)
+	if !ok1 || !ok2 || !ok3 {
+		return fmt.Errorf("malformed event %s", b)
+	}
+	*e = castEvent{Time: t, Type: typ, Data: data}
+	return nil
+}
+
+// castReader reads a cast file event by event.
+type castReader struct {
+	header castHeader
+	sc     *bufio.Scanner
+	line   int
+}
+
+// newCastReader reads and checks the header of the cast in r.
+func newCastReader(r io.Reader) (*castReader, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	cr := &castReader{sc: sc, line: 1}
+	if !sc.Scan() {
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("empty cast file")
+	}
+	if err := json.Unmarshal(sc.Bytes(), &cr.header); err != nil {
+		return nil, fmt.Errorf("cast header: %w", err)
+	}
+	if cr.header.Version != 2 {
+		return nil, fmt.Errorf("unsupported cast version %d", cr.header.Version)
+	}
+	return cr, nil
+}
+
+// next returns the next event, or io.EOF after the last one.
+func (cr *castReader) next() (castEvent, error) {
+	for cr.sc.Scan() {
+		cr.line++
+		if len(cr.sc.Bytes()) == 0 {
+			continue
+		}
+		var ev castEvent
+		if err := json.Unmarshal(cr.sc.Bytes(), &ev); err != nil {
+			return castEvent{}, fmt.Errorf("line %d: %w", cr.line, err)
+		}
+		return ev, nil
+	}
+	if err := cr.sc.Err(); err != nil {
+		return castEvent{}, err
+	}
+	return castEvent{}, io.EOF
+}
+
+// CheckCast reports whether path is a cast file NewPlayback can play.
+func CheckCast(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := newCastReader(f); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// NewPlayback creates a session that replays the cast file at path instead
+// of running a shell. Playback starts when the first client attaches and
+// follows the recorded timing; the session then stays up, with the whole
+// recording in its scrollback, until it is killed. Input is ignored.
+func NewPlayback(id, name, path string) (*Session, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	cr, err := newCastReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	// The session reads its output from a pipe that the player feeds, in
+	// place of a PTY.
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	s, err := newSession(id, name, pr, &exec.Cmd{}, nil, 0, nil)
+	if err != nil {
+		f.Close()
+		pw.Close()
+		return nil, err
+	}
+	s.player = pw
+
+	go func() {
+		defer pw.Close()
+		defer f.Close()
+		select {
+		case <-s.attached:
+		case <-s.closed:
+			return
+		}
+		if err := playCast(cr, pw, time.Sleep); err != nil {
+			log.Printf("session %s: playback: %v", s.id, err)
+		}
+		// Keep the pipe open so the session outlives the recording
+		<-s.closed
+	}()
+	return s, nil
+}
+
+// playCast writes the output events from cr to w, sleeping between them as
+// recorded. Gaps longer than the cast's idle_time_limit are shortened.
+func playCast(cr *castReader, w io.Writer, sleep func(time.Duration)) error {
+	limit := cr.header.IdleTimeLimit
+	last := 0.0
+	for {
+		ev, err := cr.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		gap := ev.Time - last
+		last = ev.Time
+		if limit > 0 && gap > limit {
+			gap = limit
+		}
+		if gap > 0 {
+			sleep(time.Duration(gap * float64(time.Second)))
+		}
+		if ev.Type != "o" {
+			continue // input, resize and marker events aren't replayed
+		}
+		if _, err := io.WriteString(w, ev.Data); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package mux
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testCast = `{"version": 2, "width": 80, "height": 24, "idle_time_limit": 2}
+[0.5, "o", "first\r\n"]
+[0.75, "i", "ignored"]
+[10.75, "o", "second\r\n"]
+[10.8, "r", "100x30"]
+`
+
+func TestPlayCast(t *testing.T) {
+	cr, err := newCastReader(strings.NewReader(testCast))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	var slept []time.Duration
+	if err := playCast(cr, &out, func(d time.Duration) { slept = append(slept, d) }); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "first\r\nsecond\r\n" {
+		t.Errorf("output = %q", out.String())
+	}
+	// The 10s gap is cut to the idle limit
+	want := []time.Duration{500 * time.Millisecond, 250 * time.Millisecond, 2 * time.Second, 50 * time.Millisecond}
+	if len(slept) != len(want) {
+		t.Fatalf("slept %v, want %v", slept, want)
+	}
+	for i := range want {
+		if d := slept[i] - want[i]; d > time.Millisecond || d < -time.Millisecond {
+			t.Errorf("sleep %d = %v, want %v", i, slept[i], want[i])
+		}
+	}
+}
+
+func TestCastReaderErrors(t *testing.T) {
+	for _, bad := range []string{
+		"",
+		"not json\n",
+		`{"version": 1}` + "\n",
+	} {
+		if _, err := newCastReader(strings.NewReader(bad)); err == nil {
+			t.Errorf("newCastReader(%q): expected error", bad)
+		}
+	}
+
+	cr, err := newCastReader(strings.NewReader(`{"version": 2}` + "\n[1, \"o\"]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cr.next(); err == nil {
+		t.Error("expected error for a short event")
+	}
+}
+
+func TestPlaybackSession(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	path := filepath.Join(t.TempDir(), "demo.cast")
+	os.WriteFile(path, []byte(`{"version": 2, "width": 80, "height": 24}
+[0.01, "o", "played-back\r\n"]
+`), 0600)
+
+	s, err := NewPlayback(GenerateID(), "play", path)
+	if err != nil {
+		t.Fatalf("NewPlayback: %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		s.Run()
+		close(done)
+	}()
+
+	conn, err := net.Dial("unix", s.socketPath)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.Write(Encode(Hello{}.message()))
+	readUntil(t, conn, "played-back")
+
+	// Killing a session with no process ends it like any other, even
+	// after a resize has been tried on its pipe
+	conn.Write(Encode(Message{Type: MsgResize, Payload: []byte{0, 30, 0, 100}}))
+	conn.Write(Encode(Message{Type: MsgKill}))
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("playback session did not shut down")
+	}
+}
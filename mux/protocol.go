@@ -0,0 +1,254 @@
+package mux
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// MsgType is the type of a wire protocol message.
+type MsgType byte
+
+// Message type constants for the wire protocol.
+const (
+	MsgData            MsgType = 0x01
+	MsgResize          MsgType = 0x02
+	MsgDetach          MsgType = 0x03
+	MsgKill            MsgType = 0x04
+	MsgHistoryRequest  MsgType = 0x05
+	MsgHistoryResponse MsgType = 0x06
+	MsgHello           MsgType = 0x07
+	MsgPromptsRequest  MsgType = 0x08
+	MsgPromptsResponse MsgType = 0x09
+	MsgClearHistory    MsgType = 0x0a
+	MsgStatsRequest    MsgType = 0x0b
+	MsgStatsResponse   MsgType = 0x0c
+	MsgSignal          MsgType = 0x0d
+	MsgInput           MsgType = 0x0e // like MsgData, but without attaching
+	MsgDetachAll       MsgType = 0x0f // detach the attached client, if any
+	MsgError           MsgType = 0x10 // the session refuses the client; see SessionError
+)
+
+// ProtocolVersion is the version of the wire protocol a client speaks,
+// sent in its Hello. Version 2 added MsgError; clients before it send
+// none.
+const ProtocolVersion = 2
+
+// historyFromEnd, set in a history request's offset, makes the rest of
+// the offset a number of lines back from the end of the scrollback rather
+// than a line number.
+const historyFromEnd uint32 = 0x80000000
+
+// historyPlain, set in an optional flags byte after a history request's
+// offset and count, asks for lines ending in "\n" alone. By default they
+// come back as the terminal showed them, ending in "\r\n", which is
+// right for redrawing a screen but not for tools that want text.
+const historyPlain byte = 0x01
+
+// msgTypeNames are the names String gives the message types.
+var msgTypeNames = map[MsgType]string{
+	MsgData:            "data",
+	MsgResize:          "resize",
+	MsgDetach:          "detach",
+	MsgKill:            "kill",
+	MsgHistoryRequest:  "history-request",
+	MsgHistoryResponse: "history-response",
+	MsgHello:           "hello",
+	MsgPromptsRequest:  "prompts-request",
+	MsgPromptsResponse: "prompts-response",
+	MsgClearHistory:    "clear-history",
+	MsgStatsRequest:    "stats-request",
+	MsgStatsResponse:   "stats-response",
+	MsgSignal:          "signal",
+	MsgInput:           "input",
+	MsgDetachAll:       "detach-all",
+	MsgError:           "error",
+}
+
+// String returns the type's name, e.g. "data", or its number for a type
+// this version doesn't know.
+func (t MsgType) String() string {
+	if name, ok := msgTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("type(%#02x)", byte(t))
+}
+
+// DetachReason says why a client left its session. The session sends it
+// as the one-byte payload of a MsgDetach when it drops a client.
+type DetachReason byte
+
+const (
+	DetachNone     DetachReason = iota // not detached: the session ended or the connection dropped
+	DetachUser                         // the user detached, e.g. with Ctrl+a d
+	DetachTakeover                     // another client attached to the session
+	DetachRemote                       // detached from outside, by `mhist detach`
+)
+
+// ErrorCode says what a SessionError is about.
+type ErrorCode byte
+
+const (
+	ErrorBusy       ErrorCode = iota + 1 // another client is attached
+	ErrorBadRequest                      // the client sent something the session can't use
+)
+
+// SessionError is the JSON payload of MsgError, with which a session
+// refuses a client before closing the connection. Errors are sent as
+// messages of their own rather than as text in the output, which would
+// land in the middle of a terminal in raw mode.
+type SessionError struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+func (e *SessionError) Error() string {
+	return e.Message
+}
+
+// message wraps e in a MsgError.
+func (e *SessionError) message() Message {
+	payload, _ := json.Marshal(e)
+	return Message{Type: MsgError, Payload: payload}
+}
+
+// parseSessionError decodes the payload of a MsgError. A payload that
+// doesn't parse is still an error, with the payload as its message.
+func parseSessionError(payload []byte) *SessionError {
+	var e SessionError
+	if json.Unmarshal(payload, &e) != nil || e.Message == "" {
+		return &SessionError{Message: fmt.Sprintf("session error %q", payload)}
+	}
+	return &e
+}
+
+// Hello is the JSON payload of MsgHello, the first message a client
+// sends after connecting.
+type Hello struct {
+	// NoRedraw skips the replay of the current screen on attach; the
+	// client only sees output from then on.
+	NoRedraw bool `json:"no_redraw,omitempty"`
+
+	// Term and ColorTerm are the client's $TERM and $COLORTERM, so the
+	// session can tell the shell what the attached terminal supports.
+	Term      string `json:"term,omitempty"`
+	ColorTerm string `json:"colorterm,omitempty"`
+
+	// Sanitize strips escape sequences that do more than draw from
+	// output replayed to the client, the redraw and history, for
+	// attaching to a session that may have run something hostile. Live
+	// output is passed on unchanged.
+	Sanitize bool `json:"sanitize,omitempty"`
+
+	// NoTakeover refuses to attach if another client is attached, rather
+	// than detaching it. The session sends a MsgError with ErrorBusy.
+	NoTakeover bool `json:"no_takeover,omitempty"`
+
+	// Version is the client's ProtocolVersion, or 0 for clients from
+	// before versions were sent.
+	Version int `json:"version,omitempty"`
+}
+
+// Stats is the JSON payload of MsgStatsResponse, a snapshot of a session's
+// scrollback and state.
+type Stats struct {
+	Lines       int   `json:"lines"`          // scrollback lines stored
+	Capacity    int   `json:"capacity"`       // maximum scrollback lines
+	Bytes       int   `json:"bytes"`          // bytes of scrollback stored
+	ReplayBytes int   `json:"replay_bytes"`   // bytes held for screen redraw
+	Uptime      int64 `json:"uptime_seconds"` // time since the session started
+	Attached    bool  `json:"attached"`       // whether a client is attached
+}
+
+// message wraps h in a MsgHello.
+func (h Hello) message() Message {
+	payload, _ := json.Marshal(h)
+	return Message{Type: MsgHello, Payload: payload}
+}
+
+// Message represents a wire protocol message.
+// Wire format: [type:1][length:4 BE][payload:N]
+type Message struct {
+	Type    MsgType
+	Payload []byte
+}
+
+// Encode serializes a message into wire format.
+func Encode(msg Message) []byte {
+	return EncodeTo(make([]byte, 0, 5+len(msg.Payload)), msg)
+}
+
+// EncodeTo appends the wire format of msg to dst and returns the extended
+// slice. Writers that send many messages reuse one buffer this way, e.g.
+// buf = EncodeTo(buf[:0], msg).
+func EncodeTo(dst []byte, msg Message) []byte {
+	if debug {
+		traceMsg("send", msg.Type, len(msg.Payload), msg.Payload)
+	}
+	dst = append(dst, byte(msg.Type), 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(dst[len(dst)-4:], uint32(len(msg.Payload)))
+	return append(dst, msg.Payload...)
+}
+
+// maxScratch is the largest encode buffer a writer keeps for reuse; a
+// bigger one, grown for an occasional large message, is dropped.
+const maxScratch = 64 << 10
+
+// MaxPayload is the largest payload Decode accepts. The length comes from
+// the peer, so without a limit one header could make the reader allocate
+// 4 GiB.
+const MaxPayload = 64 << 20
+
+// Decode reads a single message from the reader. It makes two reads per
+// message, so long-lived connections should be wrapped in a bufio.Reader
+// to avoid a syscall for every header and payload. A payload longer than
+// MaxPayload is an error.
+func Decode(r io.Reader) (Message, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return Message{}, fmt.Errorf("read header: %w", err)
+	}
+
+	msgType := MsgType(header[0])
+	length := binary.BigEndian.Uint32(header[1:5])
+	if length > MaxPayload {
+		return Message{}, fmt.Errorf("%s message of %d bytes is over the %d byte limit", msgType, length, MaxPayload)
+	}
+
+	payload := make([]byte, length)
+	if length > 0 {
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return Message{}, fmt.Errorf("read payload: %w", err)
+		}
+	}
+
+	if debug {
+		traceMsg("recv", msgType, len(payload), payload)
+	}
+	return Message{Type: msgType, Payload: payload}, nil
+}
+
+// debug turns on protocol tracing. It is set from $MHIST_DEBUG once, so
+// when off the cost is a branch per message.
+var debug = os.Getenv("MHIST_DEBUG") != ""
+
+// Debugging reports whether protocol tracing is on.
+func Debugging() bool {
+	return debug
+}
+
+// tracePreview is how many payload bytes a trace line shows.
+const tracePreview = 16
+
+// traceMsg logs a message going out or coming in: its type, its payload
+// length and the start of the payload in hex.
+func traceMsg(dir string, t MsgType, length int, payload []byte) {
+	more := ""
+	if len(payload) > tracePreview {
+		payload, more = payload[:tracePreview], " ..."
+	}
+	log.Printf("trace: %s %s len=%d [% x%s]", dir, t, length, payload, more)
+}
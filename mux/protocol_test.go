@@ -0,0 +1,368 @@
+package mux
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestProtocolRoundTripData(t *testing.T) {
+	msg := Message{Type: MsgData, Payload: []byte("hello world")}
+	encoded := Encode(msg)
+	decoded, err := Decode(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if decoded.Type != MsgData {
+		t.Errorf("expected type %v, got %v", MsgData, decoded.Type)
+	}
+	if !bytes.Equal(decoded.Payload, msg.Payload) {
+		t.Errorf("expected payload %q, got %q", msg.Payload, decoded.Payload)
+	}
+}
+
+func TestProtocolRoundTripResize(t *testing.T) {
+	payload := []byte{0x00, 0x18, 0x00, 0x50} // 24 rows, 80 cols
+	msg := Message{Type: MsgResize, Payload: payload}
+	encoded := Encode(msg)
+	decoded, err := Decode(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if decoded.Type != MsgResize {
+		t.Errorf("expected type %v, got %v", MsgResize, decoded.Type)
+	}
+	if !bytes.Equal(decoded.Payload, payload) {
+		t.Errorf("expected payload %v, got %v", payload, decoded.Payload)
+	}
+}
+
+func TestProtocolRoundTripDetach(t *testing.T) {
+	msg := Message{Type: MsgDetach, Payload: []byte{}}
+	encoded := Encode(msg)
+	decoded, err := Decode(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if decoded.Type != MsgDetach {
+		t.Errorf("expected type %v, got %v", MsgDetach, decoded.Type)
+	}
+	if len(decoded.Payload) != 0 {
+		t.Errorf("expected empty payload, got %v", decoded.Payload)
+	}
+}
+
+func TestProtocolRoundTripKill(t *testing.T) {
+	msg := Message{Type: MsgKill, Payload: []byte{}}
+	encoded := Encode(msg)
+	decoded, err := Decode(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if decoded.Type != MsgKill {
+		t.Errorf("expected type %v, got %v", MsgKill, decoded.Type)
+	}
+}
+
+func TestProtocolRoundTripHistoryRequest(t *testing.T) {
+	payload := []byte{0x00, 0x00, 0x00, 0x0A, 0x00, 0x00, 0x00, 0x14} // offset=10, count=20
+	msg := Message{Type: MsgHistoryRequest, Payload: payload}
+	encoded := Encode(msg)
+	decoded, err := Decode(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if decoded.Type != MsgHistoryRequest {
+		t.Errorf("expected type %v, got %v", MsgHistoryRequest, decoded.Type)
+	}
+	if !bytes.Equal(decoded.Payload, payload) {
+		t.Errorf("payload mismatch")
+	}
+}
+
+func TestProtocolRoundTripHistoryResponse(t *testing.T) {
+	payload := []byte("line1\nline2\nline3\n")
+	msg := Message{Type: MsgHistoryResponse, Payload: payload}
+	encoded := Encode(msg)
+	decoded, err := Decode(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if decoded.Type != MsgHistoryResponse {
+		t.Errorf("expected type %v, got %v", MsgHistoryResponse, decoded.Type)
+	}
+	if !bytes.Equal(decoded.Payload, payload) {
+		t.Errorf("payload mismatch")
+	}
+}
+
+func TestProtocolEmptyPayload(t *testing.T) {
+	msg := Message{Type: MsgData, Payload: []byte{}}
+	encoded := Encode(msg)
+	if len(encoded) != 5 {
+		t.Errorf("expected 5 bytes for empty payload, got %d", len(encoded))
+	}
+	decoded, err := Decode(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if len(decoded.Payload) != 0 {
+		t.Errorf("expected empty payload, got %d bytes", len(decoded.Payload))
+	}
+}
+
+func TestProtocolLargePayload(t *testing.T) {
+	payload := make([]byte, 100000)
+	for i := range payload {
+		payload[i] = byte(i % 256)
+	}
+	msg := Message{Type: MsgData, Payload: payload}
+	encoded := Encode(msg)
+	decoded, err := Decode(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if !bytes.Equal(decoded.Payload, payload) {
+		t.Error("large payload mismatch")
+	}
+}
+
+func TestProtocolOversizedPayload(t *testing.T) {
+	// A header claiming 4 GiB must be refused before anything is allocated
+	header := []byte{byte(MsgData), 0xff, 0xff, 0xff, 0xff}
+	if _, err := Decode(bytes.NewReader(header)); err == nil {
+		t.Error("expected error for a payload over MaxPayload")
+	}
+
+	// The limit itself is allowed
+	encoded := Encode(Message{Type: MsgData, Payload: make([]byte, MaxPayload)})
+	if _, err := Decode(bytes.NewReader(encoded)); err != nil {
+		t.Errorf("decode MaxPayload bytes: %v", err)
+	}
+	binary.BigEndian.PutUint32(encoded[1:5], MaxPayload+1)
+	if _, err := Decode(bytes.NewReader(encoded)); err == nil {
+		t.Error("expected error for MaxPayload+1 bytes")
+	}
+}
+
+func TestProtocolPartialReadError(t *testing.T) {
+	// Only 3 bytes — not enough for the 5-byte header
+	_, err := Decode(bytes.NewReader([]byte{0x01, 0x00, 0x00}))
+	if err == nil {
+		t.Error("expected error for partial header read")
+	}
+}
+
+func TestProtocolTruncatedPayload(t *testing.T) {
+	// Header says 10 bytes of payload, but only 3 provided
+	header := []byte{0x01, 0x00, 0x00, 0x00, 0x0A, 0xAA, 0xBB, 0xCC}
+	_, err := Decode(bytes.NewReader(header))
+	if err == nil {
+		t.Error("expected error for truncated payload")
+	}
+}
+
+func TestProtocolMultipleMessages(t *testing.T) {
+	var buf bytes.Buffer
+	msg1 := Message{Type: MsgData, Payload: []byte("first")}
+	msg2 := Message{Type: MsgDetach, Payload: []byte{}}
+	msg3 := Message{Type: MsgData, Payload: []byte("third")}
+	buf.Write(Encode(msg1))
+	buf.Write(Encode(msg2))
+	buf.Write(Encode(msg3))
+
+	r := bytes.NewReader(buf.Bytes())
+
+	d1, err := Decode(r)
+	if err != nil {
+		t.Fatalf("decode msg1: %v", err)
+	}
+	if !bytes.Equal(d1.Payload, []byte("first")) {
+		t.Errorf("msg1 payload: %q", d1.Payload)
+	}
+
+	d2, err := Decode(r)
+	if err != nil {
+		t.Fatalf("decode msg2: %v", err)
+	}
+	if d2.Type != MsgDetach {
+		t.Errorf("msg2 type: %v", d2.Type)
+	}
+
+	d3, err := Decode(r)
+	if err != nil {
+		t.Fatalf("decode msg3: %v", err)
+	}
+	if !bytes.Equal(d3.Payload, []byte("third")) {
+		t.Errorf("msg3 payload: %q", d3.Payload)
+	}
+
+	// No more messages
+	_, err = Decode(r)
+	if err == nil {
+		t.Error("expected error after all messages consumed")
+	}
+}
+
+func TestProtocolBufferedReader(t *testing.T) {
+	var buf bytes.Buffer
+	var want []Message
+	for i := 0; i < 100; i++ {
+		// Payloads larger than the reader's buffer exercise reads that
+		// straddle buffer refills
+		msg := Message{Type: MsgData, Payload: bytes.Repeat([]byte{byte('a' + i%26)}, i*3)}
+		want = append(want, msg)
+		buf.Write(Encode(msg))
+	}
+
+	r := bufio.NewReaderSize(iotest.OneByteReader(&buf), 16)
+	for i, w := range want {
+		got, err := Decode(r)
+		if err != nil {
+			t.Fatalf("decode %d: %v", i, err)
+		}
+		if got.Type != w.Type || !bytes.Equal(got.Payload, w.Payload) {
+			t.Fatalf("message %d: got type %d, %d bytes; want %d bytes", i, got.Type, len(got.Payload), len(w.Payload))
+		}
+	}
+	if _, err := Decode(r); err == nil {
+		t.Error("expected error after all messages consumed")
+	}
+}
+
+// BenchmarkDecodePipe decodes a stream of keystroke-sized messages from a
+// pipe, read directly and through a bufio.Reader.
+func BenchmarkDecodePipe(b *testing.B) {
+	const batch = 1000
+	var stream []byte
+	for i := 0; i < batch; i++ {
+		stream = append(stream, Encode(Message{Type: MsgData, Payload: []byte("x")})...)
+	}
+
+	for _, bc := range []struct {
+		name string
+		wrap func(io.Reader) io.Reader
+	}{
+		{"direct", func(r io.Reader) io.Reader { return r }},
+		{"bufio", func(r io.Reader) io.Reader { return bufio.NewReader(r) }},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			pr, pw, err := os.Pipe()
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer pr.Close()
+			go func() {
+				defer pw.Close()
+				for i := 0; i < b.N; i++ {
+					if _, err := pw.Write(stream); err != nil {
+						return
+					}
+				}
+			}()
+			r := bc.wrap(pr)
+			b.SetBytes(int64(len(stream)))
+			b.ResetTimer()
+			for i := 0; i < b.N*batch; i++ {
+				if _, err := Decode(r); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkEncodeDecode(b *testing.B) {
+	for _, size := range []int{1, 1024, 64 * 1024} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			msg := Message{Type: MsgData, Payload: bytes.Repeat([]byte("x"), size)}
+			var r bytes.Reader
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				r.Reset(Encode(msg))
+				if _, err := Decode(&r); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestProtocolEncodeTo(t *testing.T) {
+	msg := Message{Type: MsgData, Payload: []byte("hello")}
+	prefix := []byte("xyz")
+	got := EncodeTo(prefix, msg)
+	if want := append([]byte("xyz"), Encode(msg)...); !bytes.Equal(got, want) {
+		t.Fatalf("EncodeTo = %q, want %q", got, want)
+	}
+
+	// Reusing the buffer for a shorter message leaves no stale bytes
+	got = EncodeTo(got[:0], Message{Type: MsgDetach})
+	if want := Encode(Message{Type: MsgDetach}); !bytes.Equal(got, want) {
+		t.Errorf("reused EncodeTo = %q, want %q", got, want)
+	}
+}
+
+func BenchmarkEncodeTo(b *testing.B) {
+	msg := Message{Type: MsgData, Payload: bytes.Repeat([]byte("x"), 1024)}
+	var buf []byte
+	b.SetBytes(int64(len(msg.Payload)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf = EncodeTo(buf[:0], msg)
+	}
+}
+
+func TestMsgTypeString(t *testing.T) {
+	tests := []struct {
+		t    MsgType
+		want string
+	}{
+		{MsgData, "data"},
+		{MsgHistoryResponse, "history-response"},
+		{MsgStatsRequest, "stats-request"},
+		{MsgType(0x7f), "type(0x7f)"},
+	}
+	for _, tt := range tests {
+		if got := tt.t.String(); got != tt.want {
+			t.Errorf("MsgType(%#x).String() = %q, want %q", byte(tt.t), got, tt.want)
+		}
+	}
+}
+
+func TestTraceMsg(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	traceMsg("send", MsgData, 3, []byte("abc"))
+	traceMsg("recv", MsgHistoryResponse, 40, bytes.Repeat([]byte{0xff}, 40))
+	out := buf.String()
+	for _, want := range []string{
+		"trace: send data len=3 [61 62 63]",
+		"trace: recv history-response len=40 [" + strings.Repeat("ff ", 15) + "ff ...]",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("trace output %q lacks %q", out, want)
+		}
+	}
+}
+
+func TestParseSessionError(t *testing.T) {
+	e := &SessionError{Code: ErrorBusy, Message: "session work is attached elsewhere"}
+	if got := parseSessionError(e.message().Payload); *got != *e {
+		t.Errorf("round trip = %+v, want %+v", got, e)
+	}
+	// Anything else is still reported
+	if got := parseSessionError([]byte("oops")); got.Code != 0 || !strings.Contains(got.Error(), "oops") {
+		t.Errorf("unparsable payload = %+v", got)
+	}
+}
@@ -0,0 +1,94 @@
+package mux
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+	"unicode/utf8"
+)
+
+// castRecorder writes session output as an asciinema v2 cast file: a JSON
+// header line followed by one [time, type, data] event per line.
+type castRecorder struct {
+	f          *os.File
+	start      time.Time
+	rows, cols int
+	partial    []byte // incomplete UTF-8 sequence held for the next chunk
+}
+
+// newCastRecorder creates path and writes the cast header for a terminal
+// of the given size.
+func newCastRecorder(path string, rows, cols int) (*castRecorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("create recording: %w", err)
+	}
+	r := &castRecorder{f: f, start: time.Now(), rows: rows, cols: cols}
+	header, _ := json.Marshal(struct {
+		Version   int   `json:"version"`
+		Width     int   `json:"width"`
+		Height    int   `json:"height"`
+		Timestamp int64 `json:"timestamp"`
+	}{2, cols, rows, r.start.Unix()})
+	if _, err := f.Write(append(header, '\n')); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("write recording: %w", err)
+	}
+	return r, nil
+}
+
+// output records a chunk of PTY output.
+func (r *castRecorder) output(data []byte) {
+	// Cast data is a JSON string, so a character split across PTY reads
+	// must be joined up rather than mangled into two replacement runes.
+	data = append(r.partial, data...)
+	cut := incompleteUTF8(data)
+	r.partial = append([]byte(nil), data[cut:]...)
+	if cut > 0 {
+		r.event("o", string(data[:cut]))
+	}
+}
+
+// resize records a terminal size change, if the size actually changed.
+func (r *castRecorder) resize(rows, cols int) {
+	if rows == r.rows && cols == r.cols {
+		return
+	}
+	r.rows, r.cols = rows, cols
+	r.event("r", fmt.Sprintf("%dx%d", cols, rows))
+}
+
+// event appends one event line. Write errors are ignored: a full disk
+// shouldn't take the session down with it.
+func (r *castRecorder) event(kind, data string) {
+	elapsed := time.Since(r.start).Seconds()
+	line, _ := json.Marshal([]any{elapsed, kind, data})
+	r.f.Write(append(line, '\n'))
+}
+
+// close flushes any held bytes and closes the file.
+func (r *castRecorder) close() {
+	if len(r.partial) > 0 {
+		r.event("o", string(r.partial))
+		r.partial = nil
+	}
+	r.f.Close()
+}
+
+// incompleteUTF8 returns the index where a trailing, not yet complete
+// UTF-8 sequence starts in data, or len(data) if it ends cleanly.
+func incompleteUTF8(data []byte) int {
+	// A sequence is at most 4 bytes, so only the last 3 can be the start
+	// of an unfinished one.
+	for i := len(data) - 1; i >= 0 && i >= len(data)-3; i-- {
+		if !utf8.RuneStart(data[i]) {
+			continue
+		}
+		if !utf8.FullRune(data[i:]) {
+			return i
+		}
+		break
+	}
+	return len(data)
+}
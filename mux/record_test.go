@@ -0,0 +1,84 @@
+package mux
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// readCast parses a cast file into its header and events.
+func readCast(t *testing.T, path string) (map[string]any, [][]any) {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	var header map[string]any
+	var events [][]any
+	for sc.Scan() {
+		if header == nil {
+			if err := json.Unmarshal(sc.Bytes(), &header); err != nil {
+				t.Fatalf("header: %v", err)
+			}
+			continue
+		}
+		var ev []any
+		if err := json.Unmarshal(sc.Bytes(), &ev); err != nil {
+			t.Fatalf("event %q: %v", sc.Text(), err)
+		}
+		events = append(events, ev)
+	}
+	return header, events
+}
+
+func TestCastRecorder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.cast")
+	r, err := newCastRecorder(path, 24, 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.output([]byte("hello\r\n"))
+	r.resize(24, 80) // unchanged: no event
+	r.resize(30, 100)
+	r.close()
+
+	header, events := readCast(t, path)
+	if header["version"] != 2.0 || header["width"] != 80.0 || header["height"] != 24.0 {
+		t.Errorf("header = %v", header)
+	}
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want 2: %v", len(events), events)
+	}
+	if events[0][1] != "o" || events[0][2] != "hello\r\n" {
+		t.Errorf("output event = %v", events[0])
+	}
+	if events[1][1] != "r" || events[1][2] != "100x30" {
+		t.Errorf("resize event = %v", events[1])
+	}
+}
+
+func TestCastRecorderSplitRune(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.cast")
+	r, err := newCastRecorder(path, 24, 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	euro := []byte("€") // 3 bytes
+	r.output(append([]byte("a"), euro[:2]...))
+	r.output(append(euro[2:], 'b'))
+	r.close()
+
+	_, events := readCast(t, path)
+	var got string
+	for _, ev := range events {
+		got += ev[2].(string)
+	}
+	if got != "a€b" {
+		t.Errorf("recorded %q, want %q", got, "a€b")
+	}
+}
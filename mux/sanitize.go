@@ -0,0 +1,137 @@
+package mux
+
+import "bytes"
+
+// sanitizeReplay returns output being replayed to a client (a redraw or
+// history) without the escape sequences that do more than draw: ones that
+// make the terminal answer, such as device status and attribute queries
+// and DECRQSS, and ones that reach outside the screen, such as window
+// titles, window operations and the clipboard. A program that once ran in
+// the session could otherwise have them replayed into every terminal that
+// attaches. Everything that draws is kept, as are OSC 8 hyperlinks and
+// OSC 133 prompt marks. data is returned as is if there is nothing to
+// remove.
+func sanitizeReplay(data []byte) []byte {
+	i := bytes.IndexByte(data, 0x1b)
+	if i < 0 {
+		return data
+	}
+	out := make([]byte, 0, len(data))
+	for i >= 0 {
+		out = append(out, data[:i]...)
+		data = data[i:]
+		n, keep := escapeLen(data)
+		if keep {
+			out = append(out, data[:n]...)
+		}
+		data = data[n:]
+		i = bytes.IndexByte(data, 0x1b)
+	}
+	return append(out, data...)
+}
+
+// escapeLen returns the length of the escape sequence at the start of
+// data, which begins with ESC, and whether sanitizeReplay keeps it. A
+// sequence cut off by the end of data runs to the end.
+func escapeLen(data []byte) (int, bool) {
+	if len(data) < 2 {
+		return len(data), true
+	}
+	switch data[1] {
+	case ']':
+		// OSC: ESC ] Ps ; Pt, ended by BEL or ST
+		n := stringEnd(data, true)
+		num, _, _ := bytes.Cut(data[2:n], []byte(";"))
+		return n, string(num) == "8" || string(num) == "133"
+	case 'P', '_', '^', 'X':
+		// DCS, APC, PM and SOS strings, e.g. DECRQSS
+		return stringEnd(data, false), false
+	case '[':
+		return csiLen(data)
+	case 'Z':
+		// DECID asks for the terminal's identity
+		return 2, false
+	}
+	// nF sequences, e.g. ESC ( B to pick a character set, take
+	// intermediate bytes before their final byte
+	i := 1
+	for i < len(data) && data[i] >= 0x20 && data[i] <= 0x2f {
+		i++
+	}
+	return min(i+1, len(data)), true
+}
+
+// StripEscapes returns data as plain text: without escape sequences, and
+// without control characters other than tab and newline. data is returned
+// as is if there is nothing to remove.
+func StripEscapes(data []byte) []byte {
+	clean := true
+	for _, b := range data {
+		if isStripped(b) {
+			clean = false
+			break
+		}
+	}
+	if clean {
+		return data
+	}
+	out := make([]byte, 0, len(data))
+	for len(data) > 0 {
+		switch {
+		case data[0] == 0x1b:
+			n, _ := escapeLen(data)
+			data = data[n:]
+			continue
+		case !isStripped(data[0]):
+			out = append(out, data[0])
+		}
+		data = data[1:]
+	}
+	return out
+}
+
+// isStripped reports whether StripEscapes removes byte b.
+func isStripped(b byte) bool {
+	return (b < 0x20 && b != '\t' && b != '\n') || b == 0x7f
+}
+
+// stringEnd returns the length of the control string at the start of
+// data, up to and including its ST (ESC \), or BEL if bel is set.
+func stringEnd(data []byte, bel bool) int {
+	for i := 2; i < len(data); i++ {
+		switch {
+		case bel && data[i] == 0x07:
+			return i + 1
+		case data[i] == 0x1b && i+1 < len(data) && data[i+1] == '\\':
+			return i + 2
+		}
+	}
+	return len(data)
+}
+
+// csiLen returns the length of the CSI sequence at the start of data and
+// whether it is kept: reports (DSR, DA, DECRQM, XTVERSION) and window
+// operations are not.
+func csiLen(data []byte) (int, bool) {
+	i := 2
+	for i < len(data) && data[i] >= 0x20 && data[i] <= 0x3f {
+		i++
+	}
+	if i == len(data) {
+		return i, true
+	}
+	if data[i] < 0x40 || data[i] > 0x7e {
+		// Not a well-formed sequence; leave the rest to the terminal
+		return i, true
+	}
+	params, final := data[2:i], data[i]
+	switch {
+	case final == 'n', final == 'c', final == 't':
+		return i + 1, false
+	case final == 'p' && bytes.HasSuffix(params, []byte("$")):
+		return i + 1, false
+	case final == 'q' && bytes.HasPrefix(params, []byte(">")):
+		return i + 1, false
+	}
+	return i + 1, true
+}
@@ -0,0 +1,46 @@
+package mux
+
+import "testing"
+
+func TestSanitizeReplay(t *testing.T) {
+	for _, tt := range []struct {
+		name, in, want string
+	}{
+		{"plain", "hello\r\n", "hello\r\n"},
+		{"drawing", "\x1b[1;31mred\x1b[0m\x1b[2J\x1b[H\x1b[?1049h\x1b7\x1b8", "\x1b[1;31mred\x1b[0m\x1b[2J\x1b[H\x1b[?1049h\x1b7\x1b8"},
+		{"title", "a\x1b]0;pwned\x07b\x1b]2;x\x1b\\c", "abc"},
+		{"clipboard", "a\x1b]52;c;aGk=\x07b", "ab"},
+		{"hyperlink and prompt", "\x1b]8;;http://x\x1b\\link\x1b]8;;\x1b\\\x1b]133;A\x07$ ", "\x1b]8;;http://x\x1b\\link\x1b]8;;\x1b\\\x1b]133;A\x07$ "},
+		{"DECRQSS", "a\x1bP$qm\x1b\\b", "ab"},
+		{"status reports", "a\x1b[6n\x1b[5n\x1b[?6nb", "ab"},
+		{"device attributes", "a\x1b[c\x1b[>0c\x1bZb", "ab"},
+		{"DECRQM", "a\x1b[?2004$pb", "ab"},
+		{"XTVERSION", "a\x1b[>qb", "ab"},
+		{"window ops", "a\x1b[21t\x1b[8;100;300tb", "ab"},
+		{"cursor style kept", "\x1b[2 q", "\x1b[2 q"},
+		{"cut off", "a\x1b]0;unfinished", "a"},
+		{"lone ESC", "a\x1b", "a\x1b"},
+	} {
+		if got := string(sanitizeReplay([]byte(tt.in))); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestStripEscapes(t *testing.T) {
+	for _, tt := range []struct {
+		name, in, want string
+	}{
+		{"plain", "hello\tworld\n", "hello\tworld\n"},
+		{"colours", "\x1b[1;31mred\x1b[0m", "red"},
+		{"title and hyperlink", "\x1b]0;t\x07\x1b]8;;http://x\x1b\\link\x1b]8;;\x1b\\", "link"},
+		{"charset", "\x1b(Bab\x1b)0c", "abc"},
+		{"keypad and cursor", "\x1b=\x1b7a\x1b8", "a"},
+		{"controls", "a\rb\x08\x07c\x7f", "abc"},
+		{"cut off", "a\x1b[1;3", "a"},
+	} {
+		if got := string(StripEscapes([]byte(tt.in))); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
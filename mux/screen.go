@@ -0,0 +1,110 @@
+package mux
+
+import "bytes"
+
+// modeSwitch is a sequence that turns a terminal mode on or off.
+type modeSwitch struct {
+	seq []byte
+	on  bool
+}
+
+// screenSwitches are the sequences that move a terminal between the main
+// and alternate screens. RIS (ESC c) resets to the main screen.
+var screenSwitches = []modeSwitch{
+	{[]byte("\x1b[?1049h"), true},
+	{[]byte("\x1b[?1049l"), false},
+	{[]byte("\x1b[?1047h"), true},
+	{[]byte("\x1b[?1047l"), false},
+	{[]byte("\x1b[?47h"), true},
+	{[]byte("\x1b[?47l"), false},
+	{[]byte("\x1bc"), false},
+}
+
+// pasteSwitches are the sequences that turn bracketed paste mode on and
+// off. RIS (ESC c) turns it off.
+var pasteSwitches = []modeSwitch{
+	{[]byte("\x1b[?2004h"), true},
+	{[]byte("\x1b[?2004l"), false},
+	{[]byte("\x1bc"), false},
+}
+
+// maxSwitchLen is the length of the longest sequence in screenSwitches
+// and pasteSwitches.
+const maxSwitchLen = 8
+
+// modeTracker follows PTY output to know whether a terminal mode is on,
+// from the sequences in switches: the alternate screen (screenSwitches)
+// or bracketed paste (pasteSwitches).
+type modeTracker struct {
+	switches []modeSwitch
+	on       bool
+	tail     []byte // end of the previous write, in case a sequence was split
+}
+
+// Write scans p for switches. The last switch seen wins.
+func (t *modeTracker) Write(p []byte) {
+	// Sequences split across writes: check the previous tail joined with
+	// the start of p, then p itself, which comes later in the stream.
+	if len(t.tail) > 0 {
+		head := p
+		if len(head) > maxSwitchLen-1 {
+			head = head[:maxSwitchLen-1]
+		}
+		t.scan(append(t.tail, head...))
+	}
+	t.scan(p)
+
+	if len(p) >= maxSwitchLen-1 {
+		t.tail = append(t.tail[:0], p[len(p)-(maxSwitchLen-1):]...)
+	} else {
+		t.tail = append(t.tail, p...)
+		if len(t.tail) > maxSwitchLen-1 {
+			t.tail = t.tail[len(t.tail)-(maxSwitchLen-1):]
+		}
+	}
+}
+
+// scan updates on from the last switch in data, if any.
+func (t *modeTracker) scan(data []byte) {
+	last := -1
+	for _, s := range t.switches {
+		if i := bytes.LastIndex(data, s.seq); i > last {
+			last = i
+			t.on = s.on
+		}
+	}
+}
+
+// lastScreen returns the end of raw PTY output that draws the current
+// screen, and whether anything before it was dropped. On the main screen
+// that is the last rows lines; on the alternate screen it is everything
+// since the application switched to it, since full-screen programs move
+// the cursor rather than printing lines.
+func lastScreen(raw []byte, rows int, alt bool) ([]byte, bool) {
+	if alt {
+		last := -1
+		for _, s := range screenSwitches {
+			if !s.on {
+				continue
+			}
+			if i := bytes.LastIndex(raw, s.seq); i >= 0 && i+len(s.seq) > last {
+				last = i + len(s.seq)
+			}
+		}
+		if last < 0 {
+			return raw, false
+		}
+		return raw[last:], true
+	}
+
+	// The cursor's line counts as one, so keep what follows the rows-th
+	// newline from the end
+	i := len(raw)
+	for n := 0; n < rows; n++ {
+		i = bytes.LastIndexByte(raw[:i], '\n')
+		if i < 0 {
+			return raw, false
+		}
+	}
+	return raw[i+1:], true
+}
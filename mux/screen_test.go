@@ -0,0 +1,79 @@
+package mux
+
+import "testing"
+
+func TestModeTrackerAltScreen(t *testing.T) {
+	st := modeTracker{switches: screenSwitches}
+	st.Write([]byte("prompt$ vim\r\n\x1b[?1049h\x1b[Hfile contents"))
+	if !st.on {
+		t.Fatal("expected alt screen after 1049h")
+	}
+	st.Write([]byte("more\x1b[?1049l\r\nprompt$ "))
+	if st.on {
+		t.Fatal("expected main screen after 1049l")
+	}
+}
+
+func TestModeTrackerLastSwitchWins(t *testing.T) {
+	st := modeTracker{switches: screenSwitches}
+	st.Write([]byte("\x1b[?1049h...\x1b[?1049l...\x1b[?47h"))
+	if !st.on {
+		t.Error("expected alt screen from the final 47h")
+	}
+	st.Write([]byte("\x1bc"))
+	if st.on {
+		t.Error("expected RIS to return to the main screen")
+	}
+}
+
+func TestModeTrackerSplitSequence(t *testing.T) {
+	st := modeTracker{switches: screenSwitches}
+	st.Write([]byte("output\x1b[?10"))
+	st.Write([]byte("49h"))
+	if !st.on {
+		t.Error("expected a sequence split across writes to be seen")
+	}
+
+	// Byte at a time
+	st = modeTracker{switches: screenSwitches}
+	for _, b := range []byte("x\x1b[?1049hy") {
+		st.Write([]byte{b})
+	}
+	if !st.on {
+		t.Error("expected a byte-at-a-time sequence to be seen")
+	}
+}
+
+func TestLastScreen(t *testing.T) {
+	tests := []struct {
+		raw     string
+		rows    int
+		alt     bool
+		want    string
+		trimmed bool
+	}{
+		{"a\r\nb\r\n$ ", 5, false, "a\r\nb\r\n$ ", false},
+		{"a\r\nb\r\nc\r\nd\r\n$ ", 3, false, "c\r\nd\r\n$ ", true},
+		{"a\r\nb\r\nc\r\n", 2, false, "c\r\n", true},
+		{"$ vim\r\n\x1b[?1049h\x1b[Hold\x1b[?1049l$ vim\r\n\x1b[?1049h\x1b[Hnew", 24, true, "\x1b[Hnew", true},
+		{"\x1b[Hno switch in the buffer", 24, true, "\x1b[Hno switch in the buffer", false},
+	}
+	for _, tt := range tests {
+		got, trimmed := lastScreen([]byte(tt.raw), tt.rows, tt.alt)
+		if string(got) != tt.want || trimmed != tt.trimmed {
+			t.Errorf("lastScreen(%q, %d, %v) = %q, %v; want %q, %v", tt.raw, tt.rows, tt.alt, got, trimmed, tt.want, tt.trimmed)
+		}
+	}
+}
+
+func TestModeTrackerBracketedPaste(t *testing.T) {
+	st := modeTracker{switches: pasteSwitches}
+	st.Write([]byte("\x1b[?2004h$ "))
+	if !st.on {
+		t.Fatal("expected bracketed paste after 2004h")
+	}
+	st.Write([]byte("\x1b[?1049l\x1b[?2004l"))
+	if st.on {
+		t.Error("expected bracketed paste off after 2004l")
+	}
+}
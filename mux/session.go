@@ -0,0 +1,1294 @@
+package mux
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+)
+
+// Session holds the state for a running session process.
+type Session struct {
+	id         string
+	name       string
+	ptmx       *os.File
+	cmd        *exec.Cmd
+	buffer     *ScrollbackBuffer
+	listener   net.Listener
+	extra      []net.Listener // additional listeners, e.g. TCP
+	listenAddr string         // TCP address, if listening on one
+	created    time.Time
+	socketPath string
+	envPath    string // shell snippet exporting the attached terminal's TERM
+	client     *clientConn
+	clientMu   sync.Mutex
+	mu         sync.Mutex // guards buffer and the raw replay buffer
+	lastRows   int        // last known terminal rows for redraw
+	lastCols   int        // last known terminal cols
+	rawBuf     []byte     // circular buffer for raw PTY replay
+	rawHead    int        // next write position in rawBuf
+	rawLen     int        // bytes currently stored in rawBuf
+	outSeq     uint64     // PTY reads so far, guarded by mu; see readPTY
+	screen     modeTracker
+	recorder   *castRecorder // guarded by mu; nil unless recording
+	transcript *transcript   // guarded by mu; nil unless logging output
+
+	// OSC 52 clipboard writes are kept out of scrollback and the replay
+	// buffer, so history and redraws don't set the clipboard again. They
+	// reach the attached client as they arrive unless noClipboard is set.
+	clipboard   clipboardFilter // used by readPTY
+	noClipboard bool
+
+	// The shell isn't sent its init command or resized until it has
+	// started up; see waitReady. readPTY signals startOutput as output
+	// arrives. A resize before then is held in pendingSize (guarded by
+	// mu).
+	init        []byte // typed into the shell once it is ready
+	ready       chan struct{}
+	readyOnce   sync.Once
+	startOutput chan struct{}
+	pendingSize *pty.Winsize
+
+	attached     chan struct{} // closed when the first client attaches
+	attachedOnce sync.Once
+	closed       chan struct{} // closed once the session has been cleaned up
+
+	player *os.File // write end of a playback session's output pipe
+}
+
+// clientQueueSize is the number of outgoing messages buffered per client
+// before senders block.
+const clientQueueSize = 64
+
+// clientConn is an attached client connection. All outgoing messages go
+// through a single writer goroutine so framed messages never interleave.
+type clientConn struct {
+	conn net.Conn
+	out  chan queuedMessage
+	done chan struct{} // closed when the writer stops
+	once sync.Once
+
+	resized  bool // has sent a resize; only used by its handler
+	sanitize bool // replayed output is sanitized; set on attach
+
+	// queueMu orders a redraw with the live output around it; see
+	// readPTY. It is taken before s.mu. redrawn is the outSeq the last
+	// redraw covers, guarded by queueMu and s.mu both.
+	queueMu sync.Mutex
+	redrawn uint64
+}
+
+// queuedMessage is a message waiting to be written to a client. If buf is
+// set, the payload lives in that pooled PTY read buffer, which the writer
+// returns to readBufPool once the message is written. If parts is set, it
+// is the whole frame in pieces and is written instead of msg.
+type queuedMessage struct {
+	msg   Message
+	buf   *[]byte
+	parts [][]byte
+}
+
+// readBufSize is the size of a PTY read.
+const readBufSize = 4096
+
+// readBufPool recycles PTY read buffers, so the output fast path doesn't
+// allocate a copy of every read.
+var readBufPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, readBufSize)
+		return &b
+	},
+}
+
+// newClientConn wraps conn and starts its writer goroutine.
+func newClientConn(conn net.Conn) *clientConn {
+	cc := &clientConn{
+		conn: conn,
+		out:  make(chan queuedMessage, clientQueueSize),
+		done: make(chan struct{}),
+	}
+	go cc.writeLoop()
+	return cc
+}
+
+// send queues a message for the client. It blocks while the queue is full,
+// which applies backpressure to the sender. Returns false if the writer has
+// stopped.
+func (cc *clientConn) send(msg Message) bool {
+	return cc.sendPooled(msg, nil)
+}
+
+// sendPooled is send for a message whose payload is in buf, taken from
+// readBufPool. If it returns true the writer owns buf; otherwise the
+// caller does.
+func (cc *clientConn) sendPooled(msg Message, buf *[]byte) bool {
+	select {
+	case cc.out <- queuedMessage{msg: msg, buf: buf}:
+		return true
+	case <-cc.done:
+		return false
+	}
+}
+
+// sendParts queues a message whose payload is the concatenation of parts,
+// without joining them first. The parts must not change until written.
+func (cc *clientConn) sendParts(msgType MsgType, parts [][]byte) bool {
+	size := 0
+	for _, p := range parts {
+		size += len(p)
+	}
+	header := make([]byte, 5)
+	header[0] = byte(msgType)
+	binary.BigEndian.PutUint32(header[1:5], uint32(size))
+	if debug && len(parts) > 0 {
+		traceMsg("send", msgType, size, parts[0])
+	}
+	select {
+	case cc.out <- queuedMessage{parts: append([][]byte{header}, parts...)}:
+		return true
+	case <-cc.done:
+		return false
+	}
+}
+
+// writeLoop writes queued messages to the connection until stopped or a
+// write fails. A MsgDetach or MsgError is the last message; the
+// connection is closed once it is written.
+func (cc *clientConn) writeLoop() {
+	var scratch []byte
+	var pw *bufio.Writer // coalesces the small pieces of a parts message
+	for {
+		select {
+		case q := <-cc.out:
+			msg := q.msg
+			var err error
+			if q.parts != nil {
+				if pw == nil {
+					pw = bufio.NewWriterSize(cc.conn, 32<<10)
+				}
+				for _, p := range q.parts {
+					pw.Write(p)
+				}
+				err = pw.Flush()
+			} else {
+				scratch = EncodeTo(scratch[:0], msg)
+				_, err = cc.conn.Write(scratch)
+				if cap(scratch) > maxScratch {
+					scratch = nil
+				}
+			}
+			if q.buf != nil {
+				readBufPool.Put(q.buf)
+			}
+			if err != nil {
+				cc.stop()
+				return
+			}
+			if msg.Type == MsgDetach || msg.Type == MsgError {
+				cc.close()
+				return
+			}
+		case <-cc.done:
+			return
+		}
+	}
+}
+
+// stop stops the writer goroutine without closing the connection.
+func (cc *clientConn) stop() {
+	cc.once.Do(func() {
+		close(cc.done)
+	})
+}
+
+// close stops the writer and closes the connection.
+func (cc *clientConn) close() {
+	cc.stop()
+	cc.conn.Close()
+}
+
+// kickTimeout bounds how long a dropped client has to receive the detach
+// message telling it why.
+const kickTimeout = time.Second
+
+// kick tells the client why it is being dropped and closes the
+// connection. It never blocks: a client whose queue is full is stalled
+// and is closed without the message.
+func (cc *clientConn) kick(reason DetachReason) {
+	cc.sendLast(Message{Type: MsgDetach, Payload: []byte{byte(reason)}})
+}
+
+// refuse sends the client an error and closes the connection, like kick.
+func (cc *clientConn) refuse(code ErrorCode, format string, args ...any) {
+	e := &SessionError{Code: code, Message: fmt.Sprintf(format, args...)}
+	cc.sendLast(e.message())
+}
+
+// sendLast queues msg as the last message to the client, which the writer
+// closes the connection after. A client whose queue is full is closed
+// without it.
+func (cc *clientConn) sendLast(msg Message) {
+	cc.conn.SetWriteDeadline(time.Now().Add(kickTimeout))
+	select {
+	case cc.out <- queuedMessage{msg: msg}:
+	default:
+		cc.close()
+	}
+}
+
+// Bounds for a terminal size accepted in a resize request.
+const (
+	minTermSize = 1
+	maxTermSize = 1000
+)
+
+// validSize reports whether rows and cols are within sane bounds.
+func validSize(rows, cols int) bool {
+	return rows >= minTermSize && rows <= maxTermSize &&
+		cols >= minTermSize && cols <= maxTermSize
+}
+
+// ResolveShell returns the shell a session should run: shell itself if
+// set, else $SHELL, else /bin/sh. Bare names are looked up in $PATH. An
+// error is returned if the result isn't an executable file.
+func ResolveShell(shell string) (string, error) {
+	if shell == "" {
+		shell = os.Getenv("SHELL")
+		if shell == "" {
+			shell = "/bin/sh"
+		}
+	}
+
+	path, err := exec.LookPath(shell)
+	if err != nil {
+		return "", fmt.Errorf("shell %s: %w", shell, err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("shell %s: %w", shell, err)
+	}
+	if !fi.Mode().IsRegular() || fi.Mode().Perm()&0111 == 0 {
+		return "", fmt.Errorf("shell %s is not an executable file", shell)
+	}
+	return path, nil
+}
+
+// SessionOptions configures a new session. The zero value runs the
+// default shell (see ResolveShell) as a non-login shell.
+type SessionOptions struct {
+	Shell string // shell to run; empty means $SHELL or /bin/sh
+	Login bool   // start the shell as a login shell
+
+	// Record, if set, is a path to write the session's output to as an
+	// asciinema v2 cast file.
+	Record string
+
+	// Log, if set, is a file to append the session's output to as it
+	// was written, with each line prefixed by an ISO 8601 timestamp if
+	// LogTimestamps is set. Clients see the output unchanged.
+	Log           string
+	LogTimestamps bool
+
+	// NoClipboard stops programs in the session from setting the system
+	// clipboard with OSC 52 escape sequences, which are then dropped
+	// rather than passed on to the client's terminal.
+	NoClipboard bool
+
+	// Scrollback is the number of lines of history kept. Defaults to
+	// DefaultScrollback.
+	Scrollback int
+
+	// Rows and Cols are the size the shell starts at, normally that of
+	// the terminal creating the session, so its first prompt is laid out
+	// before any client attaches. Zero means the pty's default.
+	Rows, Cols int
+
+	// ReplayBuffer is how many bytes of recent output are kept to redraw
+	// the screen for a client that attaches. Defaults to
+	// DefaultReplayBuffer; it grows as needed to cover the terminal.
+	ReplayBuffer int
+
+	// RawScrollback keeps scrollback as raw output rather than lines; see
+	// NewRawScrollbackBuffer. History then replays the output as it was
+	// drawn, which suits output that isn't line oriented.
+	RawScrollback bool
+
+	// Init, if set, is a command typed into the shell, followed by Enter,
+	// once it has started, e.g. "cd ~/proj && git status".
+	Init string
+}
+
+// DefaultScrollback is the number of scrollback lines a session keeps
+// unless told otherwise.
+const DefaultScrollback = 10000
+
+// DefaultReplayBuffer is the size of a session's replay buffer unless
+// told otherwise, enough for a screenful of a typical terminal.
+const DefaultReplayBuffer = 64 << 10
+
+// The replay buffer grows to replayBytesPerCell bytes for every cell of
+// the attached terminal, allowing for the escape sequences of colorful
+// output, but to no more than maxReplayBuffer.
+const (
+	replayBytesPerCell = 16
+	maxReplayBuffer    = 16 << 20
+)
+
+// loginFlags maps shell names to the flag that makes them a login shell.
+// Shells not listed only get the "-" argv[0] prefix, which every
+// traditional shell honors.
+var loginFlags = map[string]string{
+	"bash": "-l",
+	"zsh":  "-l",
+	"ksh":  "-l",
+	"mksh": "-l",
+	"dash": "-l",
+	"sh":   "-l",
+	"tcsh": "-l",
+	"fish": "--login",
+	"nu":   "--login",
+}
+
+// shellCommand builds the command that runs shell. A login shell gets the
+// conventional "-name" argv[0] plus its own login flag, since not every
+// shell checks argv[0].
+func shellCommand(shell string, login bool) *exec.Cmd {
+	cmd := exec.Command(shell)
+	if login {
+		base := filepath.Base(shell)
+		cmd.Args = []string{"-" + base}
+		if flag, ok := loginFlags[base]; ok {
+			cmd.Args = append(cmd.Args, flag)
+		}
+	}
+	return cmd
+}
+
+// NewSession creates and starts a new session.
+func NewSession(id, name string, opts SessionOptions) (*Session, error) {
+	shell, err := ResolveShell(opts.Shell)
+	if err != nil {
+		return nil, err
+	}
+
+	sized := validSize(opts.Rows, opts.Cols)
+	rows, cols := 24, 80
+	if sized {
+		rows, cols = opts.Rows, opts.Cols
+	}
+
+	var recorder *castRecorder
+	if opts.Record != "" {
+		// Without a size this is a placeholder until the first client
+		// sends its own
+		recorder, err = newCastRecorder(opts.Record, rows, cols)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cmd := shellCommand(shell, opts.Login)
+	cmd.Env = append(os.Environ(), "MHIST_SESSION="+id, "MHIST_ENV_FILE="+envFilePath(id))
+
+	var ptmx *os.File
+	if sized {
+		ptmx, err = pty.StartWithSize(cmd, &pty.Winsize{Rows: uint16(rows), Cols: uint16(cols)})
+	} else {
+		ptmx, err = pty.Start(cmd)
+	}
+	if err != nil {
+		// Nothing is in the socket dir yet, so there is nothing to clean
+		// up there; the error ends up in the session log for `mhist new`
+		// to show
+		if recorder != nil {
+			recorder.close()
+		}
+		return nil, fmt.Errorf("start shell %s: %w", shell, err)
+	}
+
+	var size *pty.Winsize
+	if sized {
+		size = &pty.Winsize{Rows: uint16(rows), Cols: uint16(cols)}
+	}
+	s, err := newSession(id, name, ptmx, cmd, recorder, opts.Scrollback, size)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Log != "" {
+		if s.transcript, err = newTranscript(opts.Log, opts.LogTimestamps); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	if opts.RawScrollback {
+		s.buffer = NewRawScrollbackBuffer(s.buffer.Capacity())
+	}
+	s.noClipboard = opts.NoClipboard
+	if opts.Init != "" {
+		s.init = []byte(opts.Init + "\r")
+	}
+	s.growReplay(opts.ReplayBuffer)
+	if sized {
+		s.growReplay(rows * cols * replayBytesPerCell)
+	}
+	return s, nil
+}
+
+// newSession sets up the socket and info file for a session reading output
+// from ptmx, whose size is given if known. On failure it releases ptmx,
+// cmd and recorder.
+func newSession(id, name string, ptmx *os.File, cmd *exec.Cmd, recorder *castRecorder, scrollback int, size *pty.Winsize) (*Session, error) {
+	if scrollback <= 0 {
+		scrollback = DefaultScrollback
+	}
+
+	abort := func() {
+		ptmx.Close()
+		if cmd.Process != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}
+		if recorder != nil {
+			recorder.close()
+		}
+	}
+
+	dir, err := EnsureSocketDir()
+	if err != nil {
+		abort()
+		return nil, err
+	}
+
+	sockPath := filepath.Join(dir, id+".sock")
+
+	listener, err := net.Listen("unix", sockPath)
+	if err != nil {
+		abort()
+		return nil, fmt.Errorf("listen socket: %w", err)
+	}
+
+	s := &Session{
+		id:         id,
+		name:       name,
+		ptmx:       ptmx,
+		cmd:        cmd,
+		buffer:     NewScrollbackBuffer(scrollback),
+		listener:   listener,
+		socketPath: sockPath,
+		envPath:    envFilePath(id),
+		created:    time.Now(),
+		rawBuf:     make([]byte, DefaultReplayBuffer),
+		recorder:   recorder,
+		attached:   make(chan struct{}),
+		closed:     make(chan struct{}),
+		screen:     modeTracker{switches: screenSwitches},
+
+		ready:       make(chan struct{}),
+		startOutput: make(chan struct{}, 1),
+	}
+	if size != nil {
+		s.lastRows, s.lastCols = int(size.Rows), int(size.Cols)
+	}
+
+	if err := s.writeInfoFile(); err != nil {
+		// Stop the shell first, or cleanup would wait for it to exit
+		s.Close()
+		return nil, fmt.Errorf("write info file: %w", err)
+	}
+
+	return s, nil
+}
+
+// envFilePath returns the path of session id's environment file. A
+// session's shell finds it through $MHIST_ENV_FILE.
+func envFilePath(id string) string {
+	return filepath.Join(SocketDir(), id+".env")
+}
+
+// writeEnvFile records the attached terminal's TERM and COLORTERM as a
+// shell snippet. The shell's environment was fixed when the session
+// started, so a client attaching from a different terminal would
+// otherwise leave programs guessing the wrong capabilities; sourcing
+// $MHIST_ENV_FILE (e.g. from PROMPT_COMMAND) picks up the current one.
+func (s *Session) writeEnvFile(hello Hello) {
+	if hello.Term == "" {
+		return
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "export TERM=%s\n", shellQuote(hello.Term))
+	if hello.ColorTerm != "" {
+		fmt.Fprintf(&b, "export COLORTERM=%s\n", shellQuote(hello.ColorTerm))
+	} else {
+		b.WriteString("unset COLORTERM\n")
+	}
+	if err := os.WriteFile(s.envPath, []byte(b.String()), 0600); err != nil {
+		log.Printf("session %s: write env file: %v", s.id, err)
+	}
+}
+
+// shellQuote quotes v for a POSIX shell.
+func shellQuote(v string) string {
+	return "'" + strings.ReplaceAll(v, "'", `'\''`) + "'"
+}
+
+// Listen adds a listener on addr using the given transport, in addition to
+// the session's Unix socket. Must be called before Run.
+func (s *Session) Listen(t Transport, addr string) error {
+	l, err := t.Listen(addr)
+	if err != nil {
+		return fmt.Errorf("listen %s: %w", addr, err)
+	}
+	s.extra = append(s.extra, l)
+	s.listenAddr = l.Addr().String()
+	return s.writeInfoFile()
+}
+
+// writeInfoFile writes session metadata to the info JSON file. The caller
+// must hold s.mu, unless the session isn't running yet.
+func (s *Session) writeInfoFile() error {
+	info := SessionInfo{
+		ID:      s.id,
+		Name:    s.name,
+		PID:     os.Getpid(),
+		Created: s.created.Format(time.RFC3339),
+		Socket:  s.socketPath,
+		Listen:  s.listenAddr,
+		Rows:    s.lastRows,
+		Cols:    s.lastCols,
+
+		CreatedNano: s.created.UnixNano(),
+	}
+	return FileStore{}.Put(info)
+}
+
+// Run starts the session event loop. Blocks until the session ends.
+func (s *Session) Run() {
+	// Handle signals for clean shutdown
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+
+	// Channel to signal PTY EOF
+	ptyDone := make(chan struct{})
+
+	// Read PTY output, feed to buffer and forward to client
+	go s.readPTY(ptyDone)
+	go s.waitReady()
+
+	// Accept client connections
+	go s.acceptClients(s.listener)
+	for _, l := range s.extra {
+		go s.acceptClients(l)
+	}
+
+	// Wait for shell exit or signal
+	select {
+	case <-ptyDone:
+		log.Printf("session %s: shell exited", s.id)
+	case sig := <-sigCh:
+		log.Printf("session %s: received %v, shutting down", s.id, sig)
+		s.kill()
+	}
+
+	s.cleanup()
+}
+
+// Timing of waitReady: the shell is taken to be ready once its output
+// has paused for readySettle, or readyTimeout after it started, whichever
+// comes first.
+const (
+	readySettle  = 100 * time.Millisecond
+	readyTimeout = time.Second
+)
+
+// waitReady waits for the shell to start up, then calls markReady. A shell
+// still starting can mangle its first prompt if resized, and input typed
+// then is echoed by the terminal before the prompt and again by the line
+// editor, so the shell is left alone until it has printed its prompt and
+// gone quiet, as a user would wait.
+func (s *Session) waitReady() {
+	deadline := time.After(readyTimeout)
+	var settled <-chan time.Time
+	for {
+		select {
+		case <-s.startOutput:
+			settled = time.After(readySettle)
+		case <-settled:
+			s.markReady()
+			return
+		case <-deadline:
+			s.markReady()
+			return
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// markReady applies a resize held back while the shell started and types
+// the init command. Input from a client marks the shell ready early, so
+// whatever it types goes after the init command, at the size it expects.
+func (s *Session) markReady() {
+	s.readyOnce.Do(func() {
+		s.mu.Lock()
+		if s.pendingSize != nil {
+			pty.Setsize(s.ptmx, s.pendingSize)
+			s.notifyResize()
+			s.pendingSize = nil
+		}
+		close(s.ready)
+		s.mu.Unlock()
+		if s.init != nil {
+			s.ptmx.Write(s.init)
+		}
+	})
+}
+
+// readPTY reads from the PTY and distributes output.
+func (s *Session) readPTY(done chan<- struct{}) {
+	defer close(done)
+	for {
+		// Read straight into a pooled buffer. Everything below copies what
+		// it keeps, except the client's queue, which hands the buffer back
+		// once the data is written.
+		buf := readBufPool.Get().(*[]byte)
+		n, err := s.ptmx.Read(*buf)
+		sent := false
+		if n > 0 {
+			select {
+			case s.startOutput <- struct{}{}:
+			default:
+			}
+			live := (*buf)[:n]
+			data, stripped := s.clipboard.strip(live)
+			pooled := buf
+			if stripped && s.noClipboard {
+				live, pooled = data, nil
+			}
+
+			// The output is numbered and added to the replay buffer under
+			// mu, and sent after unlocking, so a stalled client blocks
+			// only this loop. A redraw is made under mu too and queued
+			// under the client's queueMu, so this output either comes
+			// after the redraw or, if the redraw has it already, not at
+			// all.
+			s.mu.Lock()
+			s.outSeq++
+			seq := s.outSeq
+			s.buffer.Write(data)
+			s.screen.Write(data)
+			if s.recorder != nil {
+				s.recorder.output(data)
+			}
+			if s.transcript != nil {
+				s.transcript.output(data)
+			}
+
+			// Append to raw circular replay buffer
+			cap := len(s.rawBuf)
+			for _, b := range data {
+				s.rawBuf[s.rawHead] = b
+				s.rawHead = (s.rawHead + 1) % cap
+				if s.rawLen < cap {
+					s.rawLen++
+				}
+			}
+
+			s.clientMu.Lock()
+			client := s.client
+			s.clientMu.Unlock()
+			s.mu.Unlock()
+
+			if client != nil && len(live) > 0 {
+				client.queueMu.Lock()
+				if seq <= client.redrawn {
+					// Redrawn already
+				} else if !client.sendPooled(Message{Type: MsgData, Payload: live}, pooled) {
+					// Its writer stopped on a failed write
+					s.dropClient(client)
+				} else {
+					sent = pooled != nil
+				}
+				client.queueMu.Unlock()
+			}
+		}
+		if !sent {
+			readBufPool.Put(buf)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// notifyResize sends SIGWINCH to the foreground process group of the pty.
+// The kernel already does when a resize changes the size, but not when it
+// doesn't, e.g. when a client attaches at the size the last one had; the
+// signal still prompts a full-screen program to redraw for the new client.
+// Signalling the group ourselves also covers systems where the kernel's
+// signal doesn't reach the program. Callers hold s.mu.
+func (s *Session) notifyResize() {
+	signalForeground(s.ptmx)
+}
+
+// dropClient detaches cc if it is still the client, freeing the slot, and
+// closes its connection. It is for a client whose connection failed; its
+// handler sees the close and finishes.
+func (s *Session) dropClient(cc *clientConn) {
+	s.clientMu.Lock()
+	if s.client == cc {
+		s.client = nil
+		log.Printf("session %s: dropping client after a failed write", s.id)
+	}
+	s.clientMu.Unlock()
+	cc.close()
+}
+
+// acceptClients listens for incoming client connections on l.
+func (s *Session) acceptClients(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		tuneConn(conn)
+		go s.handleClient(newClientConn(conn))
+	}
+}
+
+// attach makes cc the session's client and replays the screen to it,
+// unless hello asks otherwise. It returns false if cc was turned away
+// because hello asked not to take over from the attached client.
+func (s *Session) attach(cc *clientConn, hello Hello) bool {
+	// Kick stale client — last connection wins. This happens before
+	// taking s.mu so a stalled client can't block the new attach.
+	s.clientMu.Lock()
+	if s.client != nil && hello.NoTakeover {
+		s.clientMu.Unlock()
+		log.Printf("session %s: refusing a client that won't take over", s.id)
+		cc.refuse(ErrorBusy, "session %s is attached elsewhere", s.name)
+		return false
+	}
+	if s.client != nil {
+		log.Printf("session %s: kicking existing client for new connection", s.id)
+		s.client.kick(DetachTakeover)
+		s.client = nil
+	}
+	s.clientMu.Unlock()
+
+	cc.queueMu.Lock()
+	defer cc.queueMu.Unlock()
+	s.mu.Lock()
+	cc.sanitize = hello.Sanitize
+	s.clientMu.Lock()
+	s.client = cc
+	s.clientMu.Unlock()
+
+	log.Printf("session %s: client connected (TERM=%s, protocol %d)", s.id, hello.Term, hello.Version)
+	s.writeEnvFile(hello)
+	s.attachedOnce.Do(func() { close(s.attached) })
+
+	// Replay the screen, unless asked not to
+	var redraw []byte
+	if !hello.NoRedraw {
+		redraw = s.redraw(cc)
+	}
+	s.mu.Unlock()
+	if redraw != nil {
+		cc.send(Message{Type: MsgData, Payload: redraw})
+	}
+	return true
+}
+
+// handleClient attaches a new connection and reads its messages.
+//
+// A client's first message is normally MsgHello with its attach options.
+// Clients that predate the handshake start straight in with other
+// messages; they attach with the defaults and that message is handled as
+// usual.
+func (s *Session) handleClient(cc *clientConn) {
+	r := bufio.NewReader(cc.conn)
+	msg, err := Decode(r)
+	if err != nil {
+		cc.close()
+		return
+	}
+	// Requests from commands like `mhist kill` or `mhist stat` are served
+	// without attaching, so they don't kick the current client. The
+	// connection can make several until it hangs up.
+	for isRequest(msg.Type) {
+		if !s.handleMessage(cc, msg) {
+			cc.close()
+			return
+		}
+		if msg, err = Decode(r); err != nil {
+			cc.close()
+			return
+		}
+	}
+
+	var hello Hello
+	if msg.Type == MsgHello {
+		if err := json.Unmarshal(msg.Payload, &hello); err != nil {
+			log.Printf("session %s: bad hello: %v", s.id, err)
+			cc.refuse(ErrorBadRequest, "bad hello: %v", err)
+			return
+		}
+	}
+
+	if !s.attach(cc, hello) {
+		// The writer closes the connection once the refusal is out
+		return
+	}
+	defer func() {
+		s.clientMu.Lock()
+		if s.client == cc {
+			s.client = nil
+		}
+		s.clientMu.Unlock()
+		cc.close()
+		log.Printf("session %s: client disconnected", s.id)
+	}()
+
+	if msg.Type != MsgHello && !s.handleMessage(cc, msg) {
+		return
+	}
+	for {
+		msg, err := Decode(r)
+		if err != nil {
+			return
+		}
+		if !s.handleMessage(cc, msg) {
+			return
+		}
+	}
+}
+
+// handleMessage acts on one message from the attached client. It returns
+// false when the client is done.
+func (s *Session) handleMessage(cc *clientConn, msg Message) bool {
+	switch msg.Type {
+	case MsgData, MsgInput:
+		s.markReady()
+		s.ptmx.Write(msg.Payload)
+
+	case MsgResize:
+		if len(msg.Payload) >= 4 {
+			rows := int(msg.Payload[0])<<8 | int(msg.Payload[1])
+			cols := int(msg.Payload[2])<<8 | int(msg.Payload[3])
+			if !validSize(rows, cols) {
+				// A 0x0 PTY is unusable; keep the last good size
+				break
+			}
+			// Under mu, so cleanup can't close the pty mid-ioctl
+			cc.queueMu.Lock()
+			s.mu.Lock()
+			changed := rows != s.lastRows || cols != s.lastCols
+			if changed {
+				s.lastRows, s.lastCols = rows, cols
+				// So a client that can't read its own size gets this one
+				if err := s.writeInfoFile(); err != nil && debug {
+					log.Printf("session %s: update info file: %v", s.id, err)
+				}
+			}
+			// A bigger terminal needs more output to fill its screen
+			s.growReplay(rows * cols * replayBytesPerCell)
+			if s.recorder != nil {
+				s.recorder.resize(rows, cols)
+			}
+			size := &pty.Winsize{Rows: uint16(rows), Cols: uint16(cols)}
+			select {
+			case <-s.ready:
+				pty.Setsize(s.ptmx, size)
+				s.notifyResize()
+			default:
+				s.pendingSize = size
+			}
+			// Redraw at the new size rather than leave a stale screen
+			// until the app repaints. A client's first resize follows
+			// its attach redraw, so it doesn't need another. Clients
+			// debounce resizes, so this comes once the size settles,
+			// and under queueMu it goes out before any repaint by the
+			// app.
+			var redraw []byte
+			if changed && cc.resized {
+				redraw = s.redraw(cc)
+			}
+			cc.resized = true
+			s.mu.Unlock()
+			if redraw != nil {
+				cc.send(Message{Type: MsgData, Payload: redraw})
+			}
+			cc.queueMu.Unlock()
+		}
+
+	case MsgDetach:
+		return false
+
+	case MsgKill:
+		s.kill()
+		return false
+
+	case MsgHistoryRequest:
+		s.handleHistoryRequest(cc, msg.Payload)
+
+	case MsgPromptsRequest:
+		s.handlePromptsRequest(cc)
+
+	case MsgClearHistory:
+		s.clearHistory()
+
+	case MsgStatsRequest:
+		s.handleStatsRequest(cc)
+
+	case MsgSignal:
+		s.signal(msg.Payload)
+
+	case MsgDetachAll:
+		s.detachClient()
+
+	default:
+		// From a newer client, or a sign the stream is out of step
+		if debug {
+			log.Printf("session %s: ignoring unexpected %s message (%d bytes)", s.id, msg.Type, len(msg.Payload))
+		}
+	}
+	return true
+}
+
+// redraw returns a replay of the current screen for cc, from the circular
+// buffer of raw PTY output, or nil if there is no output yet. The caller
+// must hold cc.queueMu and s.mu, and queue the replay before releasing
+// queueMu, so that output it covers isn't sent to cc again.
+func (s *Session) redraw(cc *clientConn) []byte {
+	cc.redrawn = s.outSeq
+	if s.rawLen == 0 {
+		return nil
+	}
+
+	// Only the last screen of output; more would scroll it off the top
+	raw, trimmed := s.replayBytes(), false
+	if s.lastRows > 0 {
+		raw, trimmed = lastScreen(raw, s.lastRows, s.screen.on)
+	}
+
+	// A full clear is only worth its flash when the replay covers the
+	// screen anyway; a short session just replays below the cursor. If
+	// the app owns the alternate screen, switch to it before clearing so
+	// the client's main screen is left alone.
+	var redraw []byte
+	if s.screen.on {
+		redraw = append(redraw, "\x1b[?1049h\x1b[2J\x1b[H"...)
+	} else if trimmed || s.lastRows <= 0 {
+		redraw = append(redraw, "\x1b[2J\x1b[H"...)
+	}
+	redraw = append(redraw, raw...)
+	if cc.sanitize {
+		redraw = sanitizeReplay(redraw)
+	}
+	return redraw
+}
+
+// replayBytes returns the contents of the replay buffer, oldest first.
+// The caller must hold s.mu.
+func (s *Session) replayBytes() []byte {
+	cap := len(s.rawBuf)
+	startPos := (s.rawHead - s.rawLen + cap) % cap
+	raw := make([]byte, s.rawLen)
+	for i := 0; i < s.rawLen; i++ {
+		raw[i] = s.rawBuf[(startPos+i)%cap]
+	}
+	return raw
+}
+
+// growReplay enlarges the replay buffer to n bytes, up to maxReplayBuffer,
+// keeping its contents. It never shrinks it, so output already kept for a
+// big terminal isn't lost when a smaller one attaches. The caller must
+// hold s.mu, unless the session isn't running yet.
+func (s *Session) growReplay(n int) {
+	n = min(n, maxReplayBuffer)
+	if n <= len(s.rawBuf) {
+		return
+	}
+	buf := make([]byte, n)
+	copy(buf, s.replayBytes())
+	s.rawBuf, s.rawHead = buf, s.rawLen
+}
+
+// maxHistoryPayload is the most line data a history response carries.
+const maxHistoryPayload = MaxPayload / 2
+
+// handleHistoryRequest responds to a client's history request.
+func (s *Session) handleHistoryRequest(cc *clientConn, payload []byte) {
+	if len(payload) < 8 {
+		return
+	}
+	rawOffset := binary.BigEndian.Uint32(payload[0:4])
+	count := int(binary.BigEndian.Uint32(payload[4:8]))
+	plain := len(payload) > 8 && payload[8]&historyPlain != 0
+
+	s.mu.Lock()
+	totalLines := s.buffer.Lines()
+	var start int
+	var lines [][]byte
+	switch fromEnd := int(rawOffset &^ historyFromEnd); {
+	case rawOffset&historyFromEnd == 0:
+		start = int(rawOffset)
+		lines = s.buffer.GetRange(start, count)
+	case fromEnd == 0:
+		// The last lines, as for a screen or a capture
+		lines = s.buffer.GetTail(count)
+		start = totalLines - len(lines)
+	default:
+		start = s.buffer.TailStart(fromEnd, count)
+		lines = s.buffer.GetRange(start, count)
+	}
+	partial := s.buffer.GetPartial()
+	raw := s.buffer.Raw()
+	s.mu.Unlock()
+
+	// Drop the oldest lines until the response fits in maxHistoryPayload,
+	// half of MaxPayload, leaving room for a copy of it to be pasted back
+	// with other input.
+	size := len(partial)
+	for _, line := range lines {
+		size += len(line) + len(crlf)
+	}
+	for len(lines) > 0 && size > maxHistoryPayload {
+		size -= len(lines[0]) + len(crlf)
+		lines = lines[1:]
+		start++
+	}
+
+	// Response: [startLine:4 BE][totalLines:4 BE][line data]. The lines
+	// are views into the buffer, which never rewrites stored bytes, so
+	// they are used outside mu, queued as they are and streamed to the
+	// client rather than copied into one payload. Queueing can wait on a
+	// client that has stopped reading, which must hold up only itself.
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header[0:4], uint32(start))
+	binary.BigEndian.PutUint32(header[4:8], uint32(totalLines))
+	parts := make([][]byte, 0, 2*len(lines)+2)
+	parts = append(parts, header)
+
+	// Raw scrollback is replayed as it was output, without line breaks.
+	// Plain text drops the carriage returns stored lines keep from the PTY.
+	sep := crlf
+	switch {
+	case raw:
+		sep = nil
+	case plain:
+		sep = lf
+	}
+	for i, line := range lines {
+		if plain {
+			line = bytes.TrimSuffix(line, cr)
+		}
+		parts = append(parts, line)
+		if i < len(lines)-1 && sep != nil {
+			parts = append(parts, sep)
+		}
+	}
+
+	// If the response includes the most recent lines, append the partial line (current prompt)
+	if start+len(lines) >= totalLines {
+		if partial != nil {
+			if plain {
+				partial = bytes.TrimSuffix(partial, cr)
+			}
+			if sep != nil {
+				parts = append(parts, sep)
+			}
+			parts = append(parts, partial)
+		}
+	}
+
+	if cc.sanitize {
+		lines := sanitizeReplay(bytes.Join(parts[1:], nil))
+		cc.send(Message{Type: MsgHistoryResponse, Payload: append(header, lines...)})
+		return
+	}
+	cc.sendParts(MsgHistoryResponse, parts)
+}
+
+// Line endings used in history responses
+var (
+	crlf = []byte("\r\n")
+	lf   = []byte("\n")
+	cr   = []byte("\r")
+)
+
+// isRequest reports whether t is a request that can be made without
+// attaching.
+func isRequest(t MsgType) bool {
+	switch t {
+	case MsgKill, MsgClearHistory, MsgStatsRequest, MsgHistoryRequest, MsgSignal, MsgInput,
+		MsgDetachAll:
+		return true
+	}
+	return false
+}
+
+// handleStatsRequest replies with a snapshot of the session's state.
+func (s *Session) handleStatsRequest(cc *clientConn) {
+	s.mu.Lock()
+	stats := Stats{
+		Lines:       s.buffer.Lines(),
+		Capacity:    s.buffer.Capacity(),
+		Bytes:       s.buffer.Bytes(),
+		ReplayBytes: s.rawLen,
+		Uptime:      int64(time.Since(s.created).Seconds()),
+	}
+	s.mu.Unlock()
+	s.clientMu.Lock()
+	stats.Attached = s.client != nil
+	s.clientMu.Unlock()
+
+	payload, _ := json.Marshal(stats)
+	cc.send(Message{Type: MsgStatsResponse, Payload: payload})
+}
+
+// signal sends the signal numbered by the payload to the shell, if it is
+// one a client may send.
+func (s *Session) signal(payload []byte) {
+	if len(payload) < 1 {
+		return
+	}
+	sig := syscall.Signal(payload[0])
+	if !knownSignal(sig) {
+		log.Printf("session %s: ignoring request for unknown signal %d", s.id, payload[0])
+		return
+	}
+	if s.cmd.Process == nil {
+		// A playback session has no shell
+		return
+	}
+	log.Printf("session %s: sending %v to the shell", s.id, sig)
+	s.cmd.Process.Signal(sig)
+}
+
+// detachClient drops the attached client, telling it why, and leaves the
+// session running for the next attach.
+func (s *Session) detachClient() {
+	s.clientMu.Lock()
+	defer s.clientMu.Unlock()
+	if s.client == nil {
+		return
+	}
+	log.Printf("session %s: detaching client on request", s.id)
+	s.client.kick(DetachRemote)
+	s.client = nil
+}
+
+// clearHistory wipes the scrollback and the replay buffer, e.g. after a
+// secret was printed, and clears the attached client's screen to match.
+func (s *Session) clearHistory() {
+	s.clientMu.Lock()
+	client := s.client
+	s.clientMu.Unlock()
+	if client != nil {
+		client.queueMu.Lock()
+		defer client.queueMu.Unlock()
+	}
+
+	s.mu.Lock()
+	if s.buffer.Raw() {
+		s.buffer = NewRawScrollbackBuffer(s.buffer.Capacity())
+	} else {
+		s.buffer = NewScrollbackBuffer(s.buffer.Capacity())
+	}
+	clear(s.rawBuf)
+	s.rawHead, s.rawLen = 0, 0
+	log.Printf("session %s: history cleared", s.id)
+	if client != nil {
+		// Output from before the clear isn't sent after it
+		client.redrawn = s.outSeq
+	}
+	s.mu.Unlock()
+
+	if client != nil {
+		// Clear the screen and the terminal's own scrollback
+		client.send(Message{Type: MsgData, Payload: []byte("\x1b[H\x1b[2J\x1b[3J")})
+	}
+}
+
+// handlePromptsRequest tells the client which scrollback lines start a
+// shell prompt. Response: [totalLines:4 BE] then [line:4 BE] per prompt,
+// oldest first, using the same line numbers as history responses.
+func (s *Session) handlePromptsRequest(cc *clientConn) {
+	s.mu.Lock()
+	total := s.buffer.Lines()
+	prompts := s.buffer.Prompts()
+	s.mu.Unlock()
+
+	payload := make([]byte, 4+4*len(prompts))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(total))
+	for i, p := range prompts {
+		binary.BigEndian.PutUint32(payload[4+4*i:], uint32(p))
+	}
+	cc.send(Message{Type: MsgPromptsResponse, Payload: payload})
+}
+
+// kill ends the session's process. A playback session has none, so its
+// output pipe is closed instead, which ends readPTY the same way.
+func (s *Session) kill() {
+	if s.cmd.Process != nil {
+		s.cmd.Process.Kill()
+	} else if s.player != nil {
+		s.player.Close()
+	}
+}
+
+// Close shuts the session down without running it, removing its socket and
+// info files. Use it to abandon a session whose setup failed after NewSession.
+func (s *Session) Close() {
+	s.kill()
+	s.cleanup()
+}
+
+// cleanup removes socket and info files and reaps the child process.
+func (s *Session) cleanup() {
+	s.clientMu.Lock()
+	if s.client != nil {
+		s.client.close()
+		s.client = nil
+	}
+	s.clientMu.Unlock()
+
+	s.listener.Close()
+	for _, l := range s.extra {
+		l.Close()
+	}
+	s.mu.Lock()
+	s.ptmx.Close()
+	s.mu.Unlock()
+	s.cmd.Wait() // reap child process
+	s.mu.Lock()
+	if s.recorder != nil {
+		s.recorder.close()
+		s.recorder = nil
+	}
+	if s.transcript != nil {
+		s.transcript.close()
+		s.transcript = nil
+	}
+	s.mu.Unlock()
+	os.Remove(s.socketPath)
+	FileStore{}.Delete(s.id)
+	os.Remove(s.envPath)
+	close(s.closed)
+	log.Printf("session %s: cleaned up", s.id)
+}
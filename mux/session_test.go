@@ -0,0 +1,1059 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/creack/pty"
+)
+
+// startTestSession creates a session running sh in a temporary socket dir
+// and runs it in the background. The session is killed when the test ends.
+func startTestSession(t *testing.T) *Session {
+	t.Helper()
+	return startTestSessionWith(t, SessionOptions{Shell: "/bin/sh"})
+}
+
+// startTestSessionWith is startTestSession with the given options.
+func startTestSessionWith(t *testing.T, opts SessionOptions) *Session {
+	t.Helper()
+	// A directory of its own, so ListSessions doesn't find real sessions
+	t.Setenv("MHIST_SOCKET_DIR", t.TempDir())
+
+	s, err := NewSession(GenerateID(), "test", opts)
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		s.Run()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		if s.cmd.Process != nil {
+			s.cmd.Process.Kill()
+		}
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Error("session did not shut down")
+		}
+	})
+	return s
+}
+
+// listenFake listens on a Unix socket at path until the test ends, so a
+// fake session there passes IsSessionAlive.
+func listenFake(t *testing.T, path string) {
+	t.Helper()
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+}
+
+// historyRequest builds a "from end" history request payload.
+func historyRequest(fromEnd, count int) []byte {
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint32(payload[0:4], historyFromEnd|uint32(fromEnd))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(count))
+	return payload
+}
+
+func TestSessionConcurrentWritesStayFramed(t *testing.T) {
+	s := startTestSession(t)
+
+	conn, err := net.Dial("unix", s.socketPath)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	// Flood output from the shell while hammering the session with history
+	// requests, so PTY data and history responses are written concurrently.
+	cmd := "i=0; while [ $i -lt 3000 ]; do echo line-$i-xxxxxxxxxxxxxxxxxxxxxxxx; i=$((i+1)); done; echo FLOOD-$((1+1))\n"
+	conn.Write(Encode(Message{Type: MsgData, Payload: []byte(cmd)}))
+	go func() {
+		for i := 0; i < 200; i++ {
+			if _, err := conn.Write(Encode(Message{Type: MsgHistoryRequest, Payload: historyRequest(i, 50)})); err != nil {
+				return
+			}
+		}
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var tail []byte
+	responses := 0
+	for responses < 200 || !containsMarker(tail) {
+		msg, err := Decode(conn)
+		if err != nil {
+			t.Fatalf("decode after %d responses: %v", responses, err)
+		}
+		switch msg.Type {
+		case MsgData:
+			tail = append(tail, msg.Payload...)
+			if len(tail) > 64 {
+				tail = tail[len(tail)-64:]
+			}
+		case MsgHistoryResponse:
+			if len(msg.Payload) < 8 {
+				t.Fatalf("short history response: %d bytes", len(msg.Payload))
+			}
+			responses++
+		default:
+			t.Fatalf("unexpected message type %v (framing desync)", msg.Type)
+		}
+	}
+}
+
+func TestSessionAttachWhileFlooding(t *testing.T) {
+	s := startTestSession(t)
+
+	first, err := net.Dial("unix", s.socketPath)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer first.Close()
+	first.Write(Encode(Message{Type: MsgData, Payload: []byte("yes flood | head -n 1000000\n")}))
+
+	// Wait until the flood is running before reattaching.
+	first.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for received := 0; received < 4096; {
+		msg, err := Decode(first)
+		if err != nil {
+			t.Fatalf("waiting for flood: %v", err)
+		}
+		received += len(msg.Payload)
+	}
+
+	// Reattach repeatedly while output is streaming; each new client must
+	// receive a well-formed stream.
+	for i := 0; i < 5; i++ {
+		conn, err := net.Dial("unix", s.socketPath)
+		if err != nil {
+			t.Fatalf("dial %d: %v", i, err)
+		}
+		conn.Write(Encode(Hello{}.message()))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for j := 0; j < 20; j++ {
+			msg, err := Decode(conn)
+			if err != nil {
+				break
+			}
+			if msg.Type != MsgData {
+				t.Fatalf("attach %d: unexpected message type %v", i, msg.Type)
+			}
+		}
+		conn.Close()
+	}
+}
+
+// readUntil reads session output from conn until it contains want and
+// returns everything read.
+func readUntil(t *testing.T, conn net.Conn, want string) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var out []byte
+	for !strings.Contains(string(out), want) {
+		msg, err := Decode(conn)
+		if err != nil {
+			t.Fatalf("waiting for %q: %v; output so far %q", want, err, out)
+		}
+		if msg.Type == MsgData {
+			out = append(out, msg.Payload...)
+		}
+	}
+	return string(out)
+}
+
+func containsMarker(b []byte) bool {
+	return bytes.Contains(b, []byte("FLOOD-2\r\n"))
+}
+
+func TestResolveShell(t *testing.T) {
+	if _, err := ResolveShell("/no/such/shell"); err == nil {
+		t.Error("expected error for missing shell")
+	}
+
+	notExec := filepath.Join(t.TempDir(), "shell")
+	os.WriteFile(notExec, []byte("#!/bin/sh\n"), 0644)
+	if _, err := ResolveShell(notExec); err == nil {
+		t.Error("expected error for non-executable shell")
+	}
+
+	if _, err := ResolveShell(t.TempDir()); err == nil {
+		t.Error("expected error for a directory")
+	}
+
+	path, err := ResolveShell("sh")
+	if err != nil {
+		t.Fatalf("ResolveShell(sh): %v", err)
+	}
+	if !filepath.IsAbs(path) {
+		t.Errorf("expected absolute path, got %q", path)
+	}
+
+	t.Setenv("SHELL", "")
+	if path, err := ResolveShell(""); err != nil || path != "/bin/sh" {
+		t.Errorf("default shell: got %q, %v", path, err)
+	}
+}
+
+func TestShellCommandLogin(t *testing.T) {
+	tests := []struct {
+		shell string
+		login bool
+		want  []string
+	}{
+		{"/bin/bash", false, []string{"/bin/bash"}},
+		{"/bin/bash", true, []string{"-bash", "-l"}},
+		{"/usr/bin/zsh", true, []string{"-zsh", "-l"}},
+		{"/usr/bin/fish", true, []string{"-fish", "--login"}},
+		{"/opt/bin/myshell", true, []string{"-myshell"}},
+	}
+	for _, tt := range tests {
+		cmd := shellCommand(tt.shell, tt.login)
+		if cmd.Path != tt.shell {
+			t.Errorf("%s: path = %q", tt.shell, cmd.Path)
+		}
+		if fmt.Sprint(cmd.Args) != fmt.Sprint(tt.want) {
+			t.Errorf("shellCommand(%q, %v) args = %q, want %q", tt.shell, tt.login, cmd.Args, tt.want)
+		}
+	}
+}
+
+func TestSessionIgnoresInvalidResize(t *testing.T) {
+	s := startTestSession(t)
+
+	conn, err := net.Dial("unix", s.socketPath)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	resize := func(rows, cols uint16) {
+		payload := make([]byte, 4)
+		binary.BigEndian.PutUint16(payload[0:2], rows)
+		binary.BigEndian.PutUint16(payload[2:4], cols)
+		conn.Write(Encode(Message{Type: MsgResize, Payload: payload}))
+	}
+	resize(30, 100)
+	resize(0, 0)
+	resize(5000, 80)
+	conn.Write(Encode(Message{Type: MsgData, Payload: []byte("stty size\n")}))
+	readUntil(t, conn, "30 100")
+}
+
+func TestSessionNoRedraw(t *testing.T) {
+	s := startTestSession(t)
+
+	first, err := net.Dial("unix", s.socketPath)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	first.Write(Encode(Hello{}.message()))
+	first.Write(Encode(Message{Type: MsgData, Payload: []byte("echo old-$((1+1))\n")}))
+	readUntil(t, first, "old-2")
+	first.Close()
+
+	conn, err := net.Dial("unix", s.socketPath)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.Write(Encode(Hello{NoRedraw: true}.message()))
+	conn.Write(Encode(Message{Type: MsgData, Payload: []byte("echo new-$((1+1))\n")}))
+	if out := readUntil(t, conn, "new-2"); strings.Contains(out, "old-2") {
+		t.Errorf("screen was replayed despite no_redraw: %q", out)
+	}
+}
+
+func TestSessionInitialSize(t *testing.T) {
+	s := startTestSessionWith(t, SessionOptions{Shell: "/bin/sh", Rows: 30, Cols: 100})
+
+	// No resize is sent; the shell already has the creator's size
+	conn, err := net.Dial("unix", s.socketPath)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.Write(Encode(Hello{}.message()))
+	conn.Write(Encode(Message{Type: MsgData, Payload: []byte("stty size\n")}))
+	readUntil(t, conn, "30 100")
+}
+
+func TestSessionEnvFile(t *testing.T) {
+	s := startTestSession(t)
+
+	conn, err := net.Dial("unix", s.socketPath)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.Write(Encode(Hello{Term: "xterm-256color", ColorTerm: "truecolor"}.message()))
+	conn.Write(Encode(Message{Type: MsgData, Payload: []byte(`. "$MHIST_ENV_FILE"; echo "term=$TERM,$COLORTERM"` + "\n")}))
+	readUntil(t, conn, "term=xterm-256color,truecolor")
+}
+
+func TestSessionHistoryResponse(t *testing.T) {
+	s := startTestSession(t)
+
+	conn, err := net.Dial("unix", s.socketPath)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.Write(Encode(Hello{NoRedraw: true}.message()))
+	conn.Write(Encode(Message{Type: MsgData, Payload: []byte("i=0; while [ $i -lt 500 ]; do echo line-$i; i=$((i+1)); done\n")}))
+	readUntil(t, conn, "line-499\r\n")
+	conn.Write(Encode(Message{Type: MsgHistoryRequest, Payload: historyRequest(0, 3)}))
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		msg, err := Decode(conn)
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if msg.Type != MsgHistoryResponse {
+			continue
+		}
+		if start, total := binary.BigEndian.Uint32(msg.Payload[0:4]), binary.BigEndian.Uint32(msg.Payload[4:8]); total < 500 || start != total-3 {
+			t.Errorf("start %d, total %d", start, total)
+		}
+		// Stored lines keep the PTY's \r; the response joins them with \r\n
+		lines := string(msg.Payload[8:])
+		if !strings.HasPrefix(lines, "line-497\r\r\nline-498\r\r\nline-499\r\r\n") {
+			t.Errorf("lines = %q", lines)
+		}
+		break
+	}
+
+	// Asked for plain text, the lines end in \n alone
+	conn.Write(Encode(Message{Type: MsgHistoryRequest, Payload: append(historyRequest(0, 3), historyPlain)}))
+	for {
+		msg, err := Decode(conn)
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if msg.Type != MsgHistoryResponse {
+			continue
+		}
+		if lines := string(msg.Payload[8:]); !strings.HasPrefix(lines, "line-497\nline-498\nline-499\n") || strings.Contains(lines, "\r") {
+			t.Errorf("plain lines = %q", lines)
+		}
+		return
+	}
+}
+
+func TestSessionDetachAll(t *testing.T) {
+	s := startTestSession(t)
+	info := SessionInfo{Socket: s.socketPath}
+
+	conn, err := net.Dial("unix", s.socketPath)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.Write(Encode(Hello{}.message()))
+	conn.Write(Encode(Message{Type: MsgData, Payload: []byte("echo here-$((1+1))\n")}))
+	readUntil(t, conn, "here-2")
+
+	if err := DetachSession(info); err != nil {
+		t.Fatalf("DetachSession: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		msg, err := Decode(conn)
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if msg.Type != MsgDetach {
+			continue
+		}
+		if len(msg.Payload) != 1 || DetachReason(msg.Payload[0]) != DetachRemote {
+			t.Errorf("detach payload = %v, want DetachRemote", msg.Payload)
+		}
+		break
+	}
+
+	// The session carries on, with nobody attached
+	stats, err := QueryStats(info)
+	if err != nil {
+		t.Fatalf("QueryStats: %v", err)
+	}
+	if stats.Attached {
+		t.Error("still attached after DetachSession")
+	}
+	if err := DetachSession(info); err != nil {
+		t.Errorf("DetachSession with no client: %v", err)
+	}
+}
+
+func TestSessionClipboard(t *testing.T) {
+	const osc52 = "\x1b]52;c;aGk=\x07"
+	printf := []byte(`printf '\033]52;c;aGk=\007clip-%s\n' $((1+1))` + "\n")
+	for _, deny := range []bool{false, true} {
+		s := startTestSessionWith(t, SessionOptions{Shell: "/bin/sh", NoClipboard: deny})
+		conn, err := net.Dial("unix", s.socketPath)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer conn.Close()
+		conn.Write(Encode(Hello{}.message()))
+		conn.Write(Encode(Message{Type: MsgData, Payload: printf}))
+
+		// The attached client gets the clipboard write unless denied
+		out := readUntil(t, conn, "clip-2\r\n")
+		if got := strings.Contains(out, osc52); got == deny {
+			t.Errorf("NoClipboard %v: client saw OSC 52 = %v in %q", deny, got, out)
+		}
+
+		// Scrollback never keeps it
+		conn.Write(Encode(Message{Type: MsgHistoryRequest, Payload: historyRequest(0, 10)}))
+		for {
+			msg, err := Decode(conn)
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if msg.Type != MsgHistoryResponse {
+				continue
+			}
+			if lines := string(msg.Payload[8:]); !strings.Contains(lines, "clip-2") || strings.Contains(lines, "\x1b]52") {
+				t.Errorf("NoClipboard %v: history = %q", deny, lines)
+			}
+			break
+		}
+	}
+}
+
+func TestSessionSanitize(t *testing.T) {
+	s := startTestSessionWith(t, SessionOptions{Shell: "/bin/sh"})
+	conn, err := net.Dial("unix", s.socketPath)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.Write(Encode(Hello{}.message()))
+	conn.Write(Encode(Message{Type: MsgData, Payload: []byte(`printf '\033]0;pwned\007\033[1mbold-%s\033[0m\n' $((1+1))` + "\n")}))
+	readUntil(t, conn, "bold-2")
+
+	// A sanitizing client gets the redraw and history without the title
+	conn2, err := net.Dial("unix", s.socketPath)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn2.Close()
+	conn2.Write(Encode(Hello{Sanitize: true}.message()))
+	if out := readUntil(t, conn2, "bold-2"); strings.Contains(out, "\x1b]0;") || !strings.Contains(out, "\x1b[1mbold-2") {
+		t.Errorf("redraw = %q", out)
+	}
+	conn2.Write(Encode(Message{Type: MsgHistoryRequest, Payload: historyRequest(0, 10)}))
+	for {
+		msg, err := Decode(conn2)
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if msg.Type != MsgHistoryResponse {
+			continue
+		}
+		if lines := string(msg.Payload[8:]); strings.Contains(lines, "\x1b]0;") || !strings.Contains(lines, "\x1b[1mbold-2") {
+			t.Errorf("history = %q", lines)
+		}
+		break
+	}
+}
+
+func TestSessionBadHello(t *testing.T) {
+	s := startTestSession(t)
+	conn, err := net.Dial("unix", s.socketPath)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.Write(Encode(Message{Type: MsgHello, Payload: []byte("{not json")}))
+
+	// The refusal comes as an error message, then the session hangs up
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msg, err := Decode(conn)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if msg.Type != MsgError {
+		t.Fatalf("got %s, want error", msg.Type)
+	}
+	if e := parseSessionError(msg.Payload); e.Code != ErrorBadRequest || !strings.Contains(e.Message, "bad hello") {
+		t.Errorf("error = %+v", e)
+	}
+	if _, err := Decode(conn); err == nil {
+		t.Error("connection still open after the error")
+	}
+}
+
+func TestSessionClearHistory(t *testing.T) {
+	s := startTestSession(t)
+
+	conn, err := net.Dial("unix", s.socketPath)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.Write(Encode(Hello{}.message()))
+	conn.Write(Encode(Message{Type: MsgData, Payload: []byte("echo secret-$((1+1))\n")}))
+	readUntil(t, conn, "secret-2")
+
+	if err := ClearSessionHistory(SessionInfo{Socket: s.socketPath}); err != nil {
+		t.Fatalf("ClearSessionHistory: %v", err)
+	}
+	// The attached client stays attached and has its screen cleared
+	readUntil(t, conn, "\x1b[3J")
+
+	conn.Write(Encode(Message{Type: MsgHistoryRequest, Payload: historyRequest(0, 100)}))
+	for {
+		msg, err := Decode(conn)
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if msg.Type != MsgHistoryResponse {
+			continue
+		}
+		if strings.Contains(string(msg.Payload), "secret-2") {
+			t.Errorf("history still has the secret: %q", msg.Payload)
+		}
+		break
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rawLen != 0 || strings.Contains(string(s.rawBuf), "secret-2") {
+		t.Error("replay buffer not wiped")
+	}
+}
+
+func TestSessionStats(t *testing.T) {
+	s := startTestSession(t)
+	info := SessionInfo{Socket: s.socketPath}
+
+	stats, err := QueryStats(info)
+	if err != nil {
+		t.Fatalf("QueryStats: %v", err)
+	}
+	if stats.Attached || stats.Capacity != 10000 {
+		t.Errorf("fresh session stats = %+v", stats)
+	}
+
+	conn, err := net.Dial("unix", s.socketPath)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.Write(Encode(Hello{}.message()))
+	conn.Write(Encode(Message{Type: MsgData, Payload: []byte("echo stats-$((1+1))\n")}))
+	readUntil(t, conn, "stats-2")
+
+	// Querying doesn't kick the attached client
+	stats, err = QueryStats(info)
+	if err != nil {
+		t.Fatalf("QueryStats: %v", err)
+	}
+	if !stats.Attached || stats.Lines == 0 || stats.Bytes == 0 || stats.ReplayBytes == 0 {
+		t.Errorf("stats after output = %+v", stats)
+	}
+	conn.Write(Encode(Message{Type: MsgData, Payload: []byte("echo still-$((1+1))\n")}))
+	readUntil(t, conn, "still-2")
+}
+
+func TestSessionStalledClient(t *testing.T) {
+	s := startTestSession(t)
+	info := SessionInfo{Socket: s.socketPath}
+
+	// An attached client that stops reading while output pours out
+	conn, err := net.Dial("unix", s.socketPath)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.Write(Encode(Hello{}.message()))
+	conn.Write(Encode(Message{Type: MsgData, Payload: []byte("yes stalled\n")}))
+	time.Sleep(500 * time.Millisecond)
+
+	// Only the PTY reader waits on it
+	if _, err := QueryHistory(info, 3, 2*time.Second); err != nil {
+		t.Fatalf("QueryHistory with a stalled client: %v", err)
+	}
+
+	// As does its own redraw for a resize, and its history request
+	resize := func(rows, cols uint16) {
+		payload := make([]byte, 4)
+		binary.BigEndian.PutUint16(payload[0:2], rows)
+		binary.BigEndian.PutUint16(payload[2:4], cols)
+		conn.Write(Encode(Message{Type: MsgResize, Payload: payload}))
+	}
+	resize(30, 100)
+	resize(40, 120)
+	conn.Write(Encode(Message{Type: MsgHistoryRequest, Payload: historyRequest(0, 1000)}))
+	time.Sleep(200 * time.Millisecond)
+	if _, err := QueryHistory(info, 3, 2*time.Second); err != nil {
+		t.Fatalf("QueryHistory after the stalled client resized: %v", err)
+	}
+
+	// A new client takes over and gets output
+	other, err := net.Dial("unix", s.socketPath)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer other.Close()
+	other.Write(Encode(Hello{}.message()))
+	other.Write(Encode(Message{Type: MsgData, Payload: []byte("\x03echo taken-$((1+1))\n")}))
+	readUntil(t, other, "taken-2")
+}
+
+func TestSessionQueryHistory(t *testing.T) {
+	s := startTestSession(t)
+	info := SessionInfo{Socket: s.socketPath}
+
+	conn, err := net.Dial("unix", s.socketPath)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.Write(Encode(Hello{}.message()))
+	conn.Write(Encode(Message{Type: MsgData, Payload: []byte("for i in 1 2 3 4; do echo row-$i; done\n")}))
+	readUntil(t, conn, "row-4")
+
+	// The last two lines and the prompt, without kicking the client
+	lines, err := QueryHistory(info, 3, time.Second)
+	if err != nil {
+		t.Fatalf("QueryHistory: %v", err)
+	}
+	if len(lines) != 3 || string(lines[1]) != "row-4" {
+		t.Errorf("QueryHistory = %q, want row-3, row-4 and the prompt", lines)
+	}
+	// Raw, the lines come as a client would replay them, with the prompt
+	// on top of the 3 asked for
+	data, err := QueryRawHistory(info, 3, time.Second)
+	if err != nil {
+		t.Fatalf("QueryRawHistory: %v", err)
+	}
+	if !strings.HasPrefix(string(data), "row-2\r\r\nrow-3\r\r\nrow-4\r\r\n") {
+		t.Errorf("QueryRawHistory = %q, want row-2 to row-4 and the prompt", data)
+	}
+	conn.Write(Encode(Message{Type: MsgData, Payload: []byte("echo still-$((1+1))\n")}))
+	readUntil(t, conn, "still-2")
+}
+
+func TestListSessionsOrphanLogs(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("MHIST_SOCKET_DIR", dir)
+	old := time.Now().Add(-orphanLogAge - time.Hour)
+
+	// A crashed session's log is kept for a while, a running one's always
+	for _, name := range []string{"gone.log", "recent.log", "live.log"} {
+		os.WriteFile(filepath.Join(dir, name), []byte("log\n"), 0600)
+	}
+	os.Chtimes(filepath.Join(dir, "gone.log"), old, old)
+	os.Chtimes(filepath.Join(dir, "live.log"), old, old)
+	sock := filepath.Join(dir, "live.sock")
+	listenFake(t, sock)
+	info, _ := json.Marshal(SessionInfo{ID: "live", PID: os.Getpid(), Socket: sock})
+	os.WriteFile(filepath.Join(dir, "live.json"), info, 0600)
+
+	ListSessions()
+	for name, want := range map[string]bool{"gone.log": false, "recent.log": true, "live.log": true} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if got := err == nil; got != want {
+			t.Errorf("%s kept = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestListSessionsFallbackDirs(t *testing.T) {
+	t.Setenv("MHIST_SOCKET_DIR", "")
+	t.Setenv("XDG_RUNTIME_DIR", "")
+	fallback := SocketDir()
+
+	// A session started where $XDG_RUNTIME_DIR wasn't set is still found
+	// from an environment where it is
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	dirs := socketDirs()
+	if dirs[0] != SocketDir() || !slices.Contains(dirs, fallback) {
+		t.Errorf("socketDirs() = %q, want %s first and %s among them", dirs, SocketDir(), fallback)
+	}
+
+	t.Setenv("MHIST_SOCKET_DIR", "/srv/mhist")
+	if dirs := socketDirs(); len(dirs) != 1 || dirs[0] != "/srv/mhist" {
+		t.Errorf("with MHIST_SOCKET_DIR, socketDirs() = %q", dirs)
+	}
+}
+
+func TestIsSessionAlive(t *testing.T) {
+	dir := t.TempDir()
+	info := SessionInfo{PID: os.Getpid(), Socket: filepath.Join(dir, "s.sock")}
+	if IsSessionAlive(info) {
+		t.Error("alive with no socket")
+	}
+
+	l, err := net.Listen("unix", info.Socket)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	if !IsSessionAlive(info) {
+		t.Error("not alive while listening")
+	}
+	// Keep the socket file, as a session killed with SIGKILL would
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	if IsSessionAlive(info) {
+		t.Error("alive with a socket that refuses connections")
+	}
+}
+
+func TestSessionDropsClientOnWriteError(t *testing.T) {
+	s := startTestSession(t)
+	conn, err := net.Dial("unix", s.socketPath)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.Write(Encode(Hello{}.message()))
+	conn.Write(Encode(Message{Type: MsgData, Payload: []byte("echo ready-$((1+1))\n")}))
+	readUntil(t, conn, "ready-2")
+
+	// Make the session's next write to the client fail
+	s.clientMu.Lock()
+	cc := s.client
+	s.clientMu.Unlock()
+	cc.conn.SetWriteDeadline(time.Now())
+
+	attached := func() bool {
+		s.clientMu.Lock()
+		defer s.clientMu.Unlock()
+		return s.client != nil
+	}
+	for i := 0; attached() && i < 50; i++ {
+		conn.Write(Encode(Message{Type: MsgData, Payload: []byte("echo more\n")}))
+		time.Sleep(20 * time.Millisecond)
+	}
+	if attached() {
+		t.Fatal("client still attached after failed writes")
+	}
+
+	// The connection was closed, and the slot is free for a new client
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(io.Discard, conn); err != nil {
+		t.Errorf("read after drop: %v, want EOF", err)
+	}
+	conn2, err := net.Dial("unix", s.socketPath)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn2.Close()
+	conn2.Write(Encode(Hello{}.message()))
+	conn2.Write(Encode(Message{Type: MsgData, Payload: []byte("echo again-$((1+1))\n")}))
+	readUntil(t, conn2, "again-2")
+}
+
+func TestSessionUnknownMessage(t *testing.T) {
+	var logs syncBuffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	debug = true
+	defer func() { debug = false }()
+
+	s := startTestSession(t)
+	conn, err := net.Dial("unix", s.socketPath)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.Write(Encode(Hello{}.message()))
+	conn.Write(Encode(Message{Type: MsgType(0x7f), Payload: []byte("??")}))
+
+	// Ignored, and the connection carries on
+	conn.Write(Encode(Message{Type: MsgData, Payload: []byte("echo after-$((1+1))\n")}))
+	readUntil(t, conn, "after-2")
+	if !strings.Contains(logs.String(), "ignoring unexpected type(0x7f) message (2 bytes)") {
+		t.Errorf("unknown type not logged: %q", logs.String())
+	}
+}
+
+func TestSessionShellStartFailure(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("MHIST_SOCKET_DIR", dir)
+
+	// Executable, but not something the kernel can run
+	shell := filepath.Join(t.TempDir(), "garbage")
+	os.WriteFile(shell, []byte{0x7f, 'E', 'L', 'F', 0, 0, 0, 0}, 0755)
+
+	_, err := NewSession(GenerateID(), "test", SessionOptions{Shell: shell})
+	if err == nil || !strings.Contains(err.Error(), "start shell "+shell) {
+		t.Fatalf("NewSession: got %v, want an error naming the shell", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) > 0 {
+		t.Errorf("files left behind: %v", entries)
+	}
+}
+
+func TestSessionSetupFailureCleanup(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("MHIST_SOCKET_DIR", dir)
+
+	// A directory where the info file goes makes writing it fail after
+	// the shell has started and the socket is listening
+	id := GenerateID()
+	os.Mkdir(filepath.Join(dir, id+".json"), 0700)
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := NewSession(id, "test", SessionOptions{Shell: "/bin/sh"})
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		if err == nil || !strings.Contains(err.Error(), "write info file") {
+			t.Errorf("NewSession: got %v, want an info file error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("NewSession did not return")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) > 0 {
+		t.Errorf("files left behind: %v", entries)
+	}
+}
+
+func TestSessionResizeSignalsSameSize(t *testing.T) {
+	s := startTestSessionWith(t, SessionOptions{Shell: "/bin/sh", Rows: 30, Cols: 100})
+	conn, err := net.Dial("unix", s.socketPath)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.Write(Encode(Hello{}.message()))
+	conn.Write(Encode(Message{Type: MsgData, Payload: []byte("trap 'echo winch-$((6*7))' WINCH; echo trap-$((1+1))\n")}))
+	readUntil(t, conn, "trap-2")
+
+	// The size doesn't change, so only the session signals the shell
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint16(payload[0:2], 30)
+	binary.BigEndian.PutUint16(payload[2:4], 100)
+	conn.Write(Encode(Message{Type: MsgResize, Payload: payload}))
+	conn.Write(Encode(Message{Type: MsgData, Payload: []byte("\n")}))
+	readUntil(t, conn, "winch-42")
+}
+
+func TestSessionSendInput(t *testing.T) {
+	s := startTestSession(t)
+	conn, err := net.Dial("unix", s.socketPath)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.Write(Encode(Hello{}.message()))
+
+	// Typed from outside; the attached client sees it run
+	if err := SendInput(SessionInfo{Socket: s.socketPath}, []byte("echo sent-$((6*7))\r")); err != nil {
+		t.Fatalf("SendInput: %v", err)
+	}
+	readUntil(t, conn, "sent-42")
+}
+
+func TestSessionRawHistoryResponse(t *testing.T) {
+	s := startTestSessionWith(t, SessionOptions{Shell: "/bin/sh", RawScrollback: true})
+
+	conn, err := net.Dial("unix", s.socketPath)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.Write(Encode(Hello{NoRedraw: true}.message()))
+	conn.Write(Encode(Message{Type: MsgData, Payload: []byte("printf 'raw-%s\\n' 1 2 3 4 5 6 7 8 9\n")}))
+	readUntil(t, conn, "raw-9\r\n")
+	conn.Write(Encode(Message{Type: MsgHistoryRequest, Payload: historyRequest(0, 1000)}))
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		msg, err := Decode(conn)
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if msg.Type != MsgHistoryResponse {
+			continue
+		}
+		// The output comes back exactly as the pty wrote it
+		if out := string(msg.Payload[8:]); !strings.Contains(out, "raw-1\r\nraw-2\r\nraw-3\r\n") {
+			t.Errorf("raw history = %q", out)
+		}
+		return
+	}
+}
+
+func TestSessionGrowReplay(t *testing.T) {
+	s := &Session{rawBuf: make([]byte, 4)}
+	// Wrapped: holds "cdef" with the head in the middle
+	copy(s.rawBuf, "efcd")
+	s.rawHead, s.rawLen = 2, 4
+
+	s.growReplay(2)
+	if len(s.rawBuf) != 4 {
+		t.Fatalf("shrank to %d bytes", len(s.rawBuf))
+	}
+	s.growReplay(100 * 300 * replayBytesPerCell)
+	if len(s.rawBuf) != 100*300*replayBytesPerCell {
+		t.Fatalf("len = %d after growing for a 100x300 terminal", len(s.rawBuf))
+	}
+	if got := string(s.replayBytes()); got != "cdef" {
+		t.Errorf("replay after growing = %q, want cdef", got)
+	}
+	s.growReplay(1 << 30)
+	if len(s.rawBuf) != maxReplayBuffer {
+		t.Errorf("len = %d, want capped at %d", len(s.rawBuf), maxReplayBuffer)
+	}
+}
+
+func TestSessionRedrawOneScreen(t *testing.T) {
+	s := startTestSessionWith(t, SessionOptions{Shell: "/bin/sh", Rows: 10, Cols: 80})
+
+	first, err := net.Dial("unix", s.socketPath)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	first.Write(Encode(Hello{}.message()))
+	first.Write(Encode(Message{Type: MsgData, Payload: []byte("i=0; while [ $i -lt 50 ]; do echo row-$i; i=$((i+1)); done\n")}))
+	readUntil(t, first, "row-49\r\n")
+	first.Close()
+
+	conn, err := net.Dial("unix", s.socketPath)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.Write(Encode(Hello{}.message()))
+	out := readUntil(t, conn, "row-49\r\n")
+	if strings.Contains(out, "row-40\r\n") || !strings.Contains(out, "row-41\r\n") {
+		t.Errorf("redraw is not the last 10 rows: %q", out)
+	}
+}
+
+func TestSessionInfoSize(t *testing.T) {
+	s := startTestSessionWith(t, SessionOptions{Shell: "/bin/sh", Rows: 30, Cols: 100})
+	if info, ok := (FileStore{}).Get(s.id); !ok || info.Rows != 30 || info.Cols != 100 {
+		t.Fatalf("info = %+v, %v; want 30x100", info, ok)
+	}
+
+	conn, err := net.Dial("unix", s.socketPath)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.Write(Encode(Hello{}.message()))
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint16(payload[0:2], 40)
+	binary.BigEndian.PutUint16(payload[2:4], 120)
+	conn.Write(Encode(Message{Type: MsgResize, Payload: payload}))
+	conn.Write(Encode(Message{Type: MsgData, Payload: []byte("stty size\n")}))
+	readUntil(t, conn, "40 120")
+
+	if info, _ := (FileStore{}).Get(s.id); info.Rows != 40 || info.Cols != 120 {
+		t.Errorf("after resize: info size %dx%d, want 40x120", info.Rows, info.Cols)
+	}
+}
+
+func TestSessionResizeWhileStarting(t *testing.T) {
+	s := startTestSessionWith(t, SessionOptions{Shell: "/bin/sh", Rows: 30, Cols: 100})
+	conn, err := net.Dial("unix", s.socketPath)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.Write(Encode(Hello{}.message()))
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint16(payload[0:2], 40)
+	binary.BigEndian.PutUint16(payload[2:4], 120)
+	conn.Write(Encode(Message{Type: MsgResize, Payload: payload}))
+
+	// A resize that comes while the shell starts up is held back, not
+	// lost: the pty has the size once the shell is ready
+	select {
+	case <-s.ready:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session never became ready")
+	}
+	waitFor(t, "resize", func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		rows, cols, err := pty.Getsize(s.ptmx)
+		return err == nil && rows == 40 && cols == 120
+	})
+}
+
+func TestSessionRedrawOnResize(t *testing.T) {
+	s := startTestSessionWith(t, SessionOptions{Shell: "/bin/sh", Rows: 30, Cols: 100})
+	conn, err := net.Dial("unix", s.socketPath)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	resize := func(rows, cols int) {
+		payload := make([]byte, 4)
+		binary.BigEndian.PutUint16(payload[0:2], uint16(rows))
+		binary.BigEndian.PutUint16(payload[2:4], uint16(cols))
+		conn.Write(Encode(Message{Type: MsgResize, Payload: payload}))
+	}
+	conn.Write(Encode(Hello{NoRedraw: true}.message()))
+	resize(24, 80)
+	conn.Write(Encode(Message{Type: MsgData, Payload: []byte("echo mark-$((6*7))\n")}))
+	readUntil(t, conn, "mark-42\r\n")
+
+	// A later change of size replays the screen
+	resize(40, 120)
+	readUntil(t, conn, "mark-42\r\n")
+}
+
+func TestSessionInit(t *testing.T) {
+	s := startTestSessionWith(t, SessionOptions{Shell: "/bin/sh", Init: "echo init-$((6*7))"})
+	conn, err := net.Dial("unix", s.socketPath)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.Write(Encode(Hello{}.message()))
+
+	// The shell runs it without anyone typing, whether before the
+	// redraw or after
+	readUntil(t, conn, "init-42\r\n")
+}
+
+func TestSessionLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.log")
+	s := startTestSessionWith(t, SessionOptions{Shell: "/bin/sh", Log: path, LogTimestamps: true})
+	conn, err := net.Dial("unix", s.socketPath)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.Write(Encode(Hello{}.message()))
+	conn.Write(Encode(Message{Type: MsgData, Payload: []byte("echo logged-$((6*7))\n")}))
+
+	// The client sees plain output; the log has it with timestamps
+	if out := readUntil(t, conn, "logged-42\r\n"); strings.Contains(out, time.Now().Format("2006-01-02T")) {
+		t.Errorf("client output has timestamps: %q", out)
+	}
+	s.mu.Lock()
+	logged, _ := os.ReadFile(path)
+	s.mu.Unlock()
+	if !regexp.MustCompile(`(?m)^\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{3}\S* .*logged-42\r$`).Match(logged) {
+		t.Errorf("log = %q, want a timestamped logged-42 line", logged)
+	}
+}
@@ -0,0 +1,51 @@
+//go:build unix
+
+package mux
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSessionSignal(t *testing.T) {
+	s := startTestSession(t)
+	conn, err := net.Dial("unix", s.socketPath)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.Write(Encode(Hello{}.message()))
+	conn.Write(Encode(Message{Type: MsgData, Payload: []byte("trap 'echo usr-$((6*7))' USR1; echo trap-$((1+1))\n")}))
+	readUntil(t, conn, "trap-2")
+
+	// Unknown signals are refused; known ones reach the shell without
+	// kicking the client
+	info := SessionInfo{Socket: s.socketPath}
+	conn2, err := net.Dial("unix", s.socketPath)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	conn2.Write(Encode(Message{Type: MsgSignal, Payload: []byte{99}}))
+	conn2.Close()
+	if err := SignalSession(info, syscall.SIGUSR1); err != nil {
+		t.Fatalf("SignalSession: %v", err)
+	}
+
+	// sh runs the trap once it is done reading a line, so keep sending
+	// them until the signal has arrived
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(100 * time.Millisecond):
+				conn.Write(Encode(Message{Type: MsgData, Payload: []byte("\n")}))
+			}
+		}
+	}()
+	readUntil(t, conn, "usr-42")
+}
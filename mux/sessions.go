@@ -0,0 +1,529 @@
+package mux
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// SessionInfo is the JSON metadata written to the info file.
+type SessionInfo struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	PID     int    `json:"pid"`
+	Created string `json:"created"`
+	Socket  string `json:"socket"`
+	Listen  string `json:"listen,omitempty"` // TCP address, if any
+
+	// CreatedNano is Created in nanoseconds since the Unix epoch, so
+	// sessions started within the same second still sort in the order
+	// they were. Created, to the second, is for display.
+	CreatedNano int64 `json:"created_ns,omitempty"`
+
+	// Rows and Cols are the session's last terminal size, if known
+	Rows int `json:"rows,omitempty"`
+	Cols int `json:"cols,omitempty"`
+}
+
+// SocketDir returns the directory for session sockets and info files:
+// $MHIST_SOCKET_DIR if set, else mhist under $XDG_RUNTIME_DIR, else a
+// per-user directory under $TMPDIR or /tmp.
+func SocketDir() string {
+	if dir := os.Getenv("MHIST_SOCKET_DIR"); dir != "" {
+		return dir
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "mhist")
+	}
+	return tmpSocketDir()
+}
+
+// EnsureSocketDir creates SocketDir if needed, checks that it is private
+// to this user and returns it.
+func EnsureSocketDir() (string, error) {
+	dir := SocketDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("create socket dir: %w", err)
+	}
+	if err := checkPrivateDir(dir); err != nil {
+		return "", fmt.Errorf("socket dir: %w", err)
+	}
+	return dir, nil
+}
+
+// socketDirs returns the directories sessions may be in, SocketDir first.
+// $MHIST_SOCKET_DIR, when set, is the only one. Otherwise the session
+// may have been started with a different $XDG_RUNTIME_DIR or $TMPDIR,
+// e.g. from an SSH login that set it and a mosh or su shell that didn't,
+// so the per-user runtime dir and the temporary dirs are searched as well.
+func socketDirs() []string {
+	dirs := []string{SocketDir()}
+	if os.Getenv("MHIST_SOCKET_DIR") != "" {
+		return dirs
+	}
+	for _, dir := range fallbackSocketDirs() {
+		if !slices.Contains(dirs, dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// ListSessions returns the running sessions in the default FileStore.
+func ListSessions() []SessionInfo {
+	return FileStore{}.List()
+}
+
+// List scans the socket directories for session info files, cleaning up
+// after sessions that are gone. Sessions are listed oldest first. A
+// directory that isn't private to the user is skipped: another user could
+// have created it first, e.g. /tmp/mhist-UID, to plant sessions that would
+// be sent our keystrokes.
+func (FileStore) List() []SessionInfo {
+	var sessions []SessionInfo
+	seen := make(map[string]bool)
+	for _, dir := range socketDirs() {
+		if checkPrivateDir(dir) != nil {
+			continue
+		}
+		for _, info := range listSessionsIn(dir) {
+			if !seen[info.ID] {
+				seen[info.ID] = true
+				sessions = append(sessions, info)
+			}
+		}
+	}
+	slices.SortStableFunc(sessions, func(a, b SessionInfo) int {
+		if c := cmp.Compare(a.createdNano(), b.createdNano()); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	return sessions
+}
+
+// createdNano returns when the session was created, in nanoseconds since
+// the Unix epoch. Sessions from before CreatedNano was added only have
+// Created, to the second; ones without either sort first.
+func (info SessionInfo) createdNano() int64 {
+	if info.CreatedNano != 0 {
+		return info.CreatedNano
+	}
+	t, err := time.Parse(time.RFC3339, info.Created)
+	if err != nil {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// listSessionsIn reads the session info files in dir, cleaning up after
+// sessions that are gone.
+func listSessionsIn(dir string) []SessionInfo {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	var sessions []SessionInfo
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".log") {
+			removeOrphanLog(dir, entry)
+			continue
+		}
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		var info SessionInfo
+		if err := json.Unmarshal(data, &info); err != nil {
+			continue
+		}
+
+		if !IsSessionAlive(info) {
+			// Clean up stale files
+			os.Remove(info.Socket)
+			os.Remove(filepath.Join(dir, entry.Name()))
+			os.Remove(filepath.Join(dir, info.ID+".env"))
+			continue
+		}
+
+		sessions = append(sessions, info)
+	}
+	return sessions
+}
+
+// orphanLogAge is how long the log of a session that is gone is kept. A
+// session removes its log when it exits cleanly, so these are mostly left
+// by sessions that crashed, kept for a while to find out why.
+const orphanLogAge = 7 * 24 * time.Hour
+
+// removeOrphanLog removes a session log in dir once its session is gone
+// and it has gone unmodified for orphanLogAge.
+func removeOrphanLog(dir string, entry os.DirEntry) {
+	id := strings.TrimSuffix(entry.Name(), ".log")
+	if _, err := os.Stat(filepath.Join(dir, id+".json")); err == nil {
+		return
+	}
+	fi, err := entry.Info()
+	if err != nil || time.Since(fi.ModTime()) < orphanLogAge {
+		return
+	}
+	os.Remove(filepath.Join(dir, entry.Name()))
+}
+
+// FindSession finds a session by name, index or ID prefix; see
+// ResolveSession.
+func FindSession(sessions []SessionInfo, target string) (SessionInfo, error) {
+	info, _, err := ResolveSession(sessions, target)
+	return info, err
+}
+
+// ResolveSession finds the session target refers to. In order of
+// precedence, target is:
+//
+//   - empty, for the most recent session
+//   - a session's exact name
+//   - a session's index, counting from 1 in the order sessions are listed
+//   - a prefix of exactly one session's ID; a prefix of more is an error
+//     listing them
+//
+// When target also refers to a different session by a rule further down,
+// hint says so and how to pick that one instead.
+func ResolveSession(sessions []SessionInfo, target string) (info SessionInfo, hint string, err error) {
+	if target == "" {
+		if len(sessions) == 0 {
+			return SessionInfo{}, "", fmt.Errorf("no sessions found")
+		}
+		return sessions[len(sessions)-1], "", nil
+	}
+
+	var candidates []SessionInfo
+	for _, info := range sessions {
+		if info.Name == target {
+			candidates = append(candidates, info)
+			break
+		}
+	}
+	if n, err := strconv.Atoi(target); err == nil && n >= 1 && n <= len(sessions) {
+		candidates = append(candidates, sessions[n-1])
+	}
+	prefix, err := findByPrefix(sessions, target)
+	if err == nil {
+		candidates = append(candidates, prefix)
+	}
+	if len(candidates) == 0 {
+		return SessionInfo{}, "", err
+	}
+
+	info = candidates[0]
+	for _, other := range candidates[1:] {
+		if other.ID != info.ID {
+			hint = fmt.Sprintf("%q also refers to session %s (%s); use its ID to attach to it instead",
+				target, other.Name, other.ID)
+			break
+		}
+	}
+	return info, hint, nil
+}
+
+// SessionNamed returns the session called name, going by its name alone
+// rather than everything ResolveSession tries. If several have the name,
+// it is the last one listed.
+func SessionNamed(sessions []SessionInfo, name string) (SessionInfo, bool) {
+	for i := len(sessions) - 1; i >= 0; i-- {
+		if sessions[i].Name == name {
+			return sessions[i], true
+		}
+	}
+	return SessionInfo{}, false
+}
+
+// findByPrefix finds the one session whose ID starts with prefix.
+func findByPrefix(sessions []SessionInfo, prefix string) (SessionInfo, error) {
+	var matches []SessionInfo
+	for _, info := range sessions {
+		if strings.HasPrefix(info.ID, prefix) {
+			matches = append(matches, info)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return SessionInfo{}, fmt.Errorf("session not found: %s", prefix)
+	case 1:
+		return matches[0], nil
+	}
+	// Like a short git hash, a prefix has to pick out one session
+	candidates := make([]string, len(matches))
+	for i, info := range matches {
+		candidates[i] = fmt.Sprintf("%s (%s)", info.ID, info.Name)
+	}
+	return SessionInfo{}, fmt.Errorf("ambiguous prefix %s, %d matches: %s",
+		prefix, len(matches), strings.Join(candidates, ", "))
+}
+
+// DialTimeout bounds how long connecting to a session, and each step of
+// a request to it, may take, so a wedged session is an error rather than
+// a hung command. It is $MHIST_TIMEOUT if that is a valid duration.
+var DialTimeout = envTimeout("MHIST_TIMEOUT", 5*time.Second)
+
+// envTimeout returns the positive duration in environment variable name,
+// or def if it is unset or invalid.
+func envTimeout(name string, def time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(name)); err == nil && d > 0 {
+		return d
+	}
+	return def
+}
+
+// dialSession connects to a session's Unix socket.
+func dialSession(info SessionInfo) (net.Conn, error) {
+	conn, err := net.DialTimeout("unix", info.Socket, DialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("connect to session: %w", err)
+	}
+	conn.SetWriteDeadline(time.Now().Add(DialTimeout))
+	return conn, nil
+}
+
+// KillSession kills a session by sending MsgKill via its socket, falling back
+// to a direct process kill, and cleaning up socket/info files.
+func KillSession(info SessionInfo) {
+	// Try sending MsgKill via socket. The session hangs up once it has
+	// handled it; one that doesn't is wedged, and is killed directly.
+	if conn, err := dialSession(info); err == nil {
+		_, err = conn.Write(Encode(Message{Type: MsgKill, Payload: nil}))
+		if err == nil {
+			conn.SetReadDeadline(time.Now().Add(DialTimeout))
+			_, err = conn.Read(make([]byte, 1))
+		}
+		conn.Close()
+		var ne net.Error
+		if !errors.As(err, &ne) || !ne.Timeout() {
+			return
+		}
+	}
+
+	// Fallback: kill the process directly
+	proc, err := os.FindProcess(info.PID)
+	if err == nil {
+		proc.Kill()
+	}
+
+	// Clean up stale files
+	os.Remove(info.Socket)
+	// The files are next to the socket, which may not be in SocketDir
+	dir := filepath.Dir(info.Socket)
+	os.Remove(filepath.Join(dir, info.ID+".json"))
+	os.Remove(filepath.Join(dir, info.ID+".env"))
+}
+
+// ClearSessionHistory wipes a session's scrollback without disturbing its
+// attached client, other than clearing that client's screen.
+func ClearSessionHistory(info SessionInfo) error {
+	conn, err := dialSession(info)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write(Encode(Message{Type: MsgClearHistory}))
+	return err
+}
+
+// DetachSession detaches whatever client is attached to a session, e.g.
+// one left on a machine that can't be reached. The session keeps running.
+func DetachSession(info SessionInfo) error {
+	conn, err := dialSession(info)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write(Encode(Message{Type: MsgDetachAll}))
+	return err
+}
+
+// SendInput types data into a session as if on its terminal, without
+// attaching to it.
+func SendInput(info SessionInfo, data []byte) error {
+	conn, err := dialSession(info)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write(Encode(Message{Type: MsgInput, Payload: data}))
+	return err
+}
+
+// SignalSession sends sig to a session's shell. The session ignores a
+// signal ParseSignal doesn't know.
+func SignalSession(info SessionInfo, sig syscall.Signal) error {
+	conn, err := dialSession(info)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write(Encode(Message{Type: MsgSignal, Payload: []byte{byte(sig)}}))
+	return err
+}
+
+// ParseSignal parses a signal name, with or without the SIG prefix and in
+// any case, or its number, e.g. "TERM", "sigterm" or "15".
+func ParseSignal(s string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		if knownSignal(syscall.Signal(n)) {
+			return syscall.Signal(n), nil
+		}
+		return 0, fmt.Errorf("unknown signal %s", s)
+	}
+	name := strings.TrimPrefix(strings.ToUpper(s), "SIG")
+	if sig, ok := signalNames[name]; ok {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("unknown signal %s", s)
+}
+
+// knownSignal reports whether sig is one ParseSignal accepts.
+func knownSignal(sig syscall.Signal) bool {
+	for _, known := range signalNames {
+		if sig == known {
+			return true
+		}
+	}
+	return false
+}
+
+// QueryStats asks a session for its scrollback and state.
+func QueryStats(info SessionInfo) (Stats, error) {
+	conn, err := dialSession(info)
+	if err != nil {
+		return Stats{}, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write(Encode(Message{Type: MsgStatsRequest})); err != nil {
+		return Stats{}, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(DialTimeout))
+	for {
+		msg, err := Decode(conn)
+		if err != nil {
+			return Stats{}, fmt.Errorf("read stats: %w", err)
+		}
+		if msg.Type != MsgStatsResponse {
+			continue
+		}
+		var stats Stats
+		if err := json.Unmarshal(msg.Payload, &stats); err != nil {
+			return Stats{}, fmt.Errorf("read stats: %w", err)
+		}
+		return stats, nil
+	}
+}
+
+// QueryHistory returns the last n lines of a session's scrollback,
+// including the line being typed, without attaching to it. A session
+// that doesn't answer within timeout is an error.
+func QueryHistory(info SessionInfo, n int, timeout time.Duration) ([][]byte, error) {
+	data, err := queryHistory(info, n, historyPlain, timeout)
+	if err != nil || len(data) == 0 {
+		return nil, err
+	}
+	// Sessions from before plain text was asked for still send "\r\n"
+	lines := bytes.Split(data, lf)
+	for i, line := range lines {
+		lines[i] = bytes.TrimSuffix(line, cr)
+	}
+	// The line being typed comes on top of the n asked for
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines, nil
+}
+
+// QueryRawHistory is QueryHistory for the scrollback as a client replays
+// it: escape sequences and carriage returns kept, lines ending in "\r\n"
+// (or, for raw scrollback, not split at all).
+func QueryRawHistory(info SessionInfo, n int, timeout time.Duration) ([]byte, error) {
+	return queryHistory(info, n, 0, timeout)
+}
+
+// queryHistory asks a session for its last n lines with the given history
+// request flags and returns the line data of the response.
+func queryHistory(info SessionInfo, n int, flags byte, timeout time.Duration) ([]byte, error) {
+	conn, err := net.DialTimeout("unix", info.Socket, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("connect to session: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	payload := make([]byte, 9)
+	binary.BigEndian.PutUint32(payload[0:4], historyFromEnd)
+	binary.BigEndian.PutUint32(payload[4:8], uint32(n))
+	payload[8] = flags
+	if _, err := conn.Write(Encode(Message{Type: MsgHistoryRequest, Payload: payload})); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	for {
+		msg, err := Decode(r)
+		if err != nil {
+			return nil, fmt.Errorf("read history: %w", err)
+		}
+		if msg.Type != MsgHistoryResponse || len(msg.Payload) < 8 {
+			continue
+		}
+		return msg.Payload[8:], nil
+	}
+}
+
+// IsProcessAlive checks if a PID is alive.
+func IsProcessAlive(pid int) bool {
+	return processAlive(pid)
+}
+
+// liveTimeout bounds how long IsSessionAlive waits to connect.
+const liveTimeout = 200 * time.Millisecond
+
+// IsSessionAlive checks that a session's process is alive and that its
+// socket takes connections. The PID alone can mislead: it may belong to a
+// zombie, or to an unrelated process that was given the PID after the
+// session died. A socket that is gone or refuses connections means the
+// session is dead; one that is merely slow to answer doesn't.
+func IsSessionAlive(info SessionInfo) bool {
+	if !IsProcessAlive(info.PID) {
+		return false
+	}
+	conn, err := net.DialTimeout("unix", info.Socket, liveTimeout)
+	if err != nil {
+		return !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, syscall.ECONNREFUSED)
+	}
+	// Hanging up without a message doesn't disturb the session
+	conn.Close()
+	return true
+}
+
+// GenerateID generates a random UUID-like identifier.
+func GenerateID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("%08x-%04x-%04x-%04x-%012x",
+		b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -0,0 +1,177 @@
+package mux
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// findStore holds sessions for the FindSession tests, oldest first.
+func findStore() *MemStore {
+	store := &MemStore{}
+	for _, info := range []SessionInfo{
+		{ID: "3f2a9c10-aaaa", Name: "work"},
+		{ID: "3f2b0d44-bbbb", Name: "logs"},
+		{ID: "7c1e5b22-cccc", Name: "3f2a"}, // a name that looks like an ID
+	} {
+		store.Put(info)
+	}
+	return store
+}
+
+func TestFindSession(t *testing.T) {
+	sessions := findStore().List()
+	tests := []struct {
+		target string
+		want   string // ID, or "" for an error
+	}{
+		{"", "7c1e5b22-cccc"},     // most recent
+		{"work", "3f2a9c10-aaaa"}, // name
+		{"3f2b", "3f2b0d44-bbbb"}, // ID prefix
+		{"3f2a", "7c1e5b22-cccc"}, // exact name wins over ID prefix
+		{"3f2a9c10-aaaa", "3f2a9c10-aaaa"},
+		{"3f2", ""}, // ambiguous prefix
+		{"nope", ""},
+		{"wor", ""}, // names must match exactly
+	}
+	for _, tt := range tests {
+		info, err := FindSession(sessions, tt.target)
+		switch {
+		case tt.want == "" && err == nil:
+			t.Errorf("FindSession(%q) = %s, want an error", tt.target, info.ID)
+		case tt.want != "" && err != nil:
+			t.Errorf("FindSession(%q): %v", tt.target, err)
+		case info.ID != tt.want:
+			t.Errorf("FindSession(%q) = %s, want %s", tt.target, info.ID, tt.want)
+		}
+	}
+
+	_, err := FindSession(sessions, "3f2")
+	if err == nil || !strings.Contains(err.Error(), "2 matches") ||
+		!strings.Contains(err.Error(), "3f2a9c10-aaaa (work)") || !strings.Contains(err.Error(), "3f2b0d44-bbbb (logs)") {
+		t.Errorf("ambiguous prefix: got %v, want an error listing both sessions", err)
+	}
+
+	if _, err := FindSession(nil, ""); err == nil {
+		t.Error("FindSession with no sessions: expected an error")
+	}
+}
+
+func TestResolveSessionIndex(t *testing.T) {
+	store := findStore()
+	store.Put(SessionInfo{ID: "9d0e1f22-dddd", Name: "2"})
+	sessions := store.List()
+
+	tests := []struct {
+		target, want string
+		hint         bool
+	}{
+		{"1", "3f2a9c10-aaaa", false},
+		{"3", "7c1e5b22-cccc", false},
+		{"2", "9d0e1f22-dddd", true}, // name "2" wins over the 2nd session
+		{"4", "9d0e1f22-dddd", false},
+		{"7", "7c1e5b22-cccc", false}, // no 7th session, so an ID prefix
+		{"3f2a", "7c1e5b22-cccc", true},
+	}
+	for _, tt := range tests {
+		info, hint, err := ResolveSession(sessions, tt.target)
+		if err != nil {
+			t.Errorf("ResolveSession(%q): %v", tt.target, err)
+			continue
+		}
+		if info.ID != tt.want {
+			t.Errorf("ResolveSession(%q) = %s, want %s", tt.target, info.ID, tt.want)
+		}
+		if (hint != "") != tt.hint {
+			t.Errorf("ResolveSession(%q) hint = %q, want hint %v", tt.target, hint, tt.hint)
+		}
+	}
+	if _, err := FindSession(sessions, "0"); err == nil {
+		t.Error("FindSession(\"0\"): expected an error")
+	}
+}
+
+func TestSessionNamed(t *testing.T) {
+	store := findStore()
+	store.Put(SessionInfo{ID: "9d0e1f22-dddd", Name: "work"})
+	sessions := store.List()
+
+	if info, ok := SessionNamed(sessions, "work"); !ok || info.ID != "9d0e1f22-dddd" {
+		t.Errorf("SessionNamed(work) = %s, %v; want the newest work session", info.ID, ok)
+	}
+	// Not by number or ID prefix
+	for _, name := range []string{"1", "3f2b", "wor"} {
+		if info, ok := SessionNamed(sessions, name); ok {
+			t.Errorf("SessionNamed(%q) = %s, want none", name, info.ID)
+		}
+	}
+}
+
+func TestParseSignal(t *testing.T) {
+	for _, s := range []string{"TERM", "SIGTERM", "term", "15"} {
+		if sig, err := ParseSignal(s); err != nil || sig != syscall.SIGTERM {
+			t.Errorf("ParseSignal(%q) = %v, %v; want SIGTERM", s, sig, err)
+		}
+	}
+	for _, s := range []string{"", "FOO", "SIG", "0", "99", "-1"} {
+		if sig, err := ParseSignal(s); err == nil {
+			t.Errorf("ParseSignal(%q) = %v, want an error", s, sig)
+		}
+	}
+}
+
+func TestKillSessionWedged(t *testing.T) {
+	defer func(d time.Duration) { DialTimeout = d }(DialTimeout)
+	DialTimeout = 200 * time.Millisecond
+
+	// Connections queue on the socket but are never accepted, as with a
+	// session whose accept loop is stuck
+	dir := t.TempDir()
+	sock := filepath.Join(dir, "wedged.sock")
+	listenFake(t, sock)
+	proc := exec.Command("sleep", "60")
+	if err := proc.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		proc.Wait()
+		close(exited)
+	}()
+
+	start := time.Now()
+	KillSession(SessionInfo{ID: "wedged", PID: proc.Process.Pid, Socket: sock})
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("KillSession took %v", d)
+	}
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		proc.Process.Kill()
+		t.Fatal("wedged session's process wasn't killed")
+	}
+	if _, err := os.Stat(sock); !os.IsNotExist(err) {
+		t.Errorf("socket left behind: %v", err)
+	}
+}
+
+func TestEnvTimeout(t *testing.T) {
+	for _, tt := range []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 5 * time.Second},
+		{"750ms", 750 * time.Millisecond},
+		{"soon", 5 * time.Second},
+		{"-1s", 5 * time.Second},
+	} {
+		t.Setenv("MHIST_TEST_TIMEOUT", tt.value)
+		if got := envTimeout("MHIST_TEST_TIMEOUT", 5*time.Second); got != tt.want {
+			t.Errorf("envTimeout with %q = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package mux
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// SessionStore keeps the info of running sessions, so that commands can
+// find them by name or ID.
+type SessionStore interface {
+	// List returns the running sessions.
+	List() []SessionInfo
+	// Get returns the session with the given ID.
+	Get(id string) (SessionInfo, bool)
+	// Put adds a session, replacing any with the same ID.
+	Put(info SessionInfo) error
+	// Delete removes a session. Removing one that isn't there is not an
+	// error.
+	Delete(id string) error
+}
+
+// FileStore is the SessionStore sessions register in: an <id>.json info
+// file per session, written to SocketDir and listed from all the
+// directories a session may be in.
+type FileStore struct{}
+
+// Get returns the running session with the given ID.
+func (fs FileStore) Get(id string) (SessionInfo, bool) {
+	return getSession(fs, id)
+}
+
+// Put writes the info file of a session.
+func (FileStore) Put(info SessionInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(infoFilePath(info.ID), data, 0600)
+}
+
+// Delete removes the info file of a session.
+func (FileStore) Delete(id string) error {
+	err := os.Remove(infoFilePath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// infoFilePath returns the path of session id's info file.
+func infoFilePath(id string) string {
+	return filepath.Join(SocketDir(), id+".json")
+}
+
+// MemStore is a SessionStore held in memory, for tests and for programs
+// that track sessions themselves. List returns sessions in the order they
+// were first put. The zero value is an empty store.
+type MemStore struct {
+	sessions []SessionInfo
+}
+
+// List returns the sessions in the store.
+func (m *MemStore) List() []SessionInfo {
+	return append([]SessionInfo(nil), m.sessions...)
+}
+
+// Get returns the session with the given ID.
+func (m *MemStore) Get(id string) (SessionInfo, bool) {
+	return getSession(m, id)
+}
+
+// Put adds or replaces a session.
+func (m *MemStore) Put(info SessionInfo) error {
+	for i := range m.sessions {
+		if m.sessions[i].ID == info.ID {
+			m.sessions[i] = info
+			return nil
+		}
+	}
+	m.sessions = append(m.sessions, info)
+	return nil
+}
+
+// Delete removes a session.
+func (m *MemStore) Delete(id string) error {
+	for i := range m.sessions {
+		if m.sessions[i].ID == id {
+			m.sessions = append(m.sessions[:i], m.sessions[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// getSession looks up id in store's list.
+func getSession(store SessionStore, id string) (SessionInfo, bool) {
+	for _, info := range store.List() {
+		if info.ID == id {
+			return info, true
+		}
+	}
+	return SessionInfo{}, false
+}
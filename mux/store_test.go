@@ -0,0 +1,87 @@
+package mux
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testStore checks the SessionStore contract on an empty store. The
+// sessions put are alive if there is something listening on sock.
+func testStore(t *testing.T, store SessionStore, sock string) {
+	t.Helper()
+	a := SessionInfo{ID: "aaaa", Name: "one", PID: os.Getpid(), Socket: sock}
+	b := SessionInfo{ID: "bbbb", Name: "two", PID: os.Getpid(), Socket: sock}
+	for _, info := range []SessionInfo{a, b} {
+		if err := store.Put(info); err != nil {
+			t.Fatalf("Put(%s): %v", info.ID, err)
+		}
+	}
+	if got := store.List(); len(got) != 2 {
+		t.Fatalf("List() = %+v, want 2 sessions", got)
+	}
+
+	a.Name = "renamed"
+	store.Put(a)
+	if got, ok := store.Get("aaaa"); !ok || got.Name != "renamed" {
+		t.Errorf("Get after Put = %+v, %v; want the renamed session", got, ok)
+	}
+
+	if err := store.Delete("aaaa"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, ok := store.Get("aaaa"); ok {
+		t.Error("deleted session still there")
+	}
+	if err := store.Delete("aaaa"); err != nil {
+		t.Errorf("Delete twice: %v", err)
+	}
+	if got := store.List(); len(got) != 1 || got[0].ID != "bbbb" {
+		t.Errorf("List() = %+v, want only bbbb", got)
+	}
+}
+
+func TestMemStore(t *testing.T) {
+	testStore(t, &MemStore{}, "")
+}
+
+func TestFileStore(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("MHIST_SOCKET_DIR", dir)
+	sock := filepath.Join(dir, "fake.sock")
+	listenFake(t, sock)
+	testStore(t, FileStore{}, sock)
+}
+
+func TestFileStoreListOrder(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("MHIST_SOCKET_DIR", dir)
+	sock := filepath.Join(dir, "fake.sock")
+	listenFake(t, sock)
+
+	// Started within the same second, in the opposite order to their IDs,
+	// and one from before the nanosecond time was kept
+	second := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, info := range []SessionInfo{
+		{ID: "aaaa", CreatedNano: second.Add(300 * time.Millisecond).UnixNano()},
+		{ID: "bbbb", CreatedNano: second.Add(100 * time.Millisecond).UnixNano()},
+		{ID: "cccc", Created: second.Add(-time.Second).Format(time.RFC3339)},
+	} {
+		info.PID, info.Socket = os.Getpid(), sock
+		if info.Created == "" {
+			info.Created = second.Format(time.RFC3339)
+		}
+		if err := (FileStore{}).Put(info); err != nil {
+			t.Fatalf("Put(%s): %v", info.ID, err)
+		}
+	}
+	var ids []string
+	for _, info := range (FileStore{}).List() {
+		ids = append(ids, info.ID)
+	}
+	if got := strings.Join(ids, " "); got != "cccc bbbb aaaa" {
+		t.Errorf("List() order = %s, want cccc bbbb aaaa", got)
+	}
+}
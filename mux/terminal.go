@@ -0,0 +1,120 @@
+package mux
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+)
+
+// enableRawMode puts the terminal into raw mode and returns the previous state.
+func enableRawMode(fd int) (*term.State, error) {
+	return term.MakeRaw(fd)
+}
+
+// restoreTerminal restores the terminal to the given state.
+func restoreTerminal(fd int, state *term.State) {
+	term.Restore(fd, state)
+}
+
+// enableMouseMode enables mouse button tracking with SGR encoding.
+// ?1000h enables basic mouse button reporting, ?1006h selects SGR format.
+func enableMouseMode(w io.Writer) {
+	io.WriteString(w, "\x1b[?1000h\x1b[?1006h")
+}
+
+// noMouseTerms are terminal types known not to report the mouse, so
+// enabling it would only print the escape sequences.
+var noMouseTerms = map[string]bool{
+	"":      true,
+	"dumb":  true,
+	"linux": true, // the Linux console
+	"vt100": true,
+	"vt102": true,
+	"vt220": true,
+}
+
+// mouseCapable reports whether a terminal of type term is likely to
+// support mouse reporting. Terminals that report the mouse but not in the
+// SGR encoding ignore ?1006h and send legacy reports instead, which the
+// client also parses.
+func mouseCapable(term string) bool {
+	return !noMouseTerms[term]
+}
+
+// disableMouseMode disables mouse tracking and SGR encoding.
+func disableMouseMode(w io.Writer) {
+	io.WriteString(w, "\x1b[?1006l\x1b[?1000l")
+}
+
+// clearScreen clears the terminal screen and moves cursor to top-left.
+func clearScreen(w io.Writer) {
+	io.WriteString(w, "\x1b[2J\x1b[H")
+}
+
+// displayWidth returns the number of columns line takes on the terminal,
+// or -1 if it can't tell, e.g. because the line moves the cursor back.
+// Escape sequences take none, tabs run to the next tab stop, every
+// tabWidth columns, and characters from U+1100 up are taken to be wide,
+// which overestimates some but never underestimates. A carriage return is
+// allowed only at the end, where the PTY leaves one on stored lines.
+func displayWidth(line []byte, tabWidth int) int {
+	w := 0
+	for i := 0; i < len(line); {
+		b := line[i]
+		switch {
+		case b == 0x1b:
+			n, _ := escapeLen(line[i:])
+			i += n
+			continue
+		case b == '\t':
+			w = (w/tabWidth + 1) * tabWidth
+		case b == '\r' && i == len(line)-1:
+		case b < 0x20 || b == 0x7f:
+			return -1
+		case b < utf8.RuneSelf:
+			w++
+		default:
+			r, size := utf8.DecodeRune(line[i:])
+			w++
+			if r >= 0x1100 {
+				w++
+			}
+			i += size
+			continue
+		}
+		i++
+	}
+	return w
+}
+
+// moveCursor moves the cursor to the given row and column (1-based).
+func moveCursor(w io.Writer, row, col int) {
+	fmt.Fprintf(w, "\x1b[%d;%dH", row, col)
+}
+
+// TerminalSize returns the size of the process's terminal, trying stdin
+// then stdout, and falling back to $LINES and $COLUMNS. Returns zeros if
+// the size is unknown.
+func TerminalSize() (rows, cols int) {
+	for _, f := range []*os.File{os.Stdin, os.Stdout} {
+		if rows, cols, err := getTerminalSize(int(f.Fd())); err == nil && validSize(rows, cols) {
+			return rows, cols
+		}
+	}
+	rows, _ = strconv.Atoi(os.Getenv("LINES"))
+	cols, _ = strconv.Atoi(os.Getenv("COLUMNS"))
+	if !validSize(rows, cols) {
+		return 0, 0
+	}
+	return rows, cols
+}
+
+// getTerminalSize returns the current terminal dimensions.
+func getTerminalSize(fd int) (rows, cols int, err error) {
+	cols, rows, err = term.GetSize(fd)
+	return rows, cols, err
+}
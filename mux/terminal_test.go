@@ -0,0 +1,59 @@
+package mux
+
+import "testing"
+
+func TestDisplayWidth(t *testing.T) {
+	for _, tt := range []struct {
+		line string
+		want int
+	}{
+		{"", 0},
+		{"hello", 5},
+		{"hello\r", 5},
+		{"\x1b[1;31mred\x1b[0m", 3},
+		{"\x1b]8;;http://x\x1b\\link\x1b]8;;\x1b\\", 4},
+		{"a\tb", 9},
+		{"1234567\tb", 9},
+		{"12345678\tb", 17},
+		{"héllo", 5},
+		{"日本", 4},
+		{"a\rb", -1},
+		{"a\bb", -1},
+	} {
+		if got := displayWidth([]byte(tt.line), 8); got != tt.want {
+			t.Errorf("displayWidth(%q) = %d, want %d", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestDisplayWidthTabWidth(t *testing.T) {
+	for _, tt := range []struct {
+		line     string
+		tabWidth int
+		want     int
+	}{
+		{"a\tb", 4, 5},
+		{"123\tb", 4, 5},
+		{"1234\tb", 4, 9},
+		{"\t\tb", 4, 9},
+		{"\t\tb", 2, 5},
+		{"a\tb", 1, 3},
+		{"\x1b[1m\x1b[0m\tb", 4, 5},
+	} {
+		if got := displayWidth([]byte(tt.line), tt.tabWidth); got != tt.want {
+			t.Errorf("displayWidth(%q, %d) = %d, want %d", tt.line, tt.tabWidth, got, tt.want)
+		}
+	}
+}
+
+func TestHistoryViewFitsTabs(t *testing.T) {
+	// Two tabs and a letter take 9 columns with stops every 4, but wrap
+	// on a 10 column terminal with stops every 8
+	h := &historyView{lines: [][]byte{[]byte("\t\tb"), []byte("ok")}, rows: 2, cols: 10}
+	if !h.fits(4) {
+		t.Error("fits(4) = false, want the tabbed line on one row")
+	}
+	if h.fits(8) {
+		t.Error("fits(8) = true, want the tabbed line to wrap")
+	}
+}
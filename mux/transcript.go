@@ -0,0 +1,60 @@
+package mux
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"time"
+)
+
+// transcriptTimeFormat is the ISO 8601 timestamp put before each line of
+// a transcript when timestamps are on.
+const transcriptTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// transcript appends session output to a plain log file exactly as the
+// PTY wrote it, optionally with each line prefixed by the time its first
+// byte arrived.
+type transcript struct {
+	f          *os.File
+	timestamps bool
+	midLine    bool // the last write didn't end a line
+	now        func() time.Time
+}
+
+// newTranscript opens path for appending, creating it if needed.
+func newTranscript(path string, timestamps bool) (*transcript, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("open log: %w", err)
+	}
+	return &transcript{f: f, timestamps: timestamps, now: time.Now}, nil
+}
+
+// output logs a chunk of PTY output. Write errors are ignored, as for
+// recordings.
+func (t *transcript) output(data []byte) {
+	if !t.timestamps {
+		t.f.Write(data)
+		return
+	}
+	stamp := t.now().Format(transcriptTimeFormat) + " "
+	var out []byte
+	for len(data) > 0 {
+		if !t.midLine {
+			out = append(out, stamp...)
+		}
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line = data[:i+1]
+		}
+		out = append(out, line...)
+		data = data[len(line):]
+		t.midLine = line[len(line)-1] != '\n'
+	}
+	t.f.Write(out)
+}
+
+// close closes the file.
+func (t *transcript) close() {
+	t.f.Close()
+}
@@ -0,0 +1,44 @@
+package mux
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTranscript(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.log")
+	tr, err := newTranscript(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.output([]byte("\x1b[32mok\x1b[0m\r\n$ "))
+	tr.close()
+	if got, _ := os.ReadFile(path); string(got) != "\x1b[32mok\x1b[0m\r\n$ " {
+		t.Errorf("log = %q, want the output unchanged", got)
+	}
+}
+
+func TestTranscriptTimestamps(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.log")
+	tr, err := newTranscript(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tr.now = func() time.Time { return now }
+
+	tr.output([]byte("make\r\nbuil"))
+	now = now.Add(1500 * time.Millisecond)
+	// The rest of a line keeps the time it started at
+	tr.output([]byte("ding\r\ndone\r\n"))
+	tr.close()
+
+	want := "2024-05-01T12:00:00.000Z make\r\n" +
+		"2024-05-01T12:00:00.000Z building\r\n" +
+		"2024-05-01T12:00:01.500Z done\r\n"
+	if got, _ := os.ReadFile(path); string(got) != want {
+		t.Errorf("log = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,67 @@
+package mux
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+)
+
+// Transport creates listeners and connections for one kind of address.
+// Everything above it (acceptClients, handleClient, Decode) only sees a
+// net.Conn and doesn't care which transport produced it.
+type Transport interface {
+	Listen(addr string) (net.Listener, error)
+	Dial(addr string) (net.Conn, error)
+}
+
+// UnixTransport connects over Unix domain sockets. It is the default.
+type UnixTransport struct{}
+
+func (UnixTransport) Listen(addr string) (net.Listener, error) { return net.Listen("unix", addr) }
+func (UnixTransport) Dial(addr string) (net.Conn, error) {
+	return net.DialTimeout("unix", addr, DialTimeout)
+}
+
+// Dial connects to a session over the given transport.
+func Dial(t Transport, addr string) (net.Conn, error) {
+	conn, err := t.Dial(addr)
+	if err != nil {
+		return nil, fmt.Errorf("connect to session: %w", err)
+	}
+	tuneConn(conn)
+	return conn, nil
+}
+
+// tcpNoDelay controls whether Nagle's algorithm is disabled on TCP
+// connections. Keystrokes are sent as tiny messages, so coalescing them
+// only adds latency.
+var tcpNoDelay = true
+
+// tuneConn configures a freshly dialed or accepted connection for
+// interactive use. Unix sockets have no send-side coalescing and need no
+// tuning; messages are written unbuffered on both sides of the connection.
+func tuneConn(conn net.Conn) {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetNoDelay(tcpNoDelay)
+	}
+}
+
+// TLSTransport connects over TCP wrapped in TLS, for attaching to a
+// session from another host. The wire protocol runs unchanged on top of
+// the encrypted connection. There is no plain TCP transport: anyone who
+// can reach a listener gets a shell, so a listener's Config should require
+// client certificates.
+type TLSTransport struct {
+	Config *tls.Config
+}
+
+func (t TLSTransport) Listen(addr string) (net.Listener, error) {
+	return tls.Listen("tcp", addr, t.Config)
+}
+
+func (t TLSTransport) Dial(addr string) (net.Conn, error) {
+	return tls.DialWithDialer(&net.Dialer{Timeout: DialTimeout}, "tcp", addr, t.Config)
+}
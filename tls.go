@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+)
+
+// tlsOptions holds the TLS settings given on the command line.
+type tlsOptions struct {
+	enabled  bool   // use TLS even if no files are given (client only)
+	cert     string // certificate file
+	key      string // private key file
+	ca       string // CA bundle used to verify the peer
+	insecure bool   // skip server certificate verification (client only)
+}
+
+// active reports whether TLS was requested.
+func (o tlsOptions) active() bool {
+	return o.enabled || o.cert != "" || o.key != "" || o.ca != "" || o.insecure
+}
+
+// serverConfig builds the listener configuration. Clients must present a
+// certificate signed by the CA: a listener gives a shell to anyone who can
+// connect, so one without client authentication is refused, even on
+// loopback where any local user could reach it.
+func (o tlsOptions) serverConfig() (*tls.Config, error) {
+	if o.cert == "" || o.key == "" || o.ca == "" {
+		return nil, fmt.Errorf("--listen requires --tls-cert, --tls-key and --tls-ca so that clients are authenticated")
+	}
+	cert, err := tls.LoadX509KeyPair(o.cert, o.key)
+	if err != nil {
+		return nil, fmt.Errorf("load TLS certificate: %w", err)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	pool, err := loadCertPool(o.ca)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	return cfg, nil
+}
+
+// clientConfig builds the dialer configuration for connecting to addr.
+func (o tlsOptions) clientConfig(addr string) (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q: %w", addr, err)
+	}
+	cfg := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: o.insecure,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if o.ca != "" {
+		pool, err := loadCertPool(o.ca)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if o.cert != "" || o.key != "" {
+		cert, err := tls.LoadX509KeyPair(o.cert, o.key)
+		if err != nil {
+			return nil, fmt.Errorf("load TLS client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// loadCertPool reads a PEM bundle of CA certificates.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
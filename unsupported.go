@@ -0,0 +1,17 @@
+//go:build !unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// Sessions are built on Unix sockets, ptys and process groups, so there is
+// no mhist for other systems yet. This stands in for the real main there,
+// so a build gives a clear answer instead of a wall of compile errors.
+func main() {
+	fmt.Fprintf(os.Stderr, "mhist: %s is not supported; mhist needs a Unix system such as Linux or macOS\n", runtime.GOOS)
+	os.Exit(1)
+}